@@ -0,0 +1,350 @@
+// Command loadtest drives a running url-shortener with a mix of shortify and
+// redirect traffic and reports latency percentiles and error rates.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	var (
+		target      = flag.String("target", "http://localhost:8080", "base URL of the instance under test")
+		duration    = flag.Duration("duration", 30*time.Second, "how long to generate traffic")
+		rps         = flag.Int("rps", 100, "requests per second, 0 sends as fast as possible")
+		concurrency = flag.Int("concurrency", 16, "number of concurrent clients")
+		ratio       = flag.Float64("shortify-ratio", 0.1, "fraction of requests creating links, the rest are redirects")
+		seed        = flag.Int("seed", 100, "links created before the run starts")
+		dist        = flag.String("dist", "zipf", "distribution of redirected keys: zipf or uniform")
+		zipfS       = flag.Float64("zipf.s", 1.1, "zipf s parameter, must be > 1")
+		zipfV       = flag.Float64("zipf.v", 1, "zipf v parameter, must be >= 1")
+		timeout     = flag.Duration("timeout", 5*time.Second, "per request timeout")
+		asJSON      = flag.Bool("json", false, "print the report as JSON")
+		apiKey      = flag.String("api-key", "", "API key sent as X-API-Key when creating links, required by tenants having keys")
+	)
+	flag.Parse()
+
+	if *ratio < 0 || *ratio > 1 || *concurrency < 1 || *seed < 1 {
+		fmt.Fprintln(os.Stderr, "invalid flags")
+		os.Exit(2)
+	}
+	if *rps < 0 || *rps > int(time.Second) {
+		fmt.Fprintf(os.Stderr, "-rps must be between 0 and %d\n", int(time.Second))
+		os.Exit(2)
+	}
+	if *dist != "zipf" && *dist != "uniform" {
+		fmt.Fprintln(os.Stderr, "-dist must be zipf or uniform")
+		os.Exit(2)
+	}
+	if *dist == "zipf" && (*zipfS <= 1 || *zipfV < 1) {
+		fmt.Fprintln(os.Stderr, "zipf needs s > 1 and v >= 1")
+		os.Exit(2)
+	}
+
+	c := &client{
+		base: strings.TrimRight(*target, "/") + "/",
+		http: &http.Client{
+			Timeout: *timeout,
+			// redirects are measured, not followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+		run:    time.Now().UnixNano(),
+		apiKey: *apiKey,
+	}
+
+	keys := &keyPool{}
+	for i := 0; i < *seed; i++ {
+		id, status, err := c.shortify()
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("status %d", status)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "seeding failed: %v\n", err)
+			os.Exit(1)
+		}
+		keys.add(id)
+	}
+
+	var tokens <-chan time.Time
+	if *rps > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(*rps))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	rec := newRecorder()
+	stop := make(chan struct{})
+	time.AfterFunc(*duration, func() { close(stop) })
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(c.run + int64(w)))
+			pick := &picker{rnd: rnd, dist: *dist, s: *zipfS, v: *zipfV}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-stop:
+						return
+					}
+				}
+				begin := time.Now()
+				if rnd.Float64() < *ratio {
+					id, status, err := c.shortify()
+					rec.record("shortify", time.Since(begin), status, err)
+					if err == nil && status == http.StatusOK {
+						keys.add(id)
+					}
+					continue
+				}
+				status, err := c.redirect(keys.pick(pick))
+				rec.record("redirect", time.Since(begin), status, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	report := rec.report(time.Since(start))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	report.print(os.Stdout)
+}
+
+type client struct {
+	base    string
+	http    *http.Client
+	run     int64
+	counter int64
+	// apiKey, if set, authenticates the links created
+	apiKey string
+}
+
+// shortify creates a link to a destination never used before.
+func (c *client) shortify() (string, int, error) {
+	n := atomic.AddInt64(&c.counter, 1)
+	body, _ := json.Marshal(map[string]string{
+		"url": fmt.Sprintf("https://loadtest.example.com/%d/%d", c.run, n),
+	})
+	req, err := http.NewRequest(http.MethodPost, c.base, bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		ShortURL string `json:"shortURL"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", resp.StatusCode, err
+	}
+	return res.ShortURL[strings.LastIndex(res.ShortURL, "/")+1:], resp.StatusCode, nil
+}
+
+func (c *client) redirect(id string) (int, error) {
+	resp, err := c.http.Get(c.base + id)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// keyPool holds the ids of the links known to exist.
+type keyPool struct {
+	mtx sync.RWMutex
+	ids []string
+}
+
+func (p *keyPool) add(id string) {
+	p.mtx.Lock()
+	p.ids = append(p.ids, id)
+	p.mtx.Unlock()
+}
+
+// picker draws the ids redirected by one worker.
+type picker struct {
+	rnd  *rand.Rand
+	dist string
+	s, v float64
+	zipf *rand.Zipf
+	// size is the number of ids zipf was built for
+	size int
+}
+
+// pick returns an id, with zipf the oldest links are the most popular. The
+// zipf generator is only rebuilt when the pool has doubled, the newest ids
+// it does not cover yet are the least popular anyway.
+func (p *keyPool) pick(w *picker) string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	n := len(p.ids)
+	if w.dist == "uniform" || n == 1 {
+		return p.ids[w.rnd.Intn(n)]
+	}
+	if w.zipf == nil || n >= 2*w.size {
+		w.zipf = rand.NewZipf(w.rnd, w.s, w.v, uint64(n-1))
+		w.size = n
+	}
+	return p.ids[w.zipf.Uint64()]
+}
+
+type recorder struct {
+	mtx       sync.Mutex
+	latencies map[string][]time.Duration
+	statuses  map[string]map[string]int
+	errors    map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		latencies: map[string][]time.Duration{},
+		statuses:  map[string]map[string]int{},
+		errors:    map[string]int{},
+	}
+}
+
+func (r *recorder) record(name string, took time.Duration, status int, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.latencies[name] = append(r.latencies[name], took)
+	if r.statuses[name] == nil {
+		r.statuses[name] = map[string]int{}
+	}
+	if err != nil {
+		r.statuses[name]["transport error"]++
+	} else {
+		r.statuses[name][fmt.Sprint(status)]++
+	}
+	if err != nil || !expected(name, status) {
+		r.errors[name]++
+	}
+}
+
+func expected(name string, status int) bool {
+	if name == "redirect" {
+		// 200 is a preview page
+		return status == http.StatusPermanentRedirect || status == http.StatusOK
+	}
+	return status == http.StatusOK
+}
+
+type opReport struct {
+	Name      string         `json:"name"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"errorRate"`
+	P50       time.Duration  `json:"p50Ns"`
+	P90       time.Duration  `json:"p90Ns"`
+	P95       time.Duration  `json:"p95Ns"`
+	P99       time.Duration  `json:"p99Ns"`
+	Max       time.Duration  `json:"maxNs"`
+	Statuses  map[string]int `json:"statuses"`
+}
+
+type report struct {
+	Elapsed    time.Duration `json:"elapsedNs"`
+	Requests   int           `json:"requests"`
+	Throughput float64       `json:"throughput"`
+	Operations []opReport    `json:"operations"`
+}
+
+func (r *recorder) report(elapsed time.Duration) report {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	rep := report{Elapsed: elapsed}
+	for _, name := range []string{"shortify", "redirect"} {
+		l := r.latencies[name]
+		if len(l) == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		op := opReport{
+			Name:      name,
+			Requests:  len(l),
+			Errors:    r.errors[name],
+			ErrorRate: float64(r.errors[name]) / float64(len(l)),
+			P50:       percentile(l, 50),
+			P90:       percentile(l, 90),
+			P95:       percentile(l, 95),
+			P99:       percentile(l, 99),
+			Max:       l[len(l)-1],
+			Statuses:  r.statuses[name],
+		}
+		rep.Requests += op.Requests
+		rep.Operations = append(rep.Operations, op)
+	}
+	rep.Throughput = float64(rep.Requests) / elapsed.Seconds()
+	return rep
+}
+
+// percentile uses the nearest rank method on sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (r report) print(w io.Writer) {
+	fmt.Fprintf(w, "%d requests in %v, %.1f req/s\n\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.Throughput)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\terrors\terror%\tp50\tp90\tp95\tp99\tmax\t")
+	for _, op := range r.Operations {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f\t%v\t%v\t%v\t%v\t%v\t\n",
+			op.Name, op.Requests, op.Errors, op.ErrorRate*100,
+			op.P50.Round(time.Microsecond), op.P90.Round(time.Microsecond),
+			op.P95.Round(time.Microsecond), op.P99.Round(time.Microsecond),
+			op.Max.Round(time.Microsecond))
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	for _, op := range r.Operations {
+		var codes []string
+		for code, n := range op.Statuses {
+			codes = append(codes, fmt.Sprintf("%s=%d", code, n))
+		}
+		sort.Strings(codes)
+		fmt.Fprintf(w, "%s statuses: %s\n", op.Name, strings.Join(codes, " "))
+	}
+}
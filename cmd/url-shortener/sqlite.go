@@ -0,0 +1,7 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// SQLite needs cgo, build with CGO_ENABLED=1 go build -tags sqlite.
+import _ "github.com/mattn/go-sqlite3"
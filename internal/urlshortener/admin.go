@@ -0,0 +1,52 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+var errAdminRequired = errors.New("A valid admin key is required")
+
+// adminOnly requires the admin key, sent like the API keys of tenants. The
+// admin endpoints are closed if key is empty.
+func adminOnly(key string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if !isAdmin(ctx, key) {
+				return nil, errAdminRequired
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// adminHandler requires the admin key on routes not served by endpoints.
+func adminHandler(key string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validAdminKey(requestKey(r), key) {
+			encodeError(r.Context(), errAdminRequired, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isAdmin(ctx context.Context, key string) bool {
+	sent, _ := ctx.Value(contextKeyAPIKey).(string)
+	return validAdminKey(sent, key)
+}
+
+// validAdminKey compares the hashes of the keys, which have the same length
+// whatever the length of the keys.
+func validAdminKey(sent, key string) bool {
+	if key == "" {
+		return false
+	}
+	a, b := sha256.Sum256([]byte(sent)), sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
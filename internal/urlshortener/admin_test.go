@@ -0,0 +1,32 @@
+package urlshortener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		key, header, value string
+		want               int
+	}{
+		{"secret", "", "", http.StatusUnauthorized},
+		{"secret", "Authorization", "Bearer other", http.StatusUnauthorized},
+		{"secret", "Authorization", "Bearer secret", http.StatusOK},
+		{"secret", "X-API-Key", "secret", http.StatusOK},
+		// no admin key closes the routes
+		{"", "X-API-Key", "", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/debug/vars", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		adminHandler(test.key, ok).ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("key %q, %s %q: status %d, want %d", test.key, test.header, test.value, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package urlshortener
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::1":   true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.31.255.255":       false,
+		"192.168.0.1":          false,
+		"169.254.169.254":      false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"255.255.255.255":      false,
+		"::1":                  false,
+		"::":                   false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.216.34": true,
+	} {
+		if got := publicIP(net.ParseIP(ip)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestDialPublic(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for _, addr := range []string{ln.Addr().String(), "localhost:80"} {
+		if c, err := dialPublic(context.Background(), "tcp", addr); err != errPrivateAddress {
+			if c != nil {
+				c.Close()
+			}
+			t.Errorf("dialing %s: %v, want %v", addr, err, errPrivateAddress)
+		}
+	}
+}
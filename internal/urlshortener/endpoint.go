@@ -2,13 +2,29 @@ package urlshortener
 
 import (
 	"context"
+	"net/url"
+	"time"
 
 	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/friends-of-scalability/url-shortener/pkg/qrcode"
 	"github.com/go-kit/kit/endpoint"
 )
 
 type shortenerRequest struct {
-	URL string
+	URL         string
+	Preview     bool
+	Owner       string
+	Title       string
+	Tags        []string
+	Metadata    map[string]string
+	Password    string
+	MaxVisits   uint64
+	Rules       []redirectRule
+	Variants    []linkVariant
+	Sticky      bool
+	Passthrough bool
+	UTM         *utmParams
+	Prefix      bool
 }
 
 type shortenerResponse struct {
@@ -19,12 +35,34 @@ type shortenerResponse struct {
 
 type redirectRequest struct {
 	id string
+	// suffix is the path following the short URL, query the parameters of
+	// the visit
+	suffix  string
+	query   url.Values
+	preview bool
+	// proceed skips the forced preview page of a link
+	proceed  bool
+	password string
+	// form is set for passwords posted by the prompt
+	form bool
 }
 
 type redirectResponse struct {
-	URL string `json:"URL,omitempty"`
-	id  string
-	Err error `json:"error,omitempty"`
+	URL     string `json:"URL,omitempty"`
+	id      string
+	preview bool
+	// noStore is set for redirects that must not be cached by clients
+	noStore  bool
+	seeOther bool
+	// stickTo, if set, is the key of the variant to stick the client to
+	stickTo string
+	// path is that of the short URL, without suffix
+	path string
+	// next is the short URL the preview page continues to
+	next      string
+	createdAt time.Time
+	visits    uint64
+	Err       error `json:"error,omitempty"`
 }
 
 type infoRequest struct {
@@ -32,10 +70,54 @@ type infoRequest struct {
 }
 
 type infoResponse struct {
-	URL      string `json:"URL,omitempty"`
-	ShortURL string `json:"shortURL,omitempty"`
-	Visits   uint64 `json:"visitsCount,omitempty"`
-	Err      error  `json:"error,omitempty"`
+	URL         string            `json:"URL,omitempty"`
+	ShortURL    string            `json:"shortURL,omitempty"`
+	Visits      uint64            `json:"visitsCount,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	Preview     bool              `json:"preview,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Protected   bool              `json:"protected,omitempty"`
+	MaxVisits   uint64            `json:"maxVisits,omitempty"`
+	Rules       []redirectRule    `json:"rules,omitempty"`
+	Variants    []linkVariant     `json:"variants,omitempty"`
+	Sticky      bool              `json:"sticky,omitempty"`
+	Passthrough bool              `json:"passthrough,omitempty"`
+	UTM         *utmParams        `json:"utm,omitempty"`
+	Prefix      bool              `json:"prefix,omitempty"`
+	Check       *linkCheck        `json:"check,omitempty"`
+	Err         error             `json:"error,omitempty"`
+}
+
+type updateRequest struct {
+	id     string
+	update linkUpdate
+}
+
+type listRequest struct {
+	query listQuery
+}
+
+type listResponse struct {
+	Links      []infoResponse `json:"links"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+	Err        error          `json:"error,omitempty"`
+}
+
+type qrCodeRequest struct {
+	id     string
+	format string
+	size   int
+	level  qrcode.Level
+	margin int
+}
+
+type qrCodeResponse struct {
+	contentType string
+	body        []byte
+	Err         error `json:"error,omitempty"`
 }
 
 type healthzResponse struct {
@@ -45,7 +127,22 @@ type healthzResponse struct {
 func makeURLShortifyEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(shortenerRequest)
-		m, err := s.Shortify(req.URL)
+		m, err := s.Shortify(ctx, &shortURL{
+			URL:         req.URL,
+			Preview:     req.Preview,
+			Owner:       req.Owner,
+			Title:       req.Title,
+			Tags:        req.Tags,
+			Metadata:    req.Metadata,
+			MaxVisits:   req.MaxVisits,
+			Rules:       req.Rules,
+			Variants:    req.Variants,
+			Sticky:      req.Sticky,
+			Passthrough: req.Passthrough,
+			UTM:         req.UTM,
+			Prefix:      req.Prefix,
+			password:    req.Password,
+		})
 		if err != nil {
 			return shortenerResponse{Err: err}, nil
 		}
@@ -62,32 +159,155 @@ func makeURLHealthzEndpoint(s Service) endpoint.Endpoint {
 	}
 }
 
-func makeURLRedirectEndpoint(s Service) endpoint.Endpoint {
+func makeURLRedirectEndpoint(s Service, guard *PasswordGuard) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(redirectRequest)
-		m, err := s.Resolve(req.id)
+		// the password is checked before the visit counts
+		m, err := s.GetInfo(ctx, req.id)
+		// only some links take a path after the short URL
+		if err == nil && req.suffix != "" && !m.takesSuffix() {
+			err = errURLNotFound
+		}
+		if err == nil {
+			err = guard.check(ctx, m, req.password)
+		}
+		// a preview page must not count as a visit, following it through
+		// does
+		preview := req.preview || err == nil && m.Preview && !req.proceed
+		if err == nil && !preview {
+			m, err = s.Resolve(ctx, req.id)
+		}
 		if err != nil {
 			return redirectResponse{Err: err}, nil
 		}
 		host := ctx.Value(contextKeyHTTPAddress).(string)
-		return redirectResponse{URL: m.URL, id: host + req.id}, nil
+		res := redirectResponse{
+			URL:       m.expand(m.destination(clientFrom(ctx)), req.suffix, req.query),
+			id:        host + req.id,
+			path:      "/" + req.id,
+			preview:   preview,
+			noStore:   m.PasswordHash != "" || m.MaxVisits > 0 || len(m.Rules) > 0 || len(m.Variants) > 0,
+			seeOther:  req.form,
+			createdAt: m.CreatedAt,
+			visits:    m.VisitsCounter,
+		}
+		if preview {
+			res.next = continueURL(host+req.id, req.suffix, req.query)
+		}
+		if m.Sticky && m.variant > 0 {
+			if key := variantKey(m.Variants[m.variant-1].URL); key != clientFrom(ctx).variant {
+				res.stickTo = key
+			}
+		}
+		return res, nil
 	}
 }
 
 func makeURLInfoEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(infoRequest)
-		m, err := s.GetInfo(req.id)
+		m, err := s.GetInfo(ctx, req.id)
 		if err != nil {
 			return infoResponse{Err: err}, nil
 		}
 		host := ctx.Value(contextKeyHTTPAddress).(string)
-		return infoResponse{URL: m.URL, ShortURL: host + req.id, Visits: m.VisitsCounter}, nil
+		return makeInfoResponse(ctx, host, m), nil
+	}
+}
+
+// makeInfoResponse hides the destination of protected links from all but
+// their owner.
+func makeInfoResponse(ctx context.Context, host string, m *shortURL) infoResponse {
+	info := infoResponse{
+		URL:         m.URL,
+		ShortURL:    host + base62.Encode(m.ID),
+		Visits:      m.VisitsCounter,
+		CreatedAt:   m.CreatedAt,
+		Preview:     m.Preview,
+		Owner:       m.Owner,
+		Title:       m.Title,
+		Tags:        m.Tags,
+		Metadata:    m.Metadata,
+		Protected:   m.PasswordHash != "",
+		MaxVisits:   m.MaxVisits,
+		Rules:       m.Rules,
+		Variants:    m.Variants,
+		Sticky:      m.Sticky,
+		Passthrough: m.Passthrough,
+		UTM:         m.UTM,
+		Prefix:      m.Prefix,
+		Check:       m.Check,
+	}
+	if info.Protected && (m.Owner == "" || ownerFrom(ctx) != m.Owner) {
+		info.URL, info.Rules, info.Variants = "", nil, nil
+	}
+	return info
+}
+
+func makeURLUpdateEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(updateRequest)
+		m, err := s.Update(ctx, req.id, &req.update)
+		if err != nil {
+			return infoResponse{Err: err}, nil
+		}
+		host := ctx.Value(contextKeyHTTPAddress).(string)
+		return makeInfoResponse(ctx, host, m), nil
+	}
+}
+
+func makeURLListEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listRequest)
+		page, err := s.List(ctx, &req.query)
+		if err != nil {
+			return listResponse{Err: err}, nil
+		}
+		host := ctx.Value(contextKeyHTTPAddress).(string)
+		links := make([]infoResponse, 0, len(page.Items))
+		for _, m := range page.Items {
+			links = append(links, makeInfoResponse(ctx, host, m))
+		}
+		return listResponse{Links: links, NextCursor: page.NextCursor}, nil
+	}
+}
+
+func makeURLQRCodeEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(qrCodeRequest)
+		if _, err := s.GetInfo(ctx, req.id); err != nil {
+			return qrCodeResponse{Err: err}, nil
+		}
+		host := ctx.Value(contextKeyHTTPAddress).(string)
+		code, err := qrcode.Encode(host+req.id, req.level)
+		if err != nil {
+			return qrCodeResponse{Err: err}, nil
+		}
+		// fit the symbol and its quiet zone in the requested size, at least a
+		// pixel per module
+		scale := req.size / (code.Size + 2*req.margin)
+		if scale < 1 {
+			return qrCodeResponse{Err: errQRCodeTooSmall}, nil
+		}
+		if req.format == "svg" {
+			return qrCodeResponse{contentType: "image/svg+xml", body: code.SVG(scale, req.margin)}, nil
+		}
+		body, err := code.PNG(scale, req.margin)
+		if err != nil {
+			return qrCodeResponse{Err: err}, nil
+		}
+		return qrCodeResponse{contentType: "image/png", body: body}, nil
 	}
 }
 
 func (r redirectResponse) error() error { return r.Err }
 
+func (r qrCodeResponse) error() error { return r.Err }
+
 func (r shortenerResponse) error() error { return r.Err }
 
 func (r healthzResponse) error() error { return r.Err }
+
+func (r infoResponse) error() error { return r.Err }
+
+func (r listResponse) error() error { return r.Err }
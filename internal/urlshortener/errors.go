@@ -3,6 +3,16 @@ package urlshortener
 import "errors"
 
 var (
-	errURLNotFound  = errors.New("This URL has not been found in our database")
-	errMalformedURL = errors.New("This URL is not valid")
+	errURLNotFound         = errors.New("This URL has not been found in our database")
+	errMalformedURL        = errors.New("This URL is not valid")
+	errQRCodeParams        = errors.New("Invalid QR code parameters")
+	errQRCodeTooSmall      = errors.New("The QR code and its margin do not fit in the requested size")
+	errInvalidListQuery    = errors.New("Invalid listing parameters")
+	errInvalidLinkData     = errors.New("Invalid title, tags or metadata")
+	errLinkExhausted       = errors.New("This link has reached its maximum number of visits")
+	errVisitsConflict      = errors.New("This URL is already shortened with another maximum number of visits")
+	errPrefixConflict      = errors.New("This URL is already shortened with another deep path forwarding")
+	errPreviewConflict     = errors.New("This URL is already shortened with another preview mode")
+	errPassthroughConflict = errors.New("This URL is already shortened with other query parameters forwarding")
+	errDetailsConflict     = errors.New("This URL is already shortened with another title, tags or metadata, change them with PATCH /links/{id}")
 )
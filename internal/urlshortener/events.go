@@ -0,0 +1,315 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// Link events.
+const (
+	eventLinkCreated = "link.created"
+	eventLinkUpdated = "link.updated"
+	eventLinkDeleted = "link.deleted"
+	eventLinkVisited = "link.visited"
+	// eventLinkExpired follows the last visit allowed by MaxVisits
+	eventLinkExpired = "link.expired"
+)
+
+// eventStats are published at /debug/vars.
+var eventStats = expvar.NewMap("events")
+
+// Event is a change of a link, as sent to sinks.
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant,omitempty"`
+	Link   eventLink `json:"link"`
+
+	link *shortURL
+}
+
+type eventLink struct {
+	ShortCode string            `json:"shortCode"`
+	URL       string            `json:"url"`
+	Visits    uint64            `json:"visits"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Owner     string            `json:"owner,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Protected bool              `json:"protected,omitempty"`
+}
+
+// newEvent describes m like /info does to clients other than its owner: the
+// destination of a protected link is left out, events reach the admins and
+// webhooks.
+func newEvent(eventType, tenant string, m *shortURL) Event {
+	e := Event{
+		ID:     randomID(),
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Tenant: tenant,
+		Link: eventLink{
+			ShortCode: base62.Encode(m.ID),
+			URL:       m.URL,
+			Visits:    m.VisitsCounter,
+			CreatedAt: m.CreatedAt,
+			Owner:     m.Owner,
+			Title:     m.Title,
+			Tags:      m.Tags,
+			Metadata:  m.Metadata,
+			Protected: m.PasswordHash != "",
+		},
+		link: m,
+	}
+	if e.Link.Protected {
+		e.Link.URL = ""
+	}
+	return e
+}
+
+// Sink receives the published events.
+type Sink interface {
+	Publish(e Event) error
+	Close() error
+}
+
+// Publisher sends link events to sinks. Events are queued and sent in order
+// by a single goroutine, so slow sinks don't delay requests; once the queue
+// is full new events are dropped.
+type Publisher struct {
+	sinks  []Sink
+	logger log.Logger
+	queue  chan Event
+	done   chan struct{}
+}
+
+// NewPublisher queues up to buffer events for sinks.
+func NewPublisher(logger log.Logger, buffer int, sinks ...Sink) *Publisher {
+	p := &Publisher{
+		sinks:  sinks,
+		logger: logger,
+		queue:  make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *Publisher) publish(ctx context.Context, eventType string, m *shortURL) {
+	select {
+	case p.queue <- newEvent(eventType, tenantFrom(ctx), m):
+		eventStats.Add("published", 1)
+	default:
+		eventStats.Add("dropped", 1)
+	}
+}
+
+func (p *Publisher) loop() {
+	defer close(p.done)
+	for e := range p.queue {
+		for _, s := range p.sinks {
+			if err := s.Publish(e); err != nil {
+				eventStats.Add("errors", 1)
+				p.logger.Log("event", e.Type, "err", err)
+			}
+		}
+	}
+}
+
+// Close sends the queued events and closes the sinks.
+func (p *Publisher) Close() error {
+	close(p.queue)
+	<-p.done
+	var err error
+	for _, s := range p.sinks {
+		if closeErr := s.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// writerSink writes events as JSON lines.
+type writerSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+	c   io.Closer
+}
+
+// NewStdoutSink writes events to the standard output, one JSON per line.
+func NewStdoutSink() Sink {
+	return &writerSink{w: os.Stdout}
+}
+
+// NewFileSink appends events to the file at path, one JSON per line.
+func NewFileSink(path string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f, c: f}, nil
+}
+
+func (s *writerSink) Publish(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.c == nil {
+		return nil
+	}
+	return s.c.Close()
+}
+
+// Broker is a client of a message broker, such as NATS or Kafka.
+type Broker interface {
+	Publish(topic string, data []byte) error
+	Close() error
+}
+
+type brokerSink struct {
+	broker Broker
+	prefix string
+}
+
+// NewBrokerSink publishes each event as JSON to the topic named after its
+// type, prefixed by prefix.
+func NewBrokerSink(b Broker, prefix string) Sink {
+	return &brokerSink{broker: b, prefix: prefix}
+}
+
+func (s *brokerSink) Publish(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.broker.Publish(s.prefix+e.Type, data)
+}
+
+func (s *brokerSink) Close() error {
+	return s.broker.Close()
+}
+
+// MemoryBroker is a Broker keeping the last messages of each topic in
+// memory, to inspect the events without running a broker.
+type MemoryBroker struct {
+	size int
+
+	mtx    sync.Mutex
+	topics map[string][]json.RawMessage
+}
+
+// NewMemoryBroker keeps up to size messages per topic.
+func NewMemoryBroker(size int) *MemoryBroker {
+	return &MemoryBroker{size: size, topics: map[string][]json.RawMessage{}}
+}
+
+func (b *MemoryBroker) Publish(topic string, data []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	messages := append(b.topics[topic], json.RawMessage(data))
+	if len(messages) > b.size {
+		messages = append([]json.RawMessage(nil), messages[len(messages)-b.size:]...)
+	}
+	b.topics[topic] = messages
+	return nil
+}
+
+// Messages returns the messages kept for topic, oldest first.
+func (b *MemoryBroker) Messages(topic string) []json.RawMessage {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return append([]json.RawMessage{}, b.topics[topic]...)
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
+
+type eventService struct {
+	events *Publisher
+	Service
+}
+
+// NewEventService returns a Service publishing the changes of links to
+// events.
+func NewEventService(events *Publisher, s Service) Service {
+	return &eventService{events, s}
+}
+
+func (s *eventService) Shortify(ctx context.Context, item *shortURL) (*shortURL, error) {
+	m, err := s.Service.Shortify(ctx, item)
+	// links of URLs shortened before are returned as is
+	if err == nil && m.created {
+		s.events.publish(ctx, eventLinkCreated, m)
+	}
+	return m, err
+}
+
+func (s *eventService) Resolve(ctx context.Context, shortURL string) (*shortURL, error) {
+	m, err := s.Service.Resolve(ctx, shortURL)
+	if err != nil {
+		return m, err
+	}
+	s.events.publish(ctx, eventLinkVisited, m)
+	if m.MaxVisits > 0 && m.VisitsCounter >= m.MaxVisits {
+		s.events.publish(ctx, eventLinkExpired, m)
+		if m.MaxVisits == 1 {
+			// single-use links are deleted by their visit
+			s.events.publish(ctx, eventLinkDeleted, m)
+		}
+	}
+	return m, nil
+}
+
+func (s *eventService) Update(ctx context.Context, shortURL string, u *linkUpdate) (*shortURL, error) {
+	m, err := s.Service.Update(ctx, shortURL, u)
+	if err == nil {
+		s.events.publish(ctx, eventLinkUpdated, m)
+	}
+	return m, err
+}
+
+type recentEventsRequest struct {
+	eventType string
+}
+
+type recentEventsResponse struct {
+	Events []json.RawMessage `json:"events"`
+}
+
+// makeRecentEventsEndpoint lists the last events of a type kept by the
+// memory sink, if enabled.
+func makeRecentEventsEndpoint(b *MemoryBroker) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(recentEventsRequest)
+		if b == nil {
+			return recentEventsResponse{Events: []json.RawMessage{}}, nil
+		}
+		return recentEventsResponse{Events: b.Messages(req.eventType)}, nil
+	}
+}
+
+func decodeRecentEventsRequest(c context.Context, r *http.Request) (interface{}, error) {
+	return recentEventsRequest{eventType: mux.Vars(r)["type"]}, nil
+}
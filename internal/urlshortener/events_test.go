@@ -0,0 +1,173 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"sync"
+	"testing"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/go-kit/kit/log"
+)
+
+func TestEventService(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker(10)
+	events := NewPublisher(log.NewNopLogger(), 100, NewBrokerSink(broker, "links."))
+	s := NewEventService(events, NewService(NewInMemoryStorage()))
+
+	m, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shortening the URL again creates nothing
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	code := base62.Encode(m.ID)
+	if _, err := s.Resolve(ctx, code); err != nil {
+		t.Fatal(err)
+	}
+	title := "A"
+	if _, err := s.Update(ctx, code, &linkUpdate{Title: &title}); err != nil {
+		t.Fatal(err)
+	}
+	once, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/once", MaxVisits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Resolve(ctx, base62.Encode(once.ID)); err != nil {
+		t.Fatal(err)
+	}
+	// not found, nothing is published
+	if _, err := s.Resolve(ctx, "zzzz"); err == nil {
+		t.Fatal("resolving an unknown link succeeded")
+	}
+	if err := events.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		eventType string
+		want      []string
+	}{
+		{eventLinkCreated, []string{"https://example.com/a", "https://example.com/once"}},
+		{eventLinkVisited, []string{"https://example.com/a", "https://example.com/once"}},
+		{eventLinkUpdated, []string{"https://example.com/a"}},
+		{eventLinkExpired, []string{"https://example.com/once"}},
+		{eventLinkDeleted, []string{"https://example.com/once"}},
+	} {
+		messages := broker.Messages("links." + test.eventType)
+		if len(messages) != len(test.want) {
+			t.Errorf("%d %s events, want %d", len(messages), test.eventType, len(test.want))
+			continue
+		}
+		for i, data := range messages {
+			var e Event
+			if err := json.Unmarshal(data, &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != test.eventType || e.Link.URL != test.want[i] || e.ID == "" {
+				t.Errorf("%s event %d: %s", test.eventType, i, data)
+			}
+		}
+	}
+	var e Event
+	json.Unmarshal(broker.Messages("links." + eventLinkUpdated)[0], &e)
+	if e.Link.Title != "A" || e.Link.Visits != 1 || e.Link.ShortCode != code {
+		t.Errorf("updated event %+v, want title A, 1 visit and short code %s", e.Link, code)
+	}
+}
+
+// blockingSink holds the first event until released.
+type blockingSink struct {
+	started, release chan struct{}
+	events           []Event
+}
+
+func (s *blockingSink) Publish(e Event) error {
+	if len(s.events) == 0 {
+		close(s.started)
+		<-s.release
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *blockingSink) Close() error { return nil }
+
+func TestPublisherDropsWhenFull(t *testing.T) {
+	ctx := context.Background()
+	sink := &blockingSink{started: make(chan struct{}), release: make(chan struct{})}
+	events := NewPublisher(log.NewNopLogger(), 2, sink)
+	dropped := expvarInt(eventStats, "dropped")
+
+	m := &shortURL{ID: 1, URL: "https://example.com/a"}
+	events.publish(ctx, eventLinkVisited, m)
+	<-sink.started
+	// the first event is being sent, two more fill the queue
+	for i := 0; i < 4; i++ {
+		events.publish(ctx, eventLinkVisited, m)
+	}
+	if n := expvarInt(eventStats, "dropped") - dropped; n != 2 {
+		t.Errorf("%d events dropped, want 2", n)
+	}
+	close(sink.release)
+	events.Close()
+	if len(sink.events) != 3 {
+		t.Errorf("%d events sent, want 3", len(sink.events))
+	}
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestEventsHideProtectedDestinations(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker(10)
+	events := NewPublisher(log.NewNopLogger(), 100, NewBrokerSink(broker, ""))
+	s := NewEventService(events, NewService(NewInMemoryStorage()))
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/secret", password: "open sesame"}); err != nil {
+		t.Fatal(err)
+	}
+	events.Close()
+	messages := broker.Messages(eventLinkCreated)
+	if len(messages) != 1 {
+		t.Fatalf("%d created events, want 1", len(messages))
+	}
+	var e Event
+	if err := json.Unmarshal(messages[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Link.URL != "" || !e.Link.Protected {
+		t.Errorf("event of a protected link: %s", messages[0])
+	}
+}
+
+// Concurrent shortifies of a URL store a single link, created once.
+func TestEventServiceCreatesOnce(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker(100)
+	events := NewPublisher(log.NewNopLogger(), 100, NewBrokerSink(broker, ""))
+	s := NewEventService(events, NewService(NewInMemoryStorage()))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	events.Close()
+	if n := len(broker.Messages(eventLinkCreated)); n != 1 {
+		t.Errorf("%d created events, want 1", n)
+	}
+}
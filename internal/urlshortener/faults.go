@@ -0,0 +1,268 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+var errInvalidFault = errors.New("Invalid fault")
+
+// Fault describes the failures injected in calls to an endpoint.
+type Fault struct {
+	// Delay is added to every call, plus a random amount up to Jitter.
+	Delay  Duration `json:"delay,omitempty"`
+	Jitter Duration `json:"jitter,omitempty"`
+	// ErrorRate is the fraction of calls, in [0, 1], failing with Status.
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	Status    int     `json:"status,omitempty"`
+	// DropRate is the fraction of calls whose connection is closed without
+	// any response.
+	DropRate float64 `json:"dropRate,omitempty"`
+}
+
+func (f Fault) validate() error {
+	if f.Delay < 0 || f.Jitter < 0 {
+		return errInvalidFault
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 || f.DropRate < 0 || f.DropRate > 1 {
+		return errInvalidFault
+	}
+	if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+		return errInvalidFault
+	}
+	return nil
+}
+
+// faultError is returned by the fault middleware, encodeError writes its
+// status code or drops the connection.
+type faultError struct {
+	status int
+	drop   bool
+}
+
+func (e *faultError) Error() string {
+	if e.drop {
+		return "Injected fault: connection dropped"
+	}
+	return "Injected fault: " + http.StatusText(e.status)
+}
+
+// FaultInjector delays, fails and drops calls to endpoints so clients retry
+// logic can be exercised. Faults are set per endpoint through the admin API
+// and, when allowed, per request with the X-Fault-Delay, X-Fault-Status and
+// X-Fault-Drop headers.
+type FaultInjector struct {
+	mtx          sync.RWMutex
+	faults       map[string]Fault
+	allowHeaders bool
+
+	delayed     int64
+	failed      int64
+	dropped     int64
+	fromHeaders int64
+}
+
+// NewFaultInjector returns a FaultInjector, allowHeaders enables faults
+// requested by the X-Fault-* headers of each request.
+func NewFaultInjector(allowHeaders bool) *FaultInjector {
+	return &FaultInjector{
+		faults:       map[string]Fault{},
+		allowHeaders: allowHeaders,
+	}
+}
+
+// Set replaces the fault of an endpoint, a zero fault removes it.
+func (fi *FaultInjector) Set(name string, f Fault) error {
+	if !endpoints[name] {
+		return errUnknownTarget
+	}
+	if err := f.validate(); err != nil {
+		return err
+	}
+	fi.mtx.Lock()
+	defer fi.mtx.Unlock()
+	if f == (Fault{}) {
+		delete(fi.faults, name)
+		return nil
+	}
+	fi.faults[name] = f
+	return nil
+}
+
+func (fi *FaultInjector) fault(ctx context.Context, name string) (Fault, bool) {
+	fi.mtx.RLock()
+	f, ok := fi.faults[name]
+	fi.mtx.RUnlock()
+	if h, hok := ctx.Value(contextKeyFaultHeaders).(Fault); hok {
+		// headers override the configured fault for this request only
+		if h.Delay > 0 {
+			f.Delay = h.Delay
+		}
+		if h.Status != 0 {
+			f.Status = h.Status
+			f.ErrorRate = 1
+		}
+		if h.DropRate > 0 {
+			f.DropRate = 1
+		}
+		ok = true
+		atomic.AddInt64(&fi.fromHeaders, 1)
+	}
+	return f, ok
+}
+
+// populateContext is a kithttp.RequestFunc storing the X-Fault-* headers of
+// the request in its context.
+func (fi *FaultInjector) populateContext(ctx context.Context, r *http.Request) context.Context {
+	if !fi.allowHeaders {
+		return ctx
+	}
+	var (
+		f   Fault
+		set bool
+	)
+	if v := r.Header.Get("X-Fault-Delay"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			f.Delay, set = Duration(d), true
+		}
+	}
+	if v := r.Header.Get("X-Fault-Status"); v != "" {
+		if code, err := strconv.Atoi(v); err == nil && code >= 400 && code <= 599 {
+			f.Status, set = code, true
+		}
+	}
+	if v, err := strconv.ParseBool(r.Header.Get("X-Fault-Drop")); err == nil && v {
+		f.DropRate, set = 1, true
+	}
+	if !set {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyFaultHeaders, f)
+}
+
+// middleware injects the fault of the named endpoint, if any, in each call.
+func (fi *FaultInjector) middleware(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			f, ok := fi.fault(ctx, name)
+			if !ok {
+				return next(ctx, request)
+			}
+			if delay := time.Duration(f.Delay); delay > 0 || f.Jitter > 0 {
+				if f.Jitter > 0 {
+					delay += time.Duration(rand.Int63n(int64(f.Jitter)))
+				}
+				atomic.AddInt64(&fi.delayed, 1)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			if f.DropRate > 0 && rand.Float64() < f.DropRate {
+				atomic.AddInt64(&fi.dropped, 1)
+				return nil, &faultError{drop: true}
+			}
+			if f.ErrorRate > 0 && rand.Float64() < f.ErrorRate {
+				atomic.AddInt64(&fi.failed, 1)
+				status := f.Status
+				if status == 0 {
+					status = http.StatusServiceUnavailable
+				}
+				return nil, &faultError{status: status}
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+type faultStatus struct {
+	Faults      map[string]Fault `json:"faults"`
+	Delayed     int64            `json:"delayed"`
+	Failed      int64            `json:"failed"`
+	Dropped     int64            `json:"dropped"`
+	FromHeaders int64            `json:"fromHeaders"`
+}
+
+func (fi *FaultInjector) status() faultStatus {
+	fi.mtx.RLock()
+	defer fi.mtx.RUnlock()
+	faults := make(map[string]Fault, len(fi.faults))
+	for k, v := range fi.faults {
+		faults[k] = v
+	}
+	return faultStatus{
+		Faults:      faults,
+		Delayed:     atomic.LoadInt64(&fi.delayed),
+		Failed:      atomic.LoadInt64(&fi.failed),
+		Dropped:     atomic.LoadInt64(&fi.dropped),
+		FromHeaders: atomic.LoadInt64(&fi.fromHeaders),
+	}
+}
+
+type faultRequest struct {
+	name  string
+	fault Fault
+}
+
+type faultResponse struct {
+	faultStatus
+	Err error `json:"error,omitempty"`
+}
+
+func (r faultResponse) error() error { return r.Err }
+
+func makeFaultStatusEndpoint(fi *FaultInjector) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return faultResponse{faultStatus: fi.status()}, nil
+	}
+}
+
+func makeFaultSetEndpoint(fi *FaultInjector) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(faultRequest)
+		if err := fi.Set(req.name, req.fault); err != nil {
+			return faultResponse{Err: err}, nil
+		}
+		return faultResponse{faultStatus: fi.status()}, nil
+	}
+}
+
+func decodeFaultStatusRequest(c context.Context, r *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func decodeFaultSetRequest(c context.Context, r *http.Request) (interface{}, error) {
+	req := faultRequest{name: mux.Vars(r)["endpoint"]}
+	if r.Method == "DELETE" {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req.fault); err != nil {
+		return nil, errInvalidFault
+	}
+	return req, nil
+}
+
+// encodeFaultError writes an injected fault, dropping the connection if
+// asked to.
+func encodeFaultError(err *faultError, w http.ResponseWriter) {
+	if err.drop {
+		// net/http closes the connection without logging a stack trace
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+	})
+}
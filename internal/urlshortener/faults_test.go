@@ -0,0 +1,95 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorSet(t *testing.T) {
+	fi := NewFaultInjector(false)
+	for _, test := range []struct {
+		name  string
+		fault Fault
+		want  error
+	}{
+		{"nope", Fault{ErrorRate: 1}, errUnknownTarget},
+		{"redirect", Fault{Delay: -1}, errInvalidFault},
+		{"redirect", Fault{ErrorRate: 2}, errInvalidFault},
+		{"redirect", Fault{DropRate: -0.5}, errInvalidFault},
+		{"redirect", Fault{ErrorRate: 1, Status: 302}, errInvalidFault},
+		{"redirect", Fault{ErrorRate: 1, Status: 500}, nil},
+	} {
+		if err := fi.Set(test.name, test.fault); err != test.want {
+			t.Errorf("%s %+v: %v, want %v", test.name, test.fault, err, test.want)
+		}
+	}
+	fi.Set("redirect", Fault{})
+	if len(fi.status().Faults) != 0 {
+		t.Error("a zero fault did not remove the fault")
+	}
+}
+
+func TestFaultInjectorMiddleware(t *testing.T) {
+	ctx := context.Background()
+	fi := NewFaultInjector(false)
+	calls := 0
+	redirect := fi.middleware("redirect")(func(ctx context.Context, request interface{}) (interface{}, error) {
+		calls++
+		return nil, nil
+	})
+
+	fi.Set("redirect", Fault{ErrorRate: 1})
+	if _, err := redirect(ctx, nil); err == nil || err.(*faultError).status != http.StatusServiceUnavailable {
+		t.Errorf("failing call: %v, want a 503", err)
+	}
+	fi.Set("redirect", Fault{ErrorRate: 1, Status: http.StatusTooManyRequests})
+	if _, err := redirect(ctx, nil); err == nil || err.(*faultError).status != http.StatusTooManyRequests {
+		t.Errorf("failing call: %v, want a 429", err)
+	}
+	fi.Set("redirect", Fault{DropRate: 1})
+	if _, err := redirect(ctx, nil); err == nil || !err.(*faultError).drop {
+		t.Errorf("dropped call: %v", err)
+	}
+	fi.Set("redirect", Fault{Delay: Duration(20 * time.Millisecond)})
+	start := time.Now()
+	if _, err := redirect(ctx, nil); err != nil || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("delayed call: %v after %v", err, time.Since(start))
+	}
+	if calls != 1 {
+		t.Errorf("%d calls went through, want 1", calls)
+	}
+	if s := fi.status(); s.Failed != 2 || s.Dropped != 1 || s.Delayed != 1 {
+		t.Errorf("status %+v, want 2 failed, 1 dropped and 1 delayed", s)
+	}
+}
+
+func TestFaultHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", "/abc", nil)
+	r.Header.Set("X-Fault-Status", "502")
+	r.Header.Set("X-Fault-Delay", "1ms")
+	if ctx := NewFaultInjector(false).populateContext(context.Background(), r); ctx.Value(contextKeyFaultHeaders) != nil {
+		t.Error("headers used without being allowed")
+	}
+
+	fi := NewFaultInjector(true)
+	fi.Set("redirect", Fault{Delay: Duration(time.Hour)})
+	ctx := fi.populateContext(context.Background(), r)
+	f, ok := fi.fault(ctx, "redirect")
+	if !ok || f.Status != 502 || f.ErrorRate != 1 || f.Delay != Duration(time.Millisecond) {
+		t.Errorf("fault %+v, want a 502 after 1ms", f)
+	}
+	if _, ok := fi.fault(context.Background(), "info"); ok {
+		t.Error("fault injected without headers nor configuration")
+	}
+
+	// invalid values are ignored
+	r = httptest.NewRequest("GET", "/abc", nil)
+	r.Header.Set("X-Fault-Status", "200")
+	r.Header.Set("X-Fault-Delay", "soon")
+	if ctx := fi.populateContext(context.Background(), r); ctx.Value(contextKeyFaultHeaders) != nil {
+		t.Error("invalid headers used")
+	}
+}
@@ -0,0 +1,47 @@
+package urlshortener
+
+import "sync"
+
+// idAllocator hands out IDs from blocks leased from a counter shared by every
+// replica (hi/lo). The counter is only hit once per block, and as each block
+// belongs to a single replica the IDs stay unique across the cluster. IDs of
+// a block left when a replica stops are never used.
+//
+// IDs grow within a replica but not across replicas, so sorting by ID only
+// approximates the creation order.
+type idAllocator struct {
+	block uint64
+	// reserve adds n to the shared counter and returns its new value
+	reserve func(n uint64) (uint64, error)
+
+	mtx sync.Mutex
+	// next and last delimit the IDs left in the current block
+	next, last uint64
+}
+
+func newIDAllocator(block uint64, reserve func(n uint64) (uint64, error)) *idAllocator {
+	if block == 0 {
+		block = 1
+	}
+	return &idAllocator{block: block, reserve: reserve}
+}
+
+// nextID returns an unused ID, skipping the reserved ones.
+func (a *idAllocator) nextID() (uint64, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for {
+		if a.next == 0 || a.next > a.last {
+			last, err := a.reserve(a.block)
+			if err != nil {
+				return 0, err
+			}
+			a.next, a.last = last-a.block+1, last
+		}
+		id := a.next
+		a.next++
+		if !isReservedID(id) {
+			return id, nil
+		}
+	}
+}
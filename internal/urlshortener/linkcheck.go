@@ -0,0 +1,281 @@
+package urlshortener
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/friends-of-scalability/url-shortener/pkg/trace"
+	"github.com/go-kit/kit/log"
+)
+
+// linkCheckStats are published at /debug/vars.
+var linkCheckStats = expvar.NewMap("link_checker")
+
+// linkCheck is the last check of the destinations of a link.
+type linkCheck struct {
+	// Status is that of the first broken destination, else of the last one,
+	// 0 if it could not be reached
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// Failures counts the checks in a row finding a broken destination
+	Failures int `json:"failures,omitempty"`
+}
+
+func (c *linkCheck) broken() bool {
+	return c != nil && c.Failures > 0
+}
+
+// isBrokenStatus tells statuses of destinations that are gone or failing
+// from those of destinations refusing robots or asking to slow down.
+func isBrokenStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone || status >= 500
+}
+
+// LinkChecker checks the destinations of every link in the background and
+// records the result on the link. Healthy links are checked every interval,
+// broken ones are checked again after retry, doubled after each failure up
+// to interval. Checks of each replica are independent, run a single one.
+// Destinations that are not public addresses are skipped, links must not
+// reveal what the network of the service answers.
+type LinkChecker struct {
+	db          shortURLStorage
+	tenants     []string
+	client      *http.Client
+	interval    time.Duration
+	retry       time.Duration
+	concurrency int
+	tracer      *trace.Tracer
+	logger      log.Logger
+
+	// rounds are run one at a time
+	round sync.Mutex
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLinkChecker starts checking the links of every tenant, at most
+// concurrency at once, each destination given timeout to answer. Checks are
+// traced with tracer, which may be nil.
+func NewLinkChecker(db shortURLStorage, tenants *Tenants, timeout, interval, retry time.Duration, concurrency int, tracer *trace.Tracer, logger log.Logger) *LinkChecker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if retry <= 0 || retry > interval {
+		retry = interval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &LinkChecker{
+		db:          db,
+		tenants:     tenants.ids(),
+		client:      newPublicClient(timeout),
+		interval:    interval,
+		retry:       retry,
+		concurrency: concurrency,
+		tracer:      tracer,
+		logger:      logger,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	go c.loop(ctx)
+	return c
+}
+
+// Close stops checking, the checks in flight are abandoned.
+func (c *LinkChecker) Close() error {
+	c.cancel()
+	<-c.done
+	return nil
+}
+
+func (c *LinkChecker) loop(ctx context.Context) {
+	defer close(c.done)
+	// a round checks the links due, the shortest delay is retry
+	ticker := time.NewTicker(c.retry)
+	defer ticker.Stop()
+	for {
+		if err := c.CheckAll(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Log("err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckAll checks the links due now and waits for their checks.
+func (c *LinkChecker) CheckAll(ctx context.Context) error {
+	c.round.Lock()
+	defer c.round.Unlock()
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, c.concurrency)
+		now = time.Now()
+	)
+	defer wg.Wait()
+	for _, tenant := range c.tenants {
+		ctx := withTenant(ctx, tenant)
+		q := listQuery{SortBy: sortByCreation, Limit: maxListLimit}
+		for {
+			page, err := c.db.List(ctx, &q)
+			if err != nil {
+				return err
+			}
+			for _, m := range page.Items {
+				if !c.due(m, now) {
+					continue
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				wg.Add(1)
+				go func(m *shortURL) {
+					defer wg.Done()
+					defer func() { <-sem }()
+					c.check(ctx, m)
+				}(m)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+	}
+	return nil
+}
+
+// due reports whether m is to be checked at now.
+func (c *LinkChecker) due(m *shortURL, now time.Time) bool {
+	if m.Check == nil {
+		return true
+	}
+	wait := c.interval
+	if m.Check.broken() {
+		wait = c.retry
+		for i := 1; i < m.Check.Failures && wait < c.interval; i++ {
+			wait *= 2
+		}
+		if wait > c.interval {
+			wait = c.interval
+		}
+	}
+	return now.Sub(m.Check.CheckedAt) >= wait
+}
+
+// check probes the destinations of m and records the result.
+func (c *LinkChecker) check(ctx context.Context, m *shortURL) {
+	ctx, span := c.tracer.Start(ctx, "linkcheck.check", trace.KindInternal)
+	defer span.Finish()
+	span.SetAttribute("tenant", tenantFrom(ctx))
+	span.SetAttribute("link", base62.Encode(m.ID))
+	result := &linkCheck{}
+	broken, checked := false, false
+	for _, dest := range m.destinations() {
+		status, err := c.probe(ctx, dest)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errPrivateAddress {
+			linkCheckStats.Add("skipped", 1)
+			continue
+		}
+		checked = true
+		result.Status = status
+		if err != nil {
+			result.Error, broken = err.Error(), true
+			break
+		}
+		if isBrokenStatus(status) {
+			result.Error, broken = http.StatusText(status), true
+			break
+		}
+	}
+	if !checked {
+		return
+	}
+	result.CheckedAt = time.Now().UTC()
+	if broken {
+		result.Failures = 1
+		if m.Check != nil {
+			result.Failures = m.Check.Failures + 1
+		}
+	}
+	linkCheckStats.Add("checked", 1)
+	span.SetAttribute("linkcheck.broken", broken)
+	if broken {
+		linkCheckStats.Add("broken", 1)
+		if !m.Check.broken() {
+			c.logger.Log("tenant", tenantFrom(ctx), "link", base62.Encode(m.ID), "status", result.Status, "err", result.Error)
+		}
+	}
+	if err := c.db.SetCheck(ctx, m.ID, result); err != nil && err != errURLNotFound {
+		c.logger.Log("tenant", tenantFrom(ctx), "link", base62.Encode(m.ID), "err", err)
+	}
+}
+
+// probe returns the status of dest, asked with HEAD first. Servers not
+// implementing HEAD, or answering it with an error, are asked again with
+// GET. Errors don't name the destination, it may be that of a protected
+// link.
+func (c *LinkChecker) probe(ctx context.Context, dest string) (int, error) {
+	status, err := c.request(ctx, "HEAD", dest)
+	if err == nil && status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented && !isBrokenStatus(status) {
+		return status, nil
+	}
+	status, err = c.request(ctx, "GET", dest)
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	return status, err
+}
+
+func (c *LinkChecker) request(ctx context.Context, method, dest string) (code int, err error) {
+	req, err := http.NewRequest(method, dest, nil)
+	if err != nil {
+		return 0, err
+	}
+	// the destination is not recorded, it may be that of a protected link
+	req, span := startClientSpan(c.tracer, "linkcheck."+method, req.WithContext(ctx))
+	defer func() { finishClientSpan(span, code, err) }()
+	req.Header.Set("User-Agent", "url-shortener-linkcheck")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// destinations returns every URL m redirects to, placeholders left empty.
+func (m *shortURL) destinations() []string {
+	seen := map[string]bool{}
+	var dests []string
+	add := func(dest string) {
+		dest = fillPlaceholders(dest, "")
+		if !seen[dest] {
+			seen[dest] = true
+			dests = append(dests, dest)
+		}
+	}
+	add(m.URL)
+	for _, r := range m.Rules {
+		add(r.URL)
+	}
+	for _, v := range m.Variants {
+		add(v.URL)
+	}
+	return dests
+}
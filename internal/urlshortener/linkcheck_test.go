@@ -0,0 +1,185 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/go-kit/kit/log"
+)
+
+// newTestChecker checks the links of the default tenant of db with client,
+// without starting its loop.
+func newTestChecker(db shortURLStorage, client *http.Client, concurrency int) *LinkChecker {
+	return &LinkChecker{
+		db:          db,
+		tenants:     []string{""},
+		client:      client,
+		interval:    time.Hour,
+		retry:       time.Minute,
+		concurrency: concurrency,
+		logger:      log.NewNopLogger(),
+	}
+}
+
+func TestLinkCheckerProbe(t *testing.T) {
+	var mtx sync.Mutex
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		mtx.Unlock()
+		switch {
+		case r.URL.Path == "/no-head" && r.Method == "HEAD":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/failing":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	c := newTestChecker(NewInMemoryStorage(), srv.Client(), 1)
+
+	for _, test := range []struct {
+		path    string
+		status  int
+		methods []string
+	}{
+		{"/ok", http.StatusOK, []string{"HEAD /ok"}},
+		{"/no-head", http.StatusOK, []string{"HEAD /no-head", "GET /no-head"}},
+		{"/gone", http.StatusNotFound, []string{"HEAD /gone", "GET /gone"}},
+		{"/failing", http.StatusServiceUnavailable, []string{"HEAD /failing", "GET /failing"}},
+	} {
+		methods = nil
+		status, err := c.probe(context.Background(), srv.URL+test.path)
+		if err != nil || status != test.status {
+			t.Errorf("%s: %d, %v, want %d", test.path, status, err, test.status)
+		}
+		if len(methods) != len(test.methods) || methods[0] != test.methods[0] || methods[len(methods)-1] != test.methods[len(test.methods)-1] {
+			t.Errorf("%s: requests %v, want %v", test.path, methods, test.methods)
+		}
+	}
+}
+
+func TestLinkCheckerRecordsBrokenLinks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	db := NewInMemoryStorage()
+	c := newTestChecker(db, srv.Client(), 1)
+	m, _, err := db.Save(ctx, &shortURL{URL: srv.URL + "/ok", Variants: []linkVariant{
+		{URL: srv.URL + "/ok", Weight: 1},
+		{URL: srv.URL + "/gone", Weight: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for failures := 1; failures <= 2; failures++ {
+		c.check(ctx, m)
+		if m, err = db.ByID(ctx, base62.Encode(m.ID)); err != nil {
+			t.Fatal(err)
+		}
+		if m.Check == nil || m.Check.Status != http.StatusNotFound || m.Check.Error != "Not Found" || m.Check.Failures != failures {
+			t.Errorf("check %d: %+v, want a 404 and %d failures", failures, m.Check, failures)
+		}
+	}
+}
+
+func TestLinkCheckerDue(t *testing.T) {
+	c := newTestChecker(nil, nil, 1)
+	now := time.Now()
+	for _, test := range []struct {
+		check *linkCheck
+		due   bool
+	}{
+		{nil, true},
+		{&linkCheck{CheckedAt: now.Add(-59 * time.Minute)}, false},
+		{&linkCheck{CheckedAt: now.Add(-time.Hour)}, true},
+		{&linkCheck{CheckedAt: now.Add(-time.Minute), Failures: 1}, true},
+		{&linkCheck{CheckedAt: now.Add(-time.Minute), Failures: 2}, false},
+		{&linkCheck{CheckedAt: now.Add(-2 * time.Minute), Failures: 2}, true},
+		{&linkCheck{CheckedAt: now.Add(-7 * time.Minute), Failures: 4}, false},
+		{&linkCheck{CheckedAt: now.Add(-8 * time.Minute), Failures: 4}, true},
+		// the delay stops growing at the interval
+		{&linkCheck{CheckedAt: now.Add(-59 * time.Minute), Failures: 30}, false},
+		{&linkCheck{CheckedAt: now.Add(-time.Hour), Failures: 30}, true},
+	} {
+		if due := c.due(&shortURL{Check: test.check}, now); due != test.due {
+			t.Errorf("check %+v: due %v, want %v", test.check, due, test.due)
+		}
+	}
+}
+
+func TestLinkCheckerConcurrency(t *testing.T) {
+	var mtx sync.Mutex
+	inFlight, most := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		inFlight++
+		if inFlight > most {
+			most = inFlight
+		}
+		mtx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		inFlight--
+		mtx.Unlock()
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	db := NewInMemoryStorage()
+	for i := 0; i < 10; i++ {
+		if _, _, err := db.Save(ctx, &shortURL{URL: srv.URL + "/" + string('a'+rune(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestChecker(db, srv.Client(), 3)
+	if err := c.CheckAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if most > 3 {
+		t.Errorf("%d destinations checked at once, want at most 3", most)
+	}
+	page, err := db.List(ctx, &listQuery{Limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range page.Items {
+		if m.Check == nil || m.Check.Status != http.StatusOK {
+			t.Errorf("link %s: check %+v, want 200", m.URL, m.Check)
+		}
+	}
+}
+
+// Destinations on the network of the service are neither requested nor
+// recorded, a link would tell what they answer.
+func TestLinkCheckerSkipsPrivateDestinations(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	db := NewInMemoryStorage()
+	c := newTestChecker(db, newPublicClient(time.Second), 1)
+	m, _, err := db.Save(ctx, &shortURL{URL: srv.URL + "/admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.check(ctx, m)
+	if m, err = db.ByID(ctx, base62.Encode(m.ID)); err != nil {
+		t.Fatal(err)
+	}
+	if requested || m.Check != nil {
+		t.Errorf("loopback destination requested %v, check %+v", requested, m.Check)
+	}
+}
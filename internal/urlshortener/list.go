@@ -0,0 +1,153 @@
+package urlshortener
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+)
+
+const (
+	sortByCreation = "created"
+	sortByVisits   = "visits"
+
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+var errInvalidCursor = errors.New("Invalid listing cursor")
+
+// listQuery selects and orders the shortURLs returned by List.
+type listQuery struct {
+	Owner string
+	// Tags must all be set on a shortURL for it to match
+	Tags []string
+	// Domain matches the destination host and its subdomains
+	Domain string
+	// Contains is a case insensitive substring of the destination or title
+	Contains string
+	// Broken matches the links whose last check found a broken destination
+	Broken bool
+	SortBy string
+	Desc   bool
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// listPage is one page of a listing.
+type listPage struct {
+	Items      []*shortURL
+	NextCursor string
+}
+
+// add appends m to the page, or reports the page is full. Backends fetch one
+// item more than the limit, so a full page knows there is a next one.
+func (p *listPage) add(m *shortURL, q *listQuery) (full bool) {
+	if len(p.Items) < q.Limit {
+		p.Items = append(p.Items, m)
+		return false
+	}
+	last := p.Items[len(p.Items)-1]
+	p.NextCursor = encodeListCursor(&listCursor{Key: q.key(last), ID: last.ID})
+	return true
+}
+
+func (q *listQuery) matches(m *shortURL) bool {
+	if q.Owner != "" && m.Owner != q.Owner {
+		return false
+	}
+	if q.Domain != "" && !matchesDomain(m.URL, q.Domain) {
+		return false
+	}
+	if q.Broken && !m.Check.broken() {
+		return false
+	}
+	for _, t := range q.Tags {
+		if !m.hasTag(t) {
+			return false
+		}
+	}
+	if q.Contains != "" {
+		contains := strings.ToLower(q.Contains)
+		if !strings.Contains(strings.ToLower(m.URL), contains) &&
+			!strings.Contains(strings.ToLower(m.Title), contains) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesDomain(rawURL, domain string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// key is the value m is sorted by, its visits or its creation time in
+// nanoseconds.
+func (q *listQuery) key(m *shortURL) uint64 {
+	if q.SortBy == sortByVisits {
+		return m.VisitsCounter
+	}
+	return uint64(m.CreatedAt.UnixNano())
+}
+
+// less orders shortURLs as requested by the query, ties are broken by ID so
+// the order is total and cursors are stable. IDs are leased in blocks by
+// replicas, they don't tell the creation order.
+func (q *listQuery) less(a, b *shortURL) bool {
+	if ka, kb := q.key(a), q.key(b); ka != kb {
+		if q.Desc {
+			return ka > kb
+		}
+		return ka < kb
+	}
+	if q.Desc {
+		return a.ID > b.ID
+	}
+	return a.ID < b.ID
+}
+
+// after reports whether m comes after the cursor position.
+func (q *listQuery) after(m *shortURL, c *listCursor) bool {
+	if k := q.key(m); k != c.Key {
+		return k > c.Key != q.Desc
+	}
+	return m.ID != c.ID && m.ID > c.ID != q.Desc
+}
+
+// listCursor is the position of the last item of a page: its sort key and
+// ID.
+type listCursor struct {
+	Key uint64
+	ID  uint64
+}
+
+func encodeListCursor(c *listCursor) string {
+	return base62.Encode(c.Key) + "." + base62.Encode(c.ID)
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidCursor
+	}
+	key, err := base62.Decode(parts[0])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	id, err := base62.Decode(parts[1])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &listCursor{Key: key, ID: id}, nil
+}
@@ -0,0 +1,304 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInjectedLoad  = errors.New("Synthetic load error")
+	errInvalidLoad   = errors.New("Invalid load profile")
+	errLoadTooHigh   = errors.New("The load profile exceeds the memory or CPU workers allowed")
+	errUnknownTarget = errors.New("Unknown endpoint")
+)
+
+// endpoints names the endpoints load and faults can be configured for.
+var endpoints = map[string]bool{
+	"shortify": true,
+	"redirect": true,
+	"info":     true,
+	"qrcode":   true,
+	"list":     true,
+	"update":   true,
+	"healthz":  true,
+}
+
+// Duration is a time.Duration marshalled as "1.5s" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadProfile describes the synthetic work done on each call of an endpoint.
+type LoadProfile struct {
+	// CPU is how long CPUWorkers goroutines spin on every call.
+	CPU        Duration `json:"cpu,omitempty"`
+	CPUWorkers int      `json:"cpuWorkers,omitempty"`
+	// MemoryMB is allocated, touched and held for Hold on every call.
+	MemoryMB int      `json:"memoryMB,omitempty"`
+	Hold     Duration `json:"hold,omitempty"`
+	// Latency delays every response.
+	Latency Duration `json:"latency,omitempty"`
+	// ErrorRate is the fraction of calls, in [0, 1], failing with a 500.
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	// Background runs the CPU and memory work without delaying responses.
+	Background bool `json:"background,omitempty"`
+}
+
+func (p LoadProfile) validate(maxMemoryMB, maxCPUWorkers int) error {
+	if p.CPU < 0 || p.CPUWorkers < 0 || p.MemoryMB < 0 || p.Hold < 0 || p.Latency < 0 {
+		return errInvalidLoad
+	}
+	if p.ErrorRate < 0 || p.ErrorRate > 1 {
+		return errInvalidLoad
+	}
+	if p.MemoryMB > maxMemoryMB || p.CPUWorkers > maxCPUWorkers {
+		return errLoadTooHigh
+	}
+	return nil
+}
+
+// LoadGenerator burns CPU, allocates memory, delays and fails calls to the
+// endpoints it has a profile for. It replaces shelling out to stress: the work
+// happens in process and at most a bounded number of jobs run at once, calls
+// finding every slot busy simply skip the CPU and memory work.
+type LoadGenerator struct {
+	mtx      sync.RWMutex
+	profiles map[string]LoadProfile
+	slots    chan struct{}
+	// maxMemoryMB and maxCPUWorkers bound a single job
+	maxMemoryMB   int
+	maxCPUWorkers int
+
+	running int64
+	skipped int64
+}
+
+// NewLoadGenerator returns a LoadGenerator running at most maxConcurrent CPU
+// and memory jobs at once, each one allocating up to maxMemoryMB and spinning
+// up to maxCPUWorkers goroutines.
+func NewLoadGenerator(maxConcurrent, maxMemoryMB, maxCPUWorkers int) *LoadGenerator {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	if maxMemoryMB < 0 {
+		maxMemoryMB = 0
+	}
+	if maxCPUWorkers < 1 {
+		maxCPUWorkers = 1
+	}
+	return &LoadGenerator{
+		profiles:      map[string]LoadProfile{},
+		slots:         make(chan struct{}, maxConcurrent),
+		maxMemoryMB:   maxMemoryMB,
+		maxCPUWorkers: maxCPUWorkers,
+	}
+}
+
+// Set replaces the profile of an endpoint, a zero profile removes it.
+func (g *LoadGenerator) Set(name string, p LoadProfile) error {
+	if !endpoints[name] {
+		return errUnknownTarget
+	}
+	if err := p.validate(g.maxMemoryMB, g.maxCPUWorkers); err != nil {
+		return err
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if p == (LoadProfile{}) {
+		delete(g.profiles, name)
+		return nil
+	}
+	g.profiles[name] = p
+	return nil
+}
+
+func (g *LoadGenerator) profile(name string) (LoadProfile, bool) {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	p, ok := g.profiles[name]
+	return p, ok
+}
+
+type loadStatus struct {
+	Profiles map[string]LoadProfile `json:"profiles"`
+	Running  int64                  `json:"running"`
+	Skipped  int64                  `json:"skipped"`
+}
+
+func (g *LoadGenerator) status() loadStatus {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	profiles := make(map[string]LoadProfile, len(g.profiles))
+	for k, v := range g.profiles {
+		profiles[k] = v
+	}
+	return loadStatus{
+		Profiles: profiles,
+		Running:  atomic.LoadInt64(&g.running),
+		Skipped:  atomic.LoadInt64(&g.skipped),
+	}
+}
+
+// middleware applies the profile of the named endpoint, if any, to each call.
+func (g *LoadGenerator) middleware(name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			p, ok := g.profile(name)
+			if !ok {
+				return next(ctx, request)
+			}
+			if p.CPU > 0 || p.MemoryMB > 0 {
+				g.work(p)
+			}
+			if p.Latency > 0 {
+				select {
+				case <-time.After(time.Duration(p.Latency)):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			if p.ErrorRate > 0 && rand.Float64() < p.ErrorRate {
+				return nil, errInjectedLoad
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// work runs a CPU and memory job if a slot is free.
+func (g *LoadGenerator) work(p LoadProfile) {
+	select {
+	case g.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&g.skipped, 1)
+		return
+	}
+	atomic.AddInt64(&g.running, 1)
+	job := func() {
+		defer func() {
+			atomic.AddInt64(&g.running, -1)
+			<-g.slots
+		}()
+		deadline := time.Now().Add(time.Duration(p.Hold))
+		mem := allocate(p.MemoryMB)
+		burnCPU(time.Duration(p.CPU), p.CPUWorkers)
+		if d := time.Until(deadline); d > 0 {
+			time.Sleep(d)
+		}
+		runtime.KeepAlive(mem)
+	}
+	if p.Background {
+		go job()
+		return
+	}
+	job()
+}
+
+// allocate returns mb megabytes with every page written, so they are
+// actually resident.
+func allocate(mb int) []byte {
+	if mb <= 0 {
+		return nil
+	}
+	b := make([]byte, mb<<20)
+	for i := 0; i < len(b); i += 4096 {
+		b[i] = 1
+	}
+	return b
+}
+
+// burnCPU keeps workers goroutines busy for d.
+func burnCPU(d time.Duration, workers int) {
+	if d <= 0 {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	deadline := time.Now().Add(d)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			x := uint64(1)
+			for time.Now().Before(deadline) {
+				for j := 0; j < 1000; j++ {
+					x = x*6364136223846793005 + 1442695040888963407
+				}
+			}
+			_ = x
+		}()
+	}
+	wg.Wait()
+}
+
+type loadRequest struct {
+	name    string
+	profile LoadProfile
+}
+
+type loadResponse struct {
+	loadStatus
+	Err error `json:"error,omitempty"`
+}
+
+func (r loadResponse) error() error { return r.Err }
+
+func makeLoadStatusEndpoint(g *LoadGenerator) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return loadResponse{loadStatus: g.status()}, nil
+	}
+}
+
+func makeLoadSetEndpoint(g *LoadGenerator) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(loadRequest)
+		if err := g.Set(req.name, req.profile); err != nil {
+			return loadResponse{Err: err}, nil
+		}
+		return loadResponse{loadStatus: g.status()}, nil
+	}
+}
+
+func decodeLoadStatusRequest(c context.Context, r *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func decodeLoadSetRequest(c context.Context, r *http.Request) (interface{}, error) {
+	req := loadRequest{name: mux.Vars(r)["endpoint"]}
+	if r.Method == "DELETE" {
+		return req, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req.profile); err != nil {
+		return nil, errInvalidLoad
+	}
+	return req, nil
+}
@@ -0,0 +1,96 @@
+package urlshortener
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoadProfileValidate(t *testing.T) {
+	for _, test := range []struct {
+		profile LoadProfile
+		want    error
+	}{
+		{LoadProfile{}, nil},
+		{LoadProfile{CPU: Duration(time.Second), CPUWorkers: 4, MemoryMB: 64, ErrorRate: 1}, nil},
+		{LoadProfile{CPU: -1}, errInvalidLoad},
+		{LoadProfile{Latency: -1}, errInvalidLoad},
+		{LoadProfile{MemoryMB: -1}, errInvalidLoad},
+		{LoadProfile{ErrorRate: 1.5}, errInvalidLoad},
+		{LoadProfile{MemoryMB: 65}, errLoadTooHigh},
+		{LoadProfile{CPUWorkers: 5}, errLoadTooHigh},
+	} {
+		if err := test.profile.validate(64, 4); err != test.want {
+			t.Errorf("%+v: %v, want %v", test.profile, err, test.want)
+		}
+	}
+}
+
+func TestLoadGeneratorSet(t *testing.T) {
+	g := NewLoadGenerator(1, 64, 4)
+	if err := g.Set("nope", LoadProfile{Latency: 1}); err != errUnknownTarget {
+		t.Errorf("unknown endpoint: %v, want %v", err, errUnknownTarget)
+	}
+	if err := g.Set("redirect", LoadProfile{MemoryMB: 1 << 20}); err != errLoadTooHigh {
+		t.Errorf("profile past the maximums: %v, want %v", err, errLoadTooHigh)
+	}
+	if err := g.Set("redirect", LoadProfile{Latency: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.profile("redirect"); !ok {
+		t.Fatal("profile not set")
+	}
+	if err := g.Set("redirect", LoadProfile{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.profile("redirect"); ok {
+		t.Error("a zero profile did not remove the profile")
+	}
+}
+
+func TestLoadGeneratorMiddleware(t *testing.T) {
+	ctx := context.Background()
+	g := NewLoadGenerator(1, 1, 1)
+	calls := 0
+	next := func(ctx context.Context, request interface{}) (interface{}, error) {
+		calls++
+		return nil, nil
+	}
+	redirect, info := g.middleware("redirect")(next), g.middleware("info")(next)
+
+	g.Set("redirect", LoadProfile{Latency: Duration(20 * time.Millisecond)})
+	start := time.Now()
+	if _, err := redirect(ctx, nil); err != nil || calls != 1 {
+		t.Fatalf("delayed call: %v, %d calls", err, calls)
+	}
+	if took := time.Since(start); took < 20*time.Millisecond {
+		t.Errorf("call took %v, want at least 20ms", took)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := redirect(cancelled, nil); err != context.Canceled || calls != 1 {
+		t.Errorf("cancelled call: %v, %d calls", err, calls)
+	}
+
+	g.Set("redirect", LoadProfile{ErrorRate: 1})
+	if _, err := redirect(ctx, nil); err != errInjectedLoad || calls != 1 {
+		t.Errorf("failing call: %v, %d calls", err, calls)
+	}
+	if _, err := info(ctx, nil); err != nil || calls != 2 {
+		t.Errorf("call without profile: %v, %d calls", err, calls)
+	}
+
+	// the only slot is held by a background job, the next job is skipped
+	g.Set("redirect", LoadProfile{MemoryMB: 1, Hold: Duration(time.Second), Background: true})
+	redirect(ctx, nil)
+	for deadline := time.Now().Add(time.Second); g.status().Running == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the background job did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	redirect(ctx, nil)
+	if s := g.status(); s.Running != 1 || s.Skipped != 1 || calls != 4 {
+		t.Errorf("%d jobs running and %d skipped after %d calls, want 1, 1 and 4", s.Running, s.Skipped, calls)
+	}
+}
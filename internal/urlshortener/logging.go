@@ -1,6 +1,7 @@
 package urlshortener
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -17,23 +18,37 @@ func NewLoggingService(logger log.Logger, s Service) Service {
 }
 
 // Login to the system.
-func (s *loggingService) Shortify(longURL string) (mapping *shortURL, err error) {
+func (s *loggingService) Shortify(ctx context.Context, item *shortURL) (mapping *shortURL, err error) {
 	defer func(begin time.Time) {
-		s.logger.Log("method", "shortify", "url", longURL, "took", time.Since(begin), "err", err)
+		s.logger.Log("method", "shortify", "url", item.URL, "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return s.Service.Shortify(longURL)
+	return s.Service.Shortify(ctx, item)
 }
 
-func (s *loggingService) Resolve(shortURL string) (mapping *shortURL, err error) {
+func (s *loggingService) Resolve(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
 	defer func(begin time.Time) {
 		s.logger.Log("method", "Resolve", "shortURLId", shortURL, "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return s.Service.Resolve(shortURL)
+	return s.Service.Resolve(ctx, shortURL)
 }
 
-func (s *loggingService) GetInfo(shortURL string) (mapping *shortURL, err error) {
+func (s *loggingService) GetInfo(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
 	defer func(begin time.Time) {
 		s.logger.Log("method", "GetInfo", "shortURLId", shortURL, "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return s.Service.GetInfo(shortURL)
+	return s.Service.GetInfo(ctx, shortURL)
+}
+
+func (s *loggingService) Update(ctx context.Context, shortURL string, u *linkUpdate) (mapping *shortURL, err error) {
+	defer func(begin time.Time) {
+		s.logger.Log("method", "Update", "shortURLId", shortURL, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return s.Service.Update(ctx, shortURL, u)
+}
+
+func (s *loggingService) List(ctx context.Context, q *listQuery) (page *listPage, err error) {
+	defer func(begin time.Time) {
+		s.logger.Log("method", "List", "sort", q.SortBy, "cursor", q.Cursor, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return s.Service.List(ctx, q)
 }
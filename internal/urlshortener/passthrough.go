@@ -0,0 +1,154 @@
+package urlshortener
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const maxUTMLength = 256
+
+// utmParams are added to the destination of a link unless it has them.
+type utmParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+func (p *utmParams) values() [][2]string {
+	return [][2]string{
+		{"utm_source", p.Source},
+		{"utm_medium", p.Medium},
+		{"utm_campaign", p.Campaign},
+		{"utm_term", p.Term},
+		{"utm_content", p.Content},
+	}
+}
+
+// normalizeUTM trims p, nil if it has no parameter.
+func normalizeUTM(p *utmParams) (*utmParams, error) {
+	if p == nil {
+		return nil, nil
+	}
+	n := utmParams{
+		Source:   strings.TrimSpace(p.Source),
+		Medium:   strings.TrimSpace(p.Medium),
+		Campaign: strings.TrimSpace(p.Campaign),
+		Term:     strings.TrimSpace(p.Term),
+		Content:  strings.TrimSpace(p.Content),
+	}
+	empty := true
+	for _, v := range n.values() {
+		if len(v[1]) > maxUTMLength {
+			return nil, errInvalidLinkData
+		}
+		empty = empty && v[1] == ""
+	}
+	if empty {
+		return nil, nil
+	}
+	return &n, nil
+}
+
+// placeholderPattern matches the placeholders of destinations: {path} is the
+// path following the short URL, {1} to {9} its segments.
+var placeholderPattern = regexp.MustCompile(`\{(path|[1-9])\}`)
+
+// takesSuffix reports whether m forwards the path following the short URL,
+// being a prefix link or having placeholders in any destination.
+func (m *shortURL) takesSuffix() bool {
+	if m.Prefix || placeholderPattern.MatchString(m.URL) {
+		return true
+	}
+	for _, r := range m.Rules {
+		if placeholderPattern.MatchString(r.URL) {
+			return true
+		}
+	}
+	for _, v := range m.Variants {
+		if placeholderPattern.MatchString(v.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand fills the placeholders of dest with suffix, the path following the
+// short URL, and appends it to the path of dest for prefix links. Then it
+// adds the UTM parameters of m the destination lacks and, if m passes them
+// through, the parameters of the visit, replacing those of the destination.
+func (m *shortURL) expand(dest, suffix string, query url.Values) string {
+	dest = fillPlaceholders(dest, suffix)
+	appendSuffix := m.Prefix && suffix != ""
+	if !appendSuffix && m.UTM == nil && (!m.Passthrough || len(query) == 0) {
+		return dest
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return dest
+	}
+	if appendSuffix {
+		segments := strings.Split(strings.TrimPrefix(suffix, "/"), "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		// RawPath keeps the escaping of the destination and the suffix
+		u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + "/" + strings.Join(segments, "/")
+		if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+			return dest
+		}
+	}
+	if m.UTM == nil && (!m.Passthrough || len(query) == 0) {
+		return u.String()
+	}
+	q := u.Query()
+	if m.UTM != nil {
+		for _, v := range m.UTM.values() {
+			if v[1] != "" && q.Get(v[0]) == "" {
+				q.Set(v[0], v[1])
+			}
+		}
+	}
+	if m.Passthrough {
+		for k, vs := range query {
+			q[k] = vs
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// fillPlaceholders escapes the suffix for the part of dest, path or query,
+// each placeholder is in.
+func fillPlaceholders(dest, suffix string) string {
+	if !strings.Contains(dest, "{") {
+		return dest
+	}
+	segments := strings.Split(strings.Trim(suffix, "/"), "/")
+	fill := func(escape func(string) string) func(string) string {
+		return func(p string) string {
+			name := p[1 : len(p)-1]
+			if name == "path" {
+				escaped := make([]string, len(segments))
+				for i, s := range segments {
+					escaped[i] = escape(s)
+				}
+				return strings.Join(escaped, "/")
+			}
+			i, _ := strconv.Atoi(name)
+			if i > len(segments) {
+				return ""
+			}
+			return escape(segments[i-1])
+		}
+	}
+	path, query := dest, ""
+	if i := strings.IndexByte(dest, '?'); i >= 0 {
+		path, query = dest[:i], dest[i:]
+	}
+	return placeholderPattern.ReplaceAllStringFunc(path, fill(url.PathEscape)) +
+		placeholderPattern.ReplaceAllStringFunc(query, fill(url.QueryEscape))
+}
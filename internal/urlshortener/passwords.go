@@ -0,0 +1,249 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/password"
+	"github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	errPasswordRequired = errors.New("This link is protected by a password")
+	errWrongPassword    = errors.New("Wrong password")
+	errPasswordLocked   = errors.New("Too many wrong passwords, try again later")
+	errPasswordConflict = errors.New("This URL is already shortened, links with a password are not shared")
+)
+
+const (
+	maxPasswordLength = 256
+	// a client is locked out of a link after maxPasswordFailures wrong
+	// passwords within passwordLockout, for passwordLockout
+	maxPasswordFailures = 5
+	passwordLockout     = 15 * time.Minute
+	// failures are swept once this many clients are tracked
+	passwordSweepSize = 10000
+	// a link takes at most maxLinkPasswordFailures wrong passwords per
+	// passwordLockout window from all clients together, counted in the
+	// storage so that guessing from many addresses or replicas is limited
+	maxLinkPasswordFailures = 50
+	// usage counters of a link: its wrong passwords and the window they
+	// were counted in
+	usagePasswordFailures = "password_failures"
+	usagePasswordWindow   = "password_window"
+)
+
+// passwordWindow numbers the window of now, counting from 1.
+func passwordWindow(now time.Time) uint64 {
+	return uint64(now.Unix()/int64(passwordLockout/time.Second)) + 1
+}
+
+// linkUsageOwner holds the usage counters of link id, the owners of API keys
+// can't contain slashes.
+func linkUsageOwner(id uint64) string {
+	return "/links/" + strconv.FormatUint(id, 10)
+}
+
+// setPassword hashes the password a link is created with, if any.
+func (m *shortURL) setPassword() error {
+	if m.password == "" {
+		return nil
+	}
+	if len(m.password) > maxPasswordLength {
+		return errInvalidLinkData
+	}
+	hash, err := password.Hash(m.password)
+	if err != nil {
+		return err
+	}
+	m.PasswordHash, m.password = hash, ""
+	return nil
+}
+
+// PasswordGuard checks the passwords of protected links, locking clients
+// out of a link after too many wrong ones. Lockouts of clients are per
+// replica, the limit of a link is shared through the storage.
+type PasswordGuard struct {
+	db       shortURLStorage
+	logger   log.Logger
+	mtx      sync.Mutex
+	failures map[string]*passwordFailures
+}
+
+type passwordFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// NewPasswordGuard counts the wrong passwords of each link with the usage
+// counters of db.
+func NewPasswordGuard(db shortURLStorage, logger log.Logger) *PasswordGuard {
+	return &PasswordGuard{db: db, logger: logger, failures: map[string]*passwordFailures{}}
+}
+
+// check returns nil if m is not protected or pass is its password.
+func (g *PasswordGuard) check(ctx context.Context, m *shortURL, pass string) error {
+	if m.PasswordHash == "" {
+		return nil
+	}
+	if pass == "" {
+		return errPasswordRequired
+	}
+	key := tenantFrom(ctx) + "/" + strconv.FormatUint(m.ID, 10) + "/" + clientIP(ctx)
+	now := time.Now()
+
+	// the attempt is counted before the slow hash, so concurrent guesses
+	// can't exceed the limit
+	g.mtx.Lock()
+	f := g.failures[key]
+	if f == nil || now.Sub(f.first) > passwordLockout && now.After(f.lockedUntil) {
+		if len(g.failures) >= passwordSweepSize {
+			g.sweep(now)
+		}
+		f = &passwordFailures{first: now}
+		g.failures[key] = f
+	}
+	if now.Before(f.lockedUntil) || f.count >= maxPasswordFailures {
+		g.mtx.Unlock()
+		return errPasswordLocked
+	}
+	f.count++
+	g.mtx.Unlock()
+
+	owner := linkUsageOwner(m.ID)
+	if err := g.startWindow(ctx, owner, passwordWindow(now)); err != nil {
+		return err
+	}
+	_, allowed, err := g.db.AddUsage(ctx, owner, usagePasswordFailures, 1, maxLinkPasswordFailures)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errPasswordLocked
+	}
+	ok, err := password.Verify(m.PasswordHash, pass)
+	if err == nil && ok {
+		// the right password is not a failure
+		if _, _, err := g.db.AddUsage(ctx, owner, usagePasswordFailures, -1, 0); err != nil {
+			g.logger.Log("link", m.ID, "counter", usagePasswordFailures, "err", err)
+		}
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if err == nil && ok {
+		delete(g.failures, key)
+		return nil
+	}
+	if f.count >= maxPasswordFailures && f.lockedUntil.IsZero() {
+		f.lockedUntil = now.Add(passwordLockout)
+	}
+	if err != nil {
+		return err
+	}
+	return errWrongPassword
+}
+
+// startWindow resets the failures of the link of owner once window begins.
+// The window counter is moved forward with window as its limit, so a single
+// replica wins the reset; failures counted meanwhile may be reset with it.
+func (g *PasswordGuard) startWindow(ctx context.Context, owner string, window uint64) error {
+	usage, err := g.db.Usage(ctx, owner, usagePasswordWindow)
+	if err != nil {
+		return err
+	}
+	current := usage[usagePasswordWindow]
+	if current >= window {
+		return nil
+	}
+	_, moved, err := g.db.AddUsage(ctx, owner, usagePasswordWindow, int64(window-current), window)
+	if err != nil || !moved {
+		return err
+	}
+	_, _, err = g.db.AddUsage(ctx, owner, usagePasswordFailures, -maxLinkPasswordFailures, 0)
+	return err
+}
+
+// sweep forgets the clients whose failures no longer matter.
+func (g *PasswordGuard) sweep(now time.Time) {
+	for key, f := range g.failures {
+		if now.Sub(f.first) > passwordLockout && now.After(f.lockedUntil) {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// clientIP is the address the request came from, without its port.
+func clientIP(ctx context.Context) string {
+	addr, _ := ctx.Value(kithttp.ContextKeyRequestRemoteAddr).(string)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Protected link</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+.error { color: #b00020; }
+input { font-size: 1em; padding: .4em; }
+button { font-size: 1em; padding: .5em 1.2em; background: #2a6ebb; color: #fff; border: 0; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>This link is protected</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if not .Locked}}<form method="post" action="{{.Action}}">
+<input type="password" name="password" autofocus required autocomplete="off">
+<button type="submit">Open</button>
+</form>{{end}}
+</body>
+</html>
+`))
+
+type passwordPage struct {
+	Action string
+	Error  string
+	Locked bool
+}
+
+// isPasswordError reports whether err asks for the password of a link.
+func isPasswordError(err error) bool {
+	return err == errPasswordRequired || err == errWrongPassword || err == errPasswordLocked
+}
+
+// encodePasswordPrompt renders a password form for browsers, other clients
+// get the error as JSON.
+func encodePasswordPrompt(ctx context.Context, err error, w http.ResponseWriter) error {
+	accept, _ := ctx.Value(kithttp.ContextKeyRequestAccept).(string)
+	if !strings.Contains(accept, "text/html") {
+		encodeError(ctx, err, w)
+		return nil
+	}
+	page := passwordPage{Locked: err == errPasswordLocked}
+	if err != errPasswordRequired {
+		page.Error = err.Error()
+	}
+	// the query and path suffix of the visit must reach the destination
+	page.Action, _ = ctx.Value(kithttp.ContextKeyRequestURI).(string)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err == errPasswordLocked {
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	return passwordTemplate.Execute(w, page)
+}
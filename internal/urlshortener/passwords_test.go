@@ -0,0 +1,64 @@
+package urlshortener
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/password"
+	"github.com/go-kit/kit/log"
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// Replicas share the limit of wrong passwords of a link, whatever the
+// addresses of the clients.
+func TestPasswordGuardSharesLinkLimit(t *testing.T) {
+	db := NewInMemoryStorage()
+	hash, err := password.Hash("right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &shortURL{ID: 1, PasswordHash: hash}
+	from := func(ip string) context.Context {
+		return context.WithValue(context.Background(), kithttp.ContextKeyRequestRemoteAddr, ip+":1234")
+	}
+	a := NewPasswordGuard(db, log.NewNopLogger())
+	b := NewPasswordGuard(db, log.NewNopLogger())
+
+	if err := a.check(from("192.0.2.1"), m, "wrong"); err != errWrongPassword {
+		t.Errorf("wrong password: %v, want %v", err, errWrongPassword)
+	}
+	if err := b.check(from("192.0.2.2"), m, "right"); err != nil {
+		t.Errorf("right password: %v", err)
+	}
+	owner := linkUsageOwner(m.ID)
+	if n := failures(t, db, owner); n != 1 {
+		t.Errorf("%d failures counted, want 1", n)
+	}
+	if _, _, err := db.AddUsage(context.Background(), owner, usagePasswordFailures, maxLinkPasswordFailures-1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.check(from("192.0.2.3"), m, "right"); err != errPasswordLocked {
+		t.Errorf("password past the limit of the link: %v, want %v", err, errPasswordLocked)
+	}
+
+	// the next window starts over in the same counter
+	if err := a.startWindow(context.Background(), owner, passwordWindow(time.Now())+1); err != nil {
+		t.Fatal(err)
+	}
+	if n := failures(t, db, owner); n != 0 {
+		t.Errorf("%d failures counted in a new window, want 0", n)
+	}
+	if err := b.check(from("192.0.2.3"), m, "right"); err != nil {
+		t.Errorf("right password in a new window: %v", err)
+	}
+}
+
+func failures(t *testing.T, db shortURLStorage, owner string) uint64 {
+	t.Helper()
+	usage, err := db.Usage(context.Background(), owner, usagePasswordFailures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage[usagePasswordFailures]
+}
@@ -0,0 +1,77 @@
+package urlshortener
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Link preview</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 4em auto; padding: 0 1em; color: #222; }
+.destination { word-break: break-all; font-size: 1.2em; }
+dt { font-weight: bold; margin-top: 1em; }
+a.continue { display: inline-block; margin-top: 2em; padding: .6em 1.2em; background: #2a6ebb; color: #fff; text-decoration: none; border-radius: 4px; }
+</style>
+</head>
+<body>
+<h1>This short link leads to</h1>
+<p class="destination">{{.URL}}</p>
+<dl>
+<dt>Short link</dt><dd>{{.ShortURL}}</dd>
+<dt>Created</dt><dd>{{.CreatedAt}}</dd>
+<dt>Visits</dt><dd>{{.Visits}}</dd>
+</dl>
+<a class="continue" href="{{.Next}}" rel="noreferrer noopener">Continue to destination</a>
+</body>
+</html>
+`))
+
+type previewPage struct {
+	URL       string
+	ShortURL  string
+	Next      string
+	CreatedAt string
+	Visits    uint64
+}
+
+// encodePreviewResponse renders the destination of a short link instead of
+// redirecting to it.
+func encodePreviewResponse(_ context.Context, w http.ResponseWriter, r redirectResponse) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	return previewTemplate.Execute(w, previewPage{
+		URL:       r.URL,
+		ShortURL:  r.id,
+		Next:      r.next,
+		CreatedAt: r.createdAt.Format(time.RFC1123),
+		Visits:    r.visits,
+	})
+}
+
+// continueURL returns the short URL a preview page continues to, counting
+// the visit and skipping the forced preview, with the path and parameters
+// of the visit.
+func continueURL(shortURL, suffix string, query url.Values) string {
+	next := url.Values{}
+	for k, vs := range query {
+		next[k] = vs
+	}
+	next.Set("preview", "0")
+	if suffix != "" {
+		segments := strings.Split(suffix, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		shortURL += "/" + strings.Join(segments, "/")
+	}
+	return shortURL + "?" + next.Encode()
+}
@@ -0,0 +1,178 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+var (
+	errLinkQuotaExceeded     = errors.New("Quota exceeded: too many active links")
+	errCreationQuotaExceeded = errors.New("Quota exceeded: too many links created today")
+	errRedirectQuotaExceeded = errors.New("Quota exceeded: too many redirects this month")
+)
+
+// Quota limits what the owner of API keys may do, 0 is unlimited. Days and
+// months are in UTC.
+type Quota struct {
+	MaxLinks          uint64 `json:"maxLinks,omitempty"`
+	CreationsPerDay   uint64 `json:"creationsPerDay,omitempty"`
+	RedirectsPerMonth uint64 `json:"redirectsPerMonth,omitempty"`
+}
+
+// Usage counters of an owner, the periodic ones end with their period.
+const (
+	usageLinks     = "links"
+	usageCreations = "creations:"
+	usageRedirects = "redirects:"
+)
+
+func creationsCounter(now time.Time) string {
+	return usageCreations + now.UTC().Format("2006-01-02")
+}
+
+func redirectsCounter(now time.Time) string {
+	return usageRedirects + now.UTC().Format("2006-01")
+}
+
+// Quotas accounts for the usage of the owners of API keys, in the storage
+// so that every replica enforces the same quotas.
+type Quotas struct {
+	tenants *Tenants
+	db      shortURLStorage
+	logger  log.Logger
+}
+
+// NewQuotas enforces the quotas of tenants with the usage counters of db.
+func NewQuotas(tenants *Tenants, db shortURLStorage, logger log.Logger) *Quotas {
+	return &Quotas{tenants: tenants, db: db, logger: logger}
+}
+
+// reserve adds one to a counter of owner, or fails with exceeded if that
+// would take it past limit.
+func (q *Quotas) reserve(ctx context.Context, owner, counter string, limit uint64, exceeded error) error {
+	_, ok, err := q.db.AddUsage(ctx, owner, counter, 1, limit)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return exceeded
+	}
+	return nil
+}
+
+// release takes back what reserve added, for operations that failed or
+// turned out not to count.
+func (q *Quotas) release(ctx context.Context, owner string, counters ...string) {
+	for _, c := range counters {
+		if _, _, err := q.db.AddUsage(ctx, owner, c, -1, 0); err != nil {
+			q.logger.Log("owner", owner, "counter", c, "err", err)
+		}
+	}
+}
+
+type quotaService struct {
+	quotas *Quotas
+	Service
+}
+
+// NewQuotaService returns a Service counting the links created and
+// redirected by the owners of API keys, and refusing those past their quota.
+func NewQuotaService(q *Quotas, s Service) Service {
+	return &quotaService{q, s}
+}
+
+func (s *quotaService) Shortify(ctx context.Context, item *shortURL) (*shortURL, error) {
+	owner := ownerFrom(ctx)
+	quota, ok := s.quotas.tenants.quota(tenantFrom(ctx), owner)
+	if !ok {
+		return s.Service.Shortify(ctx, item)
+	}
+	// links of URLs the owner shortened before are returned as is, not
+	// created
+	if _, err := s.quotas.db.ByURL(ctx, owner, item.URL); err == nil {
+		return s.Service.Shortify(ctx, item)
+	}
+	creations := creationsCounter(time.Now())
+	if err := s.quotas.reserve(ctx, owner, usageLinks, quota.MaxLinks, errLinkQuotaExceeded); err != nil {
+		return nil, err
+	}
+	if err := s.quotas.reserve(ctx, owner, creations, quota.CreationsPerDay, errCreationQuotaExceeded); err != nil {
+		s.quotas.release(ctx, owner, usageLinks)
+		return nil, err
+	}
+	m, err := s.Service.Shortify(ctx, item)
+	// unless shortened concurrently
+	if err != nil || !m.created {
+		s.quotas.release(ctx, owner, usageLinks, creations)
+	}
+	return m, err
+}
+
+func (s *quotaService) Resolve(ctx context.Context, shortURL string) (*shortURL, error) {
+	tenant := tenantFrom(ctx)
+	if !s.quotas.tenants.hasKeys(tenant) {
+		return s.Service.Resolve(ctx, shortURL)
+	}
+	m, err := s.Service.GetInfo(ctx, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	owner := m.Owner
+	quota, ok := s.quotas.tenants.quota(tenant, owner)
+	if !ok {
+		return s.Service.Resolve(ctx, shortURL)
+	}
+	redirects := redirectsCounter(time.Now())
+	if err := s.quotas.reserve(ctx, owner, redirects, quota.RedirectsPerMonth, errRedirectQuotaExceeded); err != nil {
+		return nil, err
+	}
+	m, err = s.Service.Resolve(ctx, shortURL)
+	if err != nil {
+		s.quotas.release(ctx, owner, redirects)
+		return nil, err
+	}
+	if m.MaxVisits == 1 {
+		// single-use links are deleted by their visit
+		s.quotas.release(ctx, owner, usageLinks)
+	}
+	return m, nil
+}
+
+type usageResponse struct {
+	Owner              string `json:"owner,omitempty"`
+	Quota              *Quota `json:"quota,omitempty"`
+	Links              uint64 `json:"links"`
+	CreationsToday     uint64 `json:"creationsToday"`
+	RedirectsThisMonth uint64 `json:"redirectsThisMonth"`
+	Err                error  `json:"error,omitempty"`
+}
+
+func (r usageResponse) error() error { return r.Err }
+
+// makeUsageEndpoint reports the usage and quota of the owner of the API key
+// of the request.
+func makeUsageEndpoint(q *Quotas) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		owner := ownerFrom(ctx)
+		quota, ok := q.tenants.quota(tenantFrom(ctx), owner)
+		if !ok {
+			return usageResponse{Err: errUnauthorized}, nil
+		}
+		now := time.Now()
+		usage, err := q.db.Usage(ctx, owner, usageLinks, creationsCounter(now), redirectsCounter(now))
+		if err != nil {
+			return usageResponse{Err: err}, nil
+		}
+		return usageResponse{
+			Owner:              owner,
+			Quota:              &quota,
+			Links:              usage[usageLinks],
+			CreationsToday:     usage[creationsCounter(now)],
+			RedirectsThisMonth: usage[redirectsCounter(now)],
+		}, nil
+	}
+}
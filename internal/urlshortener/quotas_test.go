@@ -0,0 +1,111 @@
+package urlshortener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/go-kit/kit/log"
+)
+
+// newQuotaTest serves tenant t1, whose owner ann may have two links and
+// three redirects a month.
+func newQuotaTest(t *testing.T) (Service, shortURLStorage, context.Context) {
+	t.Helper()
+	tenants, err := NewTenants(&Tenant{ID: "t1", Domains: []string{"t1.example"}, APIKeys: []APIKey{
+		{Key: "k", Owner: "ann", Quota: &Quota{MaxLinks: 2, RedirectsPerMonth: 3}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewInMemoryStorage()
+	s := NewQuotaService(NewQuotas(tenants, db, log.NewNopLogger()), NewService(db))
+	ctx := context.WithValue(withTenant(context.Background(), "t1"), contextKeyOwner, "ann")
+	return s, db, ctx
+}
+
+func usageOf(t *testing.T, db shortURLStorage, ctx context.Context, counter string) uint64 {
+	t.Helper()
+	usage, err := db.Usage(ctx, "ann", counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usage[counter]
+}
+
+func TestQuotaLinks(t *testing.T) {
+	s, db, ctx := newQuotaTest(t)
+	// concurrent shortifies of a URL count a single link
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := usageOf(t, db, ctx, usageLinks); n != 1 {
+		t.Errorf("%d links counted, want 1", n)
+	}
+	if n := usageOf(t, db, ctx, creationsCounter(time.Now())); n != 1 {
+		t.Errorf("%d creations counted, want 1", n)
+	}
+	// failed creations give their reservation back
+	if _, err := s.Shortify(ctx, &shortURL{URL: "not a url"}); err != errMalformedURL {
+		t.Errorf("malformed URL: %v, want %v", err, errMalformedURL)
+	}
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/c"}); err != errLinkQuotaExceeded {
+		t.Errorf("third link: %v, want %v", err, errLinkQuotaExceeded)
+	}
+	// links shortened before are returned past the quota
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"}); err != nil {
+		t.Errorf("shortening a URL again: %v", err)
+	}
+	if n := usageOf(t, db, ctx, usageLinks); n != 2 {
+		t.Errorf("%d links counted, want 2", n)
+	}
+}
+
+func TestQuotaRedirects(t *testing.T) {
+	s, db, ctx := newQuotaTest(t)
+	m, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	once, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/once", MaxVisits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// visitors have no API key
+	visit := withTenant(context.Background(), "t1")
+	if _, err := s.Resolve(visit, base62.Encode(once.ID)); err != nil {
+		t.Fatal(err)
+	}
+	// the single-use link is gone and no longer counted
+	if n := usageOf(t, db, ctx, usageLinks); n != 1 {
+		t.Errorf("%d links counted after the single-use visit, want 1", n)
+	}
+	// an unknown link costs nothing
+	if _, err := s.Resolve(visit, base62.Encode(once.ID)); err != errURLNotFound {
+		t.Errorf("visit of the deleted link: %v, want %v", err, errURLNotFound)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Resolve(visit, base62.Encode(m.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Resolve(visit, base62.Encode(m.ID)); err != errRedirectQuotaExceeded {
+		t.Errorf("fourth redirect: %v, want %v", err, errRedirectQuotaExceeded)
+	}
+	if n := usageOf(t, db, ctx, redirectsCounter(time.Now())); n != 3 {
+		t.Errorf("%d redirects counted, want 3", n)
+	}
+}
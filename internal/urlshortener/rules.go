@@ -0,0 +1,192 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/geoip"
+
+	valid "github.com/asaskevich/govalidator"
+)
+
+var (
+	errInvalidRules  = errors.New("Invalid redirect rules")
+	errRulesConflict = errors.New("This URL is already shortened with other redirect rules")
+)
+
+var contextKeyClient = contextKey("URLShortenerClient")
+
+// The devices redirect rules match, mobile matches ios and android too.
+const (
+	deviceIOS     = "ios"
+	deviceAndroid = "android"
+	deviceMobile  = "mobile"
+	deviceDesktop = "desktop"
+)
+
+const maxRules = 32
+
+// redirectRule sends the clients matching all its conditions to URL instead
+// of the URL of the link.
+type redirectRule struct {
+	Device string `json:"device,omitempty"`
+	// Countries are ISO 3166-1 alpha-2 codes, any of them matches
+	Countries []string `json:"countries,omitempty"`
+	URL       string   `json:"url"`
+}
+
+// client is what redirect rules and split links know of the visitor of a
+// link.
+type client struct {
+	device  string
+	country string
+	// variant is the key of the variant the client stuck to, see variantKey
+	variant string
+}
+
+func (r *redirectRule) matches(c client) bool {
+	switch r.Device {
+	case "":
+	case deviceMobile:
+		if c.device != deviceIOS && c.device != deviceAndroid && c.device != deviceMobile {
+			return false
+		}
+	default:
+		if r.Device != c.device {
+			return false
+		}
+	}
+	if len(r.Countries) == 0 {
+		return true
+	}
+	for _, country := range r.Countries {
+		if country == c.country {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeRules validates the rules of a link, which must have conditions:
+// the URL of the link is the destination of the clients no rule matches.
+func normalizeRules(rules []redirectRule) ([]redirectRule, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if len(rules) > maxRules {
+		return nil, errInvalidRules
+	}
+	normalized := make([]redirectRule, 0, len(rules))
+	for _, r := range rules {
+		r.Device = strings.ToLower(strings.TrimSpace(r.Device))
+		switch r.Device {
+		case "", deviceIOS, deviceAndroid, deviceMobile, deviceDesktop:
+		default:
+			return nil, errInvalidRules
+		}
+		countries := make([]string, 0, len(r.Countries))
+		for _, c := range r.Countries {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if !valid.IsISO3166Alpha2(c) {
+				return nil, errInvalidRules
+			}
+			countries = append(countries, c)
+		}
+		r.Countries = nil
+		if len(countries) > 0 {
+			r.Countries = countries
+		}
+		if r.Device == "" && r.Countries == nil || !valid.IsURL(r.URL) {
+			return nil, errInvalidRules
+		}
+		normalized = append(normalized, r)
+	}
+	return normalized, nil
+}
+
+// rule returns the first rule c matches, nil if none.
+func (m *shortURL) rule(c client) *redirectRule {
+	for i := range m.Rules {
+		if m.Rules[i].matches(c) {
+			return &m.Rules[i]
+		}
+	}
+	return nil
+}
+
+// destination returns the URL the client is sent to: that of the first rule
+// it matches, else that of the variant picked by Resolve, else the URL of
+// the link.
+func (m *shortURL) destination(c client) string {
+	if r := m.rule(c); r != nil {
+		return r.URL
+	}
+	if m.variant > 0 {
+		return m.Variants[m.variant-1].URL
+	}
+	return m.URL
+}
+
+// deviceOf tells the device of a User-Agent. iPads asking for the desktop
+// site are taken at their word.
+func deviceOf(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod"):
+		return deviceIOS
+	case strings.Contains(ua, "android"):
+		return deviceAndroid
+	case strings.Contains(ua, "mobile") || strings.Contains(ua, "windows phone") || strings.Contains(ua, "blackberry"):
+		return deviceMobile
+	default:
+		return deviceDesktop
+	}
+}
+
+// Geo locates the clients of redirect rules by country, with a local GeoIP
+// database or a header set by a trusted proxy, e.g. CF-IPCountry. A nil *Geo
+// only tells devices.
+type Geo struct {
+	db     *geoip.DB
+	header string
+}
+
+// NewGeo returns a Geo looking up the country in header first, if not empty,
+// then the remote address in db, if not nil.
+func NewGeo(db *geoip.DB, header string) *Geo {
+	return &Geo{db: db, header: header}
+}
+
+func (g *Geo) country(r *http.Request) string {
+	if g == nil {
+		return ""
+	}
+	if g.header != "" {
+		if c := strings.ToUpper(strings.TrimSpace(r.Header.Get(g.header))); valid.IsISO3166Alpha2(c) {
+			return c
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return g.db.Country(net.ParseIP(host))
+}
+
+// populateContext is a kithttp.RequestFunc storing the client redirect rules
+// and split links are evaluated for.
+func (g *Geo) populateContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, contextKeyClient, client{
+		device:  deviceOf(r.UserAgent()),
+		country: g.country(r),
+		variant: variantFromCookie(r),
+	})
+}
+
+func clientFrom(ctx context.Context) client {
+	c, _ := ctx.Value(contextKeyClient).(client)
+	return c
+}
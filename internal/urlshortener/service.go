@@ -1,11 +1,17 @@
 package urlshortener
 
+import "context"
+
 // Service provides operations on Users.
 type Service interface {
 	//Creates a new shortURL from a longURL
-	Shortify(longURL string) (*shortURL, error)
+	Shortify(ctx context.Context, item *shortURL) (*shortURL, error)
 	//Retrieves a long URL from a short one
-	Resolve(shortURL string) (*shortURL, error)
-	GetInfo(shortURL string) (*shortURL, error)
-	IsHealthy() (bool, error)
+	Resolve(ctx context.Context, shortURL string) (*shortURL, error)
+	GetInfo(ctx context.Context, shortURL string) (*shortURL, error)
+	//Changes the attributes of a shortURL
+	Update(ctx context.Context, shortURL string, u *linkUpdate) (*shortURL, error)
+	//Lists the shortURLs matching a query, one page at a time
+	List(ctx context.Context, q *listQuery) (*listPage, error)
+	IsHealthy(ctx context.Context) (bool, error)
 }
@@ -1,65 +1,362 @@
 package urlshortener
 
 import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/friends-of-scalability/url-shortener/pkg"
 )
 
 type shortURLStorage interface {
-	//Creates a new shortURL from a longURL
-	Save(Item *shortURL) (*shortURL, error)
-	ByID(id string) (*shortURL, error)
-	ByURL(URL string) (*shortURL, error)
+	//Creates a new shortURL from a longURL, unless its owner already
+	//shortened it; reports whether it stored one
+	Save(ctx context.Context, Item *shortURL) (*shortURL, bool, error)
+	ByID(ctx context.Context, id string) (*shortURL, error)
+	//Returns the shortURL of owner shortening URL, links are not shared
+	//between the owners of a tenant
+	ByURL(ctx context.Context, owner, URL string) (*shortURL, error)
+	//Replaces the stored attributes of an existing shortURL
+	Update(ctx context.Context, item *shortURL) error
+	Delete(ctx context.Context, id uint64) error
+	//Returns a page of shortURLs matching the query
+	List(ctx context.Context, q *listQuery) (*listPage, error)
+	IncrementVisits(ctx context.Context, id uint64) error
+	//Counts a visit unless the shortURL already has max visits, failing with
+	//errLinkExhausted then; returns the visits counted
+	IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error)
+	//Counts a visit of the variant of a split shortURL whose URL is variant
+	IncrementVariantVisits(ctx context.Context, id uint64, variant string) error
+	//Records the last check of the destinations of a shortURL
+	SetCheck(ctx context.Context, id uint64, check *linkCheck) error
+	//Adds visits to many shortURLs at once, unknown IDs are skipped
+	AddVisits(ctx context.Context, visits map[uint64]uint64) error
+	//Adds n, possibly negative, to a usage counter of owner without going
+	//below 0. An increment past limit, unless 0, is not applied and reports
+	//false
+	AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error)
+	//Returns the usage counters of owner, 0 for those never added to
+	Usage(ctx context.Context, owner string, counters ...string) (map[string]uint64, error)
+	Close() error
+}
+
+// reservedIDs are path segments routed by MakeHandler, short URLs encoding
+// to one of them would never be reachable, nor forward the paths following
+// them.
+var reservedIDs = map[string]bool{
+	"admin":   true,
+	"debug":   true,
+	"healthz": true,
+	"info":    true,
+	"links":   true,
+	"ui":      true,
+	"usage":   true,
+}
+
+func isReservedID(id uint64) bool {
+	return reservedIDs[base62.Encode(id)]
 }
 
 // shortURLRepository is an in-memory user database.
 type shortURLInMemoryRepository struct {
-	shortURLRepository map[string]*shortURL
+	mtx   sync.RWMutex
+	byID  map[uint64]*shortURL
+	byURL map[ownedURL]*shortURL
+	// ids keeps the creation order, IDs are handed out incrementally and
+	// creation times never go back
+	ids []uint64
+	// lastID is never reused, even if its shortURL has been deleted
+	lastID uint64
+	// usage holds the usage counters of each owner
+	usage map[string]map[string]uint64
 }
 
-// ByShortURL finds and URL in our databse.
-func (u *shortURLInMemoryRepository) ByURL(URL string) (*shortURL, error) {
+// NewInMemoryStorage returns a storage keeping shortURLs in this process,
+// one repository per tenant.
+func NewInMemoryStorage() shortURLStorage {
+	return newTenantStorage(func(string) (shortURLStorage, error) {
+		return newInMemoryRepository(), nil
+	}, nil)
+}
 
-	for _, mapping := range u.shortURLRepository {
-		if mapping.URL == URL {
-			return mapping, nil
-		}
+func newInMemoryRepository() *shortURLInMemoryRepository {
+	return &shortURLInMemoryRepository{
+		byID:  map[uint64]*shortURL{},
+		byURL: map[ownedURL]*shortURL{},
+		usage: map[string]map[string]uint64{},
+	}
+}
+
+// ownedURL keys the links of an owner by destination.
+type ownedURL struct {
+	owner, url string
+}
+
+// ByShortURL finds and URL in our databse.
+func (u *shortURLInMemoryRepository) ByURL(ctx context.Context, owner, URL string) (*shortURL, error) {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	if mapping, ok := u.byURL[ownedURL{owner, URL}]; ok {
+		return mapping.clone(), nil
 	}
 	return nil, errURLNotFound
 }
 
-func (u *shortURLInMemoryRepository) ByID(id string) (*shortURL, error) {
+func (u *shortURLInMemoryRepository) ByID(ctx context.Context, id string) (*shortURL, error) {
 
 	key, err := base62.Decode(id)
 	if err != nil {
 		return nil, errMalformedURL
 	}
-	for _, mapping := range u.shortURLRepository {
-		if mapping.ID == key {
-			return mapping, nil
-		}
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	if mapping, ok := u.byID[key]; ok {
+		return mapping.clone(), nil
 	}
 	return nil, errURLNotFound
 }
 
 // ByShortURL finds and URL in our databse.
-func (u *shortURLInMemoryRepository) Save(item *shortURL) (*shortURL, error) {
+func (u *shortURLInMemoryRepository) Save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
 
-	m, err := u.ByURL(item.URL)
-	if err != errURLNotFound {
-		return m, err
+	if m, ok := u.byURL[ownedURL{item.Owner, item.URL}]; ok {
+		return m.clone(), false, nil
 	}
 	var mapping shortURL
-	var autoInc uint64
-	for _, mapping := range u.shortURLRepository {
-		if mapping.ID > autoInc {
-			autoInc = mapping.ID
-		}
+	autoInc := u.lastID + 1
+	for isReservedID(autoInc) {
+		autoInc++
 	}
-	autoInc++
+	u.lastID = autoInc
 	mapping.URL = item.URL
 	mapping.VisitsCounter = 0
+	mapping.CreatedAt = time.Now().UTC()
+	if n := len(u.ids); n > 0 && mapping.CreatedAt.Before(u.byID[u.ids[n-1]].CreatedAt) {
+		// the wall clock was set back
+		mapping.CreatedAt = u.byID[u.ids[n-1]].CreatedAt
+	}
+	mapping.Preview = item.Preview
+	mapping.Owner = item.Owner
+	mapping.Title = item.Title
+	mapping.Tags = item.Tags
+	mapping.Metadata = item.Metadata
+	mapping.PasswordHash = item.PasswordHash
+	mapping.MaxVisits = item.MaxVisits
+	mapping.Rules = item.Rules
+	mapping.Variants = item.Variants
+	mapping.Sticky = item.Sticky
+	mapping.Passthrough = item.Passthrough
+	mapping.UTM = item.UTM
+	mapping.Prefix = item.Prefix
 	mapping.ID = autoInc
-	encodedkey := base62.Encode(mapping.ID)
-	u.shortURLRepository[encodedkey] = &mapping
-	return &mapping, nil
+	u.byID[mapping.ID] = &mapping
+	u.byURL[ownedURL{mapping.Owner, mapping.URL}] = &mapping
+	u.ids = append(u.ids, mapping.ID)
+	return mapping.clone(), true, nil
+}
+
+func (u *shortURLInMemoryRepository) Update(ctx context.Context, item *shortURL) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	stored, ok := u.byID[item.ID]
+	if !ok {
+		return errURLNotFound
+	}
+	// only the attributes a caller may change: the visits and the check
+	// are counted meanwhile and must not be written back from item
+	mapping := *stored
+	mapping.Preview = item.Preview
+	mapping.Title = item.Title
+	mapping.Metadata = item.Metadata
+	mapping.Rules = item.Rules
+	mapping.Variants = append([]linkVariant(nil), item.Variants...)
+	keepVariantVisits(mapping.Variants, stored.Variants)
+	mapping.Sticky = item.Sticky
+	mapping.Passthrough = item.Passthrough
+	mapping.UTM = item.UTM
+	mapping.Prefix = item.Prefix
+	mapping.Tags = item.Tags
+	u.byID[item.ID] = &mapping
+	u.byURL[ownedURL{mapping.Owner, mapping.URL}] = &mapping
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) Delete(ctx context.Context, id uint64) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	mapping, ok := u.byID[id]
+	if !ok {
+		return errURLNotFound
+	}
+	delete(u.byID, id)
+	delete(u.byURL, ownedURL{mapping.Owner, mapping.URL})
+	i := sort.Search(len(u.ids), func(i int) bool { return u.ids[i] >= id })
+	u.ids = append(u.ids[:i], u.ids[i+1:]...)
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) IncrementVisits(ctx context.Context, id uint64) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	mapping, ok := u.byID[id]
+	if !ok {
+		return errURLNotFound
+	}
+	mapping.VisitsCounter++
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	mapping, ok := u.byID[id]
+	if !ok {
+		return 0, errURLNotFound
+	}
+	if mapping.VisitsCounter >= max {
+		return mapping.VisitsCounter, errLinkExhausted
+	}
+	mapping.VisitsCounter++
+	return mapping.VisitsCounter, nil
+}
+
+func (u *shortURLInMemoryRepository) IncrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	mapping, ok := u.byID[id]
+	if !ok {
+		return errURLNotFound
+	}
+	for i, v := range mapping.Variants {
+		if v.URL == variant {
+			// clones share the variants
+			mapping.Variants = countVariantVisit(mapping.Variants, i)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) SetCheck(ctx context.Context, id uint64, check *linkCheck) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	mapping, ok := u.byID[id]
+	if !ok {
+		return errURLNotFound
+	}
+	mapping.Check = check
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	for id, n := range visits {
+		if mapping, ok := u.byID[id]; ok {
+			mapping.VisitsCounter += n
+		}
+	}
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	counters := u.usage[owner]
+	if counters == nil {
+		counters = map[string]uint64{}
+		u.usage[owner] = counters
+	}
+	value, ok := addUsage(counters[counter], n, limit)
+	if ok {
+		counters[counter] = value
+	}
+	return value, ok, nil
+}
+
+// addUsage returns value plus n, floored at 0, and false if that is past
+// limit.
+func addUsage(value uint64, n int64, limit uint64) (uint64, bool) {
+	switch {
+	case n >= 0 && limit > 0 && value+uint64(n) > limit:
+		return value, false
+	case n >= 0:
+		return value + uint64(n), true
+	case uint64(-n) > value:
+		return 0, true
+	}
+	return value - uint64(-n), true
+}
+
+func (u *shortURLInMemoryRepository) Usage(ctx context.Context, owner string, counters ...string) (map[string]uint64, error) {
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+	usage := make(map[string]uint64, len(counters))
+	for _, c := range counters {
+		usage[c] = u.usage[owner][c]
+	}
+	return usage, nil
+}
+
+func (u *shortURLInMemoryRepository) Close() error {
+	return nil
+}
+
+func (u *shortURLInMemoryRepository) List(ctx context.Context, q *listQuery) (*listPage, error) {
+	cursor, err := decodeListCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	u.mtx.RLock()
+	defer u.mtx.RUnlock()
+
+	page := &listPage{}
+	if q.SortBy == sortByVisits {
+		// visits change all the time, sort a snapshot of the matches
+		var matches []*shortURL
+		for _, id := range u.ids {
+			if m := u.byID[id]; q.matches(m) {
+				matches = append(matches, m)
+			}
+		}
+		sort.Slice(matches, func(i, j int) bool {
+			return q.less(matches[i], matches[j])
+		})
+		for _, m := range matches {
+			if cursor != nil && !q.after(m, cursor) {
+				continue
+			}
+			if page.add(m.clone(), q) {
+				break
+			}
+		}
+		return page, nil
+	}
+
+	// creation order is the order of u.ids, walk it from the cursor
+	n := len(u.ids)
+	start := 0
+	if cursor != nil {
+		asc := listQuery{SortBy: sortByCreation}
+		start = sort.Search(n, func(i int) bool { return asc.after(u.byID[u.ids[i]], cursor) })
+		if q.Desc {
+			start = n - sort.Search(n, func(i int) bool {
+				m := u.byID[u.ids[i]]
+				return m.ID == cursor.ID || asc.after(m, cursor)
+			})
+		}
+	}
+	for i := start; i < n; i++ {
+		id := u.ids[i]
+		if q.Desc {
+			id = u.ids[n-1-i]
+		}
+		if m := u.byID[id]; q.matches(m) && page.add(m.clone(), q) {
+			break
+		}
+	}
+	return page, nil
 }
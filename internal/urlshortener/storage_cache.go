@@ -0,0 +1,296 @@
+package urlshortener
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+)
+
+// cacheStats are published at /debug/vars.
+var cacheStats = expvar.NewMap("storage_cache")
+
+// shortURLCache is a read-through cache of ByID lookups in front of another
+// storage. Links not found are cached too, for negativeTTL, so scans of
+// random IDs don't reach the backend.
+type shortURLCache struct {
+	shortURLStorage
+
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mtx sync.Mutex
+	// lru holds *cacheEntry, most recently used first
+	lru   *list.List
+	items map[cacheKey]*list.Element
+	// fills are the ByID misses being fetched, by key
+	fills map[cacheKey]*cacheFill
+}
+
+// cacheKey identifies a link, IDs are only unique within a tenant.
+type cacheKey struct {
+	tenant string
+	id     uint64
+}
+
+// cacheFill tracks the fetches of a key in flight. Writes to the key bump
+// its generation, a fetch started before a write does not fill the cache.
+type cacheFill struct {
+	fetches    int
+	generation uint64
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	link    *shortURL // nil if not found
+	expires time.Time
+}
+
+// NewCachedStorage caches up to size links of next for ttl. Writes through
+// this storage invalidate the cached entries, writes by other replicas are
+// only seen once the entries expire.
+func NewCachedStorage(next shortURLStorage, size int, ttl, negativeTTL time.Duration) shortURLStorage {
+	c := &shortURLCache{
+		shortURLStorage: next,
+		size:            size,
+		ttl:             ttl,
+		negativeTTL:     negativeTTL,
+		lru:             list.New(),
+		items:           map[cacheKey]*list.Element{},
+		fills:           map[cacheKey]*cacheFill{},
+	}
+	cacheStats.Set("entries", expvar.Func(func() interface{} {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return c.lru.Len()
+	}))
+	return c
+}
+
+func (c *shortURLCache) ByID(ctx context.Context, id string) (*shortURL, error) {
+	decoded, err := base62.Decode(id)
+	if err != nil {
+		return c.shortURLStorage.ByID(ctx, id)
+	}
+	key := cacheKey{tenantFrom(ctx), decoded}
+	if m, found, ok := c.get(key); ok {
+		if !found {
+			cacheStats.Add("negative_hits", 1)
+			return nil, errURLNotFound
+		}
+		cacheStats.Add("hits", 1)
+		return m, nil
+	}
+	cacheStats.Add("misses", 1)
+
+	generation := c.startFill(key)
+	m, err := c.shortURLStorage.ByID(ctx, id)
+	switch {
+	case err == errURLNotFound && c.negativeTTL > 0:
+		c.endFill(key, generation, nil, c.negativeTTL)
+	case err == nil:
+		c.endFill(key, generation, m.clone(), c.ttl)
+	default:
+		c.endFill(key, generation, nil, 0)
+	}
+	return m, err
+}
+
+func (c *shortURLCache) Save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	m, created, err := c.shortURLStorage.Save(ctx, item)
+	if err == nil {
+		// the ID may have been cached as not found
+		c.invalidate(cacheKey{tenantFrom(ctx), m.ID})
+	}
+	return m, created, err
+}
+
+func (c *shortURLCache) Update(ctx context.Context, item *shortURL) error {
+	err := c.shortURLStorage.Update(ctx, item)
+	c.invalidate(cacheKey{tenantFrom(ctx), item.ID})
+	return err
+}
+
+func (c *shortURLCache) Delete(ctx context.Context, id uint64) error {
+	err := c.shortURLStorage.Delete(ctx, id)
+	c.invalidate(cacheKey{tenantFrom(ctx), id})
+	return err
+}
+
+func (c *shortURLCache) IncrementVisits(ctx context.Context, id uint64) error {
+	if err := c.shortURLStorage.IncrementVisits(ctx, id); err != nil {
+		return err
+	}
+	key := cacheKey{tenantFrom(ctx), id}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.touch(key)
+	if e, ok := c.items[key]; ok {
+		if entry := e.Value.(*cacheEntry); entry.link != nil {
+			entry.link.VisitsCounter++
+		}
+	}
+	return nil
+}
+
+func (c *shortURLCache) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error) {
+	visits, err := c.shortURLStorage.IncrementVisitsUpTo(ctx, id, max)
+	if err != nil && err != errLinkExhausted {
+		return visits, err
+	}
+	key := cacheKey{tenantFrom(ctx), id}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.touch(key)
+	if e, ok := c.items[key]; ok {
+		if entry := e.Value.(*cacheEntry); entry.link != nil {
+			entry.link.VisitsCounter = visits
+		}
+	}
+	return visits, err
+}
+
+func (c *shortURLCache) IncrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	if err := c.shortURLStorage.IncrementVariantVisits(ctx, id, variant); err != nil {
+		return err
+	}
+	key := cacheKey{tenantFrom(ctx), id}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.touch(key)
+	if e, ok := c.items[key]; ok {
+		if entry := e.Value.(*cacheEntry); entry.link != nil {
+			for i, v := range entry.link.Variants {
+				if v.URL == variant {
+					entry.link.Variants = countVariantVisit(entry.link.Variants, i)
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *shortURLCache) SetCheck(ctx context.Context, id uint64, check *linkCheck) error {
+	if err := c.shortURLStorage.SetCheck(ctx, id, check); err != nil {
+		return err
+	}
+	key := cacheKey{tenantFrom(ctx), id}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.touch(key)
+	if e, ok := c.items[key]; ok {
+		if entry := e.Value.(*cacheEntry); entry.link != nil {
+			entry.link.Check = check
+		}
+	}
+	return nil
+}
+
+func (c *shortURLCache) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	if err := c.shortURLStorage.AddVisits(ctx, visits); err != nil {
+		return err
+	}
+	tenant := tenantFrom(ctx)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for id, n := range visits {
+		key := cacheKey{tenant, id}
+		c.touch(key)
+		if e, ok := c.items[key]; ok {
+			if entry := e.Value.(*cacheEntry); entry.link != nil {
+				entry.link.VisitsCounter += n
+			}
+		}
+	}
+	return nil
+}
+
+// get returns a copy of the cached link, found is false for cached misses
+// and ok is false if key is not cached.
+func (c *shortURLCache) get(key cacheKey) (m *shortURL, found, ok bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false, false
+	}
+	c.lru.MoveToFront(e)
+	if entry.link == nil {
+		return nil, false, true
+	}
+	return entry.link.clone(), true, true
+}
+
+// put caches m for ttl, c.mtx is held.
+func (c *shortURLCache) put(key cacheKey, m *shortURL, ttl time.Duration) {
+	entry := &cacheEntry{key: key, link: m, expires: time.Now().Add(ttl)}
+	if e, ok := c.items[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		cacheStats.Add("evictions", 1)
+	}
+}
+
+// startFill registers a fetch of key and returns the generation it starts
+// from.
+func (c *shortURLCache) startFill(key cacheKey) uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	f := c.fills[key]
+	if f == nil {
+		f = &cacheFill{}
+		c.fills[key] = f
+	}
+	f.fetches++
+	return f.generation
+}
+
+// endFill caches m for ttl, unless ttl is 0 or key was written since the
+// fetch started at generation.
+func (c *shortURLCache) endFill(key cacheKey, generation uint64, m *shortURL, ttl time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	f := c.fills[key]
+	if f.fetches--; f.fetches == 0 {
+		delete(c.fills, key)
+	}
+	if ttl > 0 && f.generation == generation {
+		c.put(key, m, ttl)
+	}
+}
+
+// touch marks key as written for the fetches in flight, c.mtx is held.
+func (c *shortURLCache) touch(key cacheKey) {
+	if f := c.fills[key]; f != nil {
+		f.generation++
+	}
+}
+
+func (c *shortURLCache) invalidate(key cacheKey) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.touch(key)
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *shortURLCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(*cacheEntry).key)
+}
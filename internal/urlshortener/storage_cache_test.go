@@ -0,0 +1,55 @@
+package urlshortener
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+)
+
+// slowLookups holds ByID until released, after it read the link.
+type slowLookups struct {
+	shortURLStorage
+	read, release chan struct{}
+}
+
+func (s *slowLookups) ByID(ctx context.Context, id string) (*shortURL, error) {
+	m, err := s.shortURLStorage.ByID(ctx, id)
+	s.read <- struct{}{}
+	<-s.release
+	return m, err
+}
+
+// A lookup reading a link before an update must not cache it after.
+func TestCacheSkipsStaleFill(t *testing.T) {
+	ctx := context.Background()
+	backend := &slowLookups{NewInMemoryStorage(), make(chan struct{}), make(chan struct{})}
+	db := NewCachedStorage(backend, 10, time.Minute, time.Minute)
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Title: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.ByID(ctx, base62.Encode(m.ID))
+	}()
+	<-backend.read
+	updated := m.clone()
+	updated.Title = "new"
+	if err := db.Update(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+	close(backend.release)
+	<-done
+
+	go func() { <-backend.read }()
+	got, err := db.ByID(ctx, base62.Encode(m.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "new" {
+		t.Errorf("title %q after the update, want new", got.Title)
+	}
+}
@@ -0,0 +1,1007 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/friends-of-scalability/url-shortener/pkg/resp"
+)
+
+var errStorageContention = errors.New("too many concurrent writes, try again")
+
+// shortURLRedisRepository stores shortURLs in a Redis compatible server so
+// every replica sees the same links. Keys, all under a common prefix:
+//
+//	seq              counter of the IDs leased by replicas
+//	schema           version of the layout of the keys below
+//	link:<id>        hash with the fields of a shortURL but its visits
+//	variants:<id>    sorted set of the variant URLs of a link scored by visits
+//	url:<url>        ID of the shortURL of a destination, for links without owner
+//	owner:<own>:url:<url>
+//	                 the same for the links of an owner
+//	created          sorted set of IDs scored by creation time in µs
+//	visits           sorted set of IDs scored by visits
+//	created:<index>  the same for the links of an index, see linkIndexes
+//	visits:<index>
+//	usage:<own>      hash of the usage counters of an owner
+//
+// Sorted set members are zero padded IDs, so ties sort by ID. Visits are
+// only counted with ZADD XX INCR, which adds nothing to the sorted sets of a
+// deleted link. The keys of a tenant other than the default one are also
+// prefixed by tenant:<id>:.
+type shortURLRedisRepository struct {
+	pool   *resp.Pool
+	prefix string
+	ids    *idAllocator
+}
+
+// NewRedisStorage connects to a Redis compatible server at addr. IDs are
+// leased idBlock at a time, from a sequence per tenant.
+func NewRedisStorage(addr, password string, db int, prefix string, idBlock uint64) (shortURLStorage, error) {
+	pool := resp.NewPool(addr, resp.Options{Password: password, DB: db, MaxIdle: 16})
+	if _, err := pool.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return newTenantStorage(func(tenant string) (shortURLStorage, error) {
+		u := &shortURLRedisRepository{pool: pool, prefix: prefix}
+		if tenant != "" {
+			u.prefix += "tenant:" + tenant + ":"
+		}
+		u.ids = newIDAllocator(idBlock, u.reserveIDs)
+		return u, u.migrate()
+	}, pool.Close), nil
+}
+
+// redisSchema is the version of the layout of the keys of a tenant.
+const redisSchema = 3
+
+// migrate brings the links stored with an older layout to the current one:
+// version 1 scores the created sorted set by creation time and builds the
+// indexes, version 2 moves the visits of variants from the hash of their
+// link to a sorted set, version 3 keys the destinations of links having an
+// owner by owner. Replicas starting together do the same work twice,
+// harmlessly.
+func (u *shortURLRedisRepository) migrate() error {
+	version, err := resp.Int(u.pool.Do("GET", u.prefix+"schema"))
+	if err != nil && err != resp.ErrNil {
+		return err
+	}
+	if version >= redisSchema {
+		return nil
+	}
+	members, err := resp.Strings(u.pool.Do("ZRANGE", u.prefix+"created", 0, -1))
+	if err != nil {
+		return err
+	}
+	for len(members) > 0 {
+		batch := members
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		members = members[len(batch):]
+		var cmds [][]interface{}
+		for _, mem := range batch {
+			id, _ := strconv.ParseUint(mem, 10, 64)
+			m, err := u.get(id)
+			if err == errURLNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if version < 1 {
+				indexes := linkIndexes(m)
+				b, err := json.Marshal(indexes)
+				if err != nil {
+					return err
+				}
+				cmds = append(cmds,
+					[]interface{}{"ZADD", u.prefix + "created", createdScore(m.CreatedAt), member(id)},
+					[]interface{}{"HSET", u.linkKey(id), "indexes", b},
+				)
+				cmds = append(cmds, u.indexCmds(m, indexes)...)
+			}
+			if version < 2 {
+				fields, err := resp.StringMap(u.pool.Do("HGETALL", u.linkKey(id)))
+				if err != nil {
+					return err
+				}
+				for _, v := range m.Variants {
+					visits, _ := strconv.ParseUint(fields["variant:"+v.URL], 10, 64)
+					cmds = append(cmds, []interface{}{"ZADD", u.variantsKey(id), "NX", visits, v.URL})
+				}
+				for field := range fields {
+					if field == "visits" || strings.HasPrefix(field, "variant:") {
+						cmds = append(cmds, []interface{}{"HDEL", u.linkKey(id), field})
+					}
+				}
+			}
+			if version < 3 && m.Owner != "" {
+				shared, err := resp.Int(u.pool.Do("GET", u.urlKey("", m.URL)))
+				if err != nil && err != resp.ErrNil {
+					return err
+				}
+				cmds = append(cmds, []interface{}{"SET", u.urlKey(m.Owner, m.URL), id})
+				if err == nil && uint64(shared) == id {
+					cmds = append(cmds, []interface{}{"DEL", u.urlKey("", m.URL)})
+				}
+			}
+		}
+		if len(cmds) == 0 {
+			continue
+		}
+		if _, err := u.transaction(cmds...); err != nil {
+			return err
+		}
+	}
+	_, err = u.pool.Do("SET", u.prefix+"schema", redisSchema)
+	return err
+}
+
+func (u *shortURLRedisRepository) linkKey(id uint64) string {
+	return u.prefix + "link:" + strconv.FormatUint(id, 10)
+}
+
+// urlKey holds the ID of the link of owner shortening URL.
+func (u *shortURLRedisRepository) urlKey(owner, URL string) string {
+	if owner == "" {
+		return u.prefix + "url:" + URL
+	}
+	return u.prefix + "owner:" + owner + ":url:" + URL
+}
+
+func (u *shortURLRedisRepository) variantsKey(id uint64) string {
+	return u.prefix + "variants:" + strconv.FormatUint(id, 10)
+}
+
+func member(id uint64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+// createdScore is the score of a link in the created sorted sets. Creation
+// times are stored in µs, float scores hold them exactly.
+func createdScore(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// orderKey is the sorted set of the links of index in order, every link if
+// index is empty.
+func (u *shortURLRedisRepository) orderKey(order, index string) string {
+	key := u.prefix + order
+	if index != "" {
+		key += ":" + index
+	}
+	return key
+}
+
+// linkIndexes are the listing filters m matches, each one has a sorted set
+// per order: its owner, its tags, the domains of its destination and broken
+// if its last check found it broken.
+func linkIndexes(m *shortURL) []string {
+	var indexes []string
+	if m.Owner != "" {
+		indexes = append(indexes, "owner:"+m.Owner)
+	}
+	for _, t := range m.Tags {
+		indexes = append(indexes, "tag:"+t)
+	}
+	// the host and its parent domains, as matched by listQuery.Domain
+	if host := hostOf(m.URL); host != "" {
+		labels := strings.Split(host, ".")
+		for i := range labels {
+			indexes = append(indexes, "domain:"+strings.Join(labels[i:], "."))
+		}
+	}
+	if m.Check.broken() {
+		indexes = append(indexes, "broken")
+	}
+	return indexes
+}
+
+// listIndex returns the index listing q, the other filters are checked on
+// the links it holds. Substrings are not indexed.
+func listIndex(q *listQuery) string {
+	switch {
+	case q.Owner != "":
+		return "owner:" + q.Owner
+	case len(q.Tags) > 0:
+		return "tag:" + q.Tags[0]
+	case q.Domain != "":
+		return "domain:" + strings.ToLower(q.Domain)
+	case q.Broken:
+		return "broken"
+	}
+	return ""
+}
+
+// indexCmds add m to the sorted sets of indexes.
+func (u *shortURLRedisRepository) indexCmds(m *shortURL, indexes []string) [][]interface{} {
+	cmds := make([][]interface{}, 0, 2*len(indexes))
+	for _, index := range indexes {
+		cmds = append(cmds,
+			[]interface{}{"ZADD", u.orderKey("created", index), createdScore(m.CreatedAt), member(m.ID)},
+			[]interface{}{"ZADD", u.orderKey("visits", index), m.VisitsCounter, member(m.ID)},
+		)
+	}
+	return cmds
+}
+
+// unindexCmds remove id from the sorted sets of indexes.
+func (u *shortURLRedisRepository) unindexCmds(id uint64, indexes []string) [][]interface{} {
+	cmds := make([][]interface{}, 0, 2*len(indexes))
+	for _, index := range indexes {
+		cmds = append(cmds,
+			[]interface{}{"ZREM", u.orderKey("created", index), member(id)},
+			[]interface{}{"ZREM", u.orderKey("visits", index), member(id)},
+		)
+	}
+	return cmds
+}
+
+// visitCmds add n visits to id in the visits sorted sets of indexes, the
+// first reply is its new visits count, null if it was deleted.
+func (u *shortURLRedisRepository) visitCmds(id uint64, n int64, indexes []string) [][]interface{} {
+	cmds := [][]interface{}{
+		{"ZADD", u.prefix + "visits", "XX", "INCR", n, member(id)},
+	}
+	for _, index := range indexes {
+		cmds = append(cmds, []interface{}{"ZADD", u.orderKey("visits", index), "XX", "INCR", n, member(id)})
+	}
+	return cmds
+}
+
+// parseVisits converts the reply of ZSCORE or ZADD INCR, a score sent as a
+// string.
+func parseVisits(reply interface{}) (uint64, error) {
+	score, err := resp.String(reply, nil)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(score, 64)
+	if err != nil || f < 0 {
+		return 0, err
+	}
+	return uint64(f), nil
+}
+
+// indexes returns the indexes stored with the link id.
+func (u *shortURLRedisRepository) indexes(c *resp.Conn, id uint64) ([]string, error) {
+	fields, err := resp.Strings(c.Do("HMGET", u.linkKey(id), "url", "indexes"))
+	if err != nil {
+		return nil, err
+	}
+	if fields[0] == "" {
+		return nil, errURLNotFound
+	}
+	return decodeIndexes(fields[1])
+}
+
+func decodeIndexes(s string) ([]string, error) {
+	var indexes []string
+	if s == "" {
+		return nil, nil
+	}
+	err := json.Unmarshal([]byte(s), &indexes)
+	return indexes, err
+}
+
+func (u *shortURLRedisRepository) get(id uint64) (*shortURL, error) {
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer u.pool.Put(c)
+	links, err := u.load(c, []uint64{id})
+	if err != nil {
+		return nil, err
+	}
+	if links[0] == nil {
+		return nil, errURLNotFound
+	}
+	return links[0], nil
+}
+
+// load reads the links ids in a single round trip, nil for those not found.
+func (u *shortURLRedisRepository) load(c *resp.Conn, ids []uint64) ([]*shortURL, error) {
+	cmds := make([][]interface{}, 0, 3*len(ids))
+	for _, id := range ids {
+		cmds = append(cmds,
+			[]interface{}{"HGETALL", u.linkKey(id)},
+			[]interface{}{"ZSCORE", u.prefix + "visits", member(id)},
+			[]interface{}{"ZRANGE", u.variantsKey(id), 0, -1, "WITHSCORES"},
+		)
+	}
+	replies, err := c.Pipeline(cmds)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range replies {
+		if e, ok := r.(resp.Error); ok {
+			return nil, e
+		}
+	}
+	links := make([]*shortURL, len(ids))
+	for i, id := range ids {
+		fields, err := resp.StringMap(replies[3*i], nil)
+		if err != nil {
+			return nil, err
+		}
+		m, err := decodeRedisLink(id, fields)
+		if err == errURLNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if replies[3*i+1] != nil {
+			if m.VisitsCounter, err = parseVisits(replies[3*i+1]); err != nil {
+				return nil, err
+			}
+		}
+		variants, err := resp.Strings(replies[3*i+2], nil)
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j+1 < len(variants); j += 2 {
+			for k := range m.Variants {
+				if m.Variants[k].URL == variants[j] {
+					m.Variants[k].Visits, _ = parseVisits(variants[j+1])
+				}
+			}
+		}
+		links[i] = m
+	}
+	return links, nil
+}
+
+// decodeRedisLink decodes the hash of a link, its visits are stored apart.
+func decodeRedisLink(id uint64, fields map[string]string) (*shortURL, error) {
+	if fields["url"] == "" {
+		return nil, errURLNotFound
+	}
+	m := &shortURL{
+		ID:           id,
+		URL:          fields["url"],
+		Preview:      fields["preview"] == "1",
+		Owner:        fields["owner"],
+		Title:        fields["title"],
+		PasswordHash: fields["password"],
+	}
+	m.MaxVisits, _ = strconv.ParseUint(fields["max_visits"], 10, 64)
+	created, _ := strconv.ParseInt(fields["created"], 10, 64)
+	m.CreatedAt = time.Unix(0, created).UTC()
+	if s := fields["tags"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &m.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if s := fields["metadata"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &m.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if s := fields["rules"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &m.Rules); err != nil {
+			return nil, err
+		}
+	}
+	if s := fields["variants"]; s != "" {
+		variants, err := unmarshalVariants(s)
+		if err != nil {
+			return nil, err
+		}
+		m.Variants = variants
+	}
+	m.Sticky = fields["sticky"] == "1"
+	m.Passthrough = fields["passthrough"] == "1"
+	m.Prefix = fields["prefix"] == "1"
+	if s := fields["check"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &m.Check); err != nil {
+			return nil, err
+		}
+	}
+	if s := fields["utm"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &m.UTM); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// linkFields are the HSET arguments for the user settable fields of m.
+func linkFields(m *shortURL) ([]interface{}, error) {
+	preview, sticky, passthrough, prefix := "0", "0", "0", "0"
+	if m.Preview {
+		preview = "1"
+	}
+	if m.Prefix {
+		prefix = "1"
+	}
+	if m.Sticky {
+		sticky = "1"
+	}
+	if m.Passthrough {
+		passthrough = "1"
+	}
+	var variants string
+	var tags, metadata, rules, utm []byte
+	var err error
+	if len(m.Tags) > 0 {
+		if tags, err = json.Marshal(m.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Metadata) > 0 {
+		if metadata, err = json.Marshal(m.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Rules) > 0 {
+		if rules, err = json.Marshal(m.Rules); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.Variants) > 0 {
+		if variants, err = marshalVariants(m.Variants); err != nil {
+			return nil, err
+		}
+	}
+	if m.UTM != nil {
+		if utm, err = json.Marshal(m.UTM); err != nil {
+			return nil, err
+		}
+	}
+	return []interface{}{
+		"preview", preview,
+		"title", m.Title,
+		"tags", tags,
+		"metadata", metadata,
+		"rules", rules,
+		"variants", variants,
+		"sticky", sticky,
+		"passthrough", passthrough,
+		"utm", utm,
+		"prefix", prefix,
+	}, nil
+}
+
+// variantCmds add the variants of m not counted yet to its variants sorted
+// set, and remove those of old it no longer has.
+func (u *shortURLRedisRepository) variantCmds(m *shortURL, old []linkVariant) [][]interface{} {
+	var cmds [][]interface{}
+	kept := map[string]bool{}
+	for _, v := range m.Variants {
+		kept[v.URL] = true
+		cmds = append(cmds, []interface{}{"ZADD", u.variantsKey(m.ID), "NX", 0, v.URL})
+	}
+	for _, v := range old {
+		if !kept[v.URL] {
+			cmds = append(cmds, []interface{}{"ZREM", u.variantsKey(m.ID), v.URL})
+		}
+	}
+	return cmds
+}
+
+func (u *shortURLRedisRepository) reserveIDs(n uint64) (uint64, error) {
+	last, err := resp.Int(u.pool.Do("INCRBY", u.prefix+"seq", n))
+	return uint64(last), err
+}
+
+func (u *shortURLRedisRepository) ByURL(ctx context.Context, owner, URL string) (*shortURL, error) {
+	id, err := resp.Int(u.pool.Do("GET", u.urlKey(owner, URL)))
+	if err == resp.ErrNil {
+		return nil, errURLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.get(uint64(id))
+}
+
+func (u *shortURLRedisRepository) ByID(ctx context.Context, id string) (*shortURL, error) {
+	key, err := base62.Decode(id)
+	if err != nil {
+		return nil, errMalformedURL
+	}
+	return u.get(key)
+}
+
+// Save stores item unless its owner already shortened its URL. The key of
+// the URL is watched, so concurrent saves of the same URL agree on a single
+// ID.
+func (u *shortURLRedisRepository) Save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	for attempt := 0; attempt < 8; attempt++ {
+		m, created, err := u.trySave(item)
+		if err != errStorageContention {
+			return m, created, err
+		}
+	}
+	return nil, false, errStorageContention
+}
+
+func (u *shortURLRedisRepository) trySave(item *shortURL) (*shortURL, bool, error) {
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, false, err
+	}
+	defer u.pool.Put(c)
+
+	urlKey := u.urlKey(item.Owner, item.URL)
+	if _, err := c.Do("WATCH", urlKey); err != nil {
+		return nil, false, err
+	}
+	// EXEC unwatches the key, any other return must not leave it watched on
+	// a pooled connection
+	executed := false
+	defer func() {
+		if !executed {
+			c.Do("UNWATCH")
+		}
+	}()
+	existing, err := resp.Int(c.Do("GET", urlKey))
+	if err == nil {
+		m, err := u.get(uint64(existing))
+		return m, false, err
+	}
+	if err != resp.ErrNil {
+		return nil, false, err
+	}
+
+	id, err := u.ids.nextID()
+	if err != nil {
+		return nil, false, err
+	}
+	mapping := &shortURL{
+		ID:  id,
+		URL: item.URL,
+		// scores hold µs, not ns
+		CreatedAt:    time.Now().UTC().Truncate(time.Microsecond),
+		Preview:      item.Preview,
+		Owner:        item.Owner,
+		Title:        item.Title,
+		Tags:         item.Tags,
+		Metadata:     item.Metadata,
+		PasswordHash: item.PasswordHash,
+		MaxVisits:    item.MaxVisits,
+		Rules:        item.Rules,
+		Variants:     item.Variants,
+		Sticky:       item.Sticky,
+		Passthrough:  item.Passthrough,
+		UTM:          item.UTM,
+		Prefix:       item.Prefix,
+	}
+	fields, err := linkFields(mapping)
+	if err != nil {
+		return nil, false, err
+	}
+	indexes := linkIndexes(mapping)
+	encodedIndexes, err := json.Marshal(indexes)
+	if err != nil {
+		return nil, false, err
+	}
+	hset := append([]interface{}{"HSET", u.linkKey(id),
+		"url", mapping.URL,
+		"created", mapping.CreatedAt.UnixNano(),
+		"owner", mapping.Owner,
+		"password", mapping.PasswordHash,
+		"max_visits", mapping.MaxVisits,
+		"indexes", encodedIndexes,
+	}, fields...)
+	cmds := [][]interface{}{
+		{"SET", urlKey, id},
+		hset,
+		{"ZADD", u.prefix + "created", createdScore(mapping.CreatedAt), member(id)},
+		{"ZADD", u.prefix + "visits", 0, member(id)},
+	}
+	cmds = append(cmds, u.variantCmds(mapping, nil)...)
+	executed = true
+	results, err := u.exec(c, append(cmds, u.indexCmds(mapping, indexes)...)...)
+	if err != nil {
+		return nil, false, err
+	}
+	if results == nil {
+		// someone else saved this URL meanwhile
+		return nil, false, errStorageContention
+	}
+	return mapping, true, nil
+}
+
+// exec runs cmds in a MULTI/EXEC transaction and returns their replies, nil
+// if the transaction was aborted because a watched key changed.
+func (u *shortURLRedisRepository) exec(c *resp.Conn, cmds ...[]interface{}) ([]interface{}, error) {
+	pipeline := append([][]interface{}{{"MULTI"}}, cmds...)
+	pipeline = append(pipeline, []interface{}{"EXEC"})
+	replies, err := c.Pipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range replies {
+		if e, ok := r.(resp.Error); ok {
+			return nil, e
+		}
+	}
+	results, _ := replies[len(replies)-1].([]interface{})
+	for _, r := range results {
+		if e, ok := r.(resp.Error); ok {
+			return nil, e
+		}
+	}
+	return results, nil
+}
+
+func (u *shortURLRedisRepository) transaction(cmds ...[]interface{}) ([]interface{}, error) {
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer u.pool.Put(c)
+	return u.exec(c, cmds...)
+}
+
+// reindexCmds move m from the indexes of old to its own ones and store
+// them with m.
+func (u *shortURLRedisRepository) reindexCmds(m *shortURL, old []string) ([][]interface{}, error) {
+	indexes := linkIndexes(m)
+	b, err := json.Marshal(indexes)
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, index := range indexes {
+		kept[index] = true
+	}
+	var removed, added []string
+	for _, index := range old {
+		if !kept[index] {
+			removed = append(removed, index)
+		}
+		delete(kept, index)
+	}
+	for _, index := range indexes {
+		if kept[index] {
+			added = append(added, index)
+		}
+	}
+	cmds := [][]interface{}{{"HSET", u.linkKey(m.ID), "indexes", b}}
+	cmds = append(cmds, u.unindexCmds(m.ID, removed)...)
+	return append(cmds, u.indexCmds(m, added)...), nil
+}
+
+func (u *shortURLRedisRepository) Update(ctx context.Context, item *shortURL) error {
+	stored, err := u.get(item.ID)
+	if err != nil {
+		return err
+	}
+	old, err := u.indexesOf(item.ID)
+	if err != nil {
+		return err
+	}
+	fields, err := linkFields(item)
+	if err != nil {
+		return err
+	}
+	// the indexes keep the stored creation time, visits and check
+	indexed := *item
+	indexed.CreatedAt, indexed.VisitsCounter, indexed.Check = stored.CreatedAt, stored.VisitsCounter, stored.Check
+	reindex, err := u.reindexCmds(&indexed, old)
+	if err != nil {
+		return err
+	}
+	cmds := [][]interface{}{append([]interface{}{"HSET", u.linkKey(item.ID)}, fields...)}
+	cmds = append(cmds, u.variantCmds(item, stored.Variants)...)
+	_, err = u.transaction(append(cmds, reindex...)...)
+	return err
+}
+
+func (u *shortURLRedisRepository) Delete(ctx context.Context, id uint64) error {
+	m, err := u.get(id)
+	if err != nil {
+		return err
+	}
+	indexes, err := u.indexesOf(id)
+	if err != nil {
+		return err
+	}
+	cmds := [][]interface{}{
+		{"DEL", u.linkKey(id), u.urlKey(m.Owner, m.URL), u.variantsKey(id)},
+		{"ZREM", u.prefix + "created", member(id)},
+		{"ZREM", u.prefix + "visits", member(id)},
+	}
+	_, err = u.transaction(append(cmds, u.unindexCmds(id, indexes)...)...)
+	return err
+}
+
+// indexesOf returns the indexes stored with the link id.
+func (u *shortURLRedisRepository) indexesOf(id uint64) ([]string, error) {
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer u.pool.Put(c)
+	return u.indexes(c, id)
+}
+
+func (u *shortURLRedisRepository) IncrementVisits(ctx context.Context, id uint64) error {
+	_, err := u.addVisits(id, 1)
+	return err
+}
+
+// addVisits adds n visits to id and returns its visits count.
+func (u *shortURLRedisRepository) addVisits(id uint64, n int64) (uint64, error) {
+	indexes, err := u.indexesOf(id)
+	if err != nil {
+		return 0, err
+	}
+	results, err := u.transaction(u.visitCmds(id, n, indexes)...)
+	if err != nil {
+		return 0, err
+	}
+	if results[0] == nil {
+		// deleted since its indexes were read
+		return 0, errURLNotFound
+	}
+	return parseVisits(results[0])
+}
+
+// SetCheck is not part of linkFields, so updates and checks don't overwrite
+// each other.
+func (u *shortURLRedisRepository) SetCheck(ctx context.Context, id uint64, check *linkCheck) error {
+	m, err := u.get(id)
+	if err != nil {
+		return err
+	}
+	old, err := u.indexesOf(id)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	// broken links are indexed
+	m.Check = check
+	reindex, err := u.reindexCmds(m, old)
+	if err != nil {
+		return err
+	}
+	cmds := [][]interface{}{{"HSET", u.linkKey(id), "check", b}}
+	_, err = u.transaction(append(cmds, reindex...)...)
+	return err
+}
+
+func (u *shortURLRedisRepository) IncrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	reply, err := u.pool.Do("ZADD", u.variantsKey(id), "XX", "INCR", 1, variant)
+	if err != nil || reply != nil {
+		return err
+	}
+	// a deleted link, or a variant removed meanwhile
+	n, err := resp.Int(u.pool.Do("EXISTS", u.linkKey(id)))
+	if err == nil && n == 0 {
+		err = errURLNotFound
+	}
+	return err
+}
+
+// IncrementVisitsUpTo counts the visit first and takes it back past max, so
+// a listing may briefly see max+1 visits.
+func (u *shortURLRedisRepository) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error) {
+	visits, err := u.addVisits(id, 1)
+	if err != nil || visits <= max {
+		return visits, err
+	}
+	visits, err = u.addVisits(id, -1)
+	if err == nil {
+		err = errLinkExhausted
+	}
+	return visits, err
+}
+
+func (u *shortURLRedisRepository) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	c, err := u.pool.Get()
+	if err != nil {
+		return err
+	}
+	defer u.pool.Put(c)
+
+	ids := make([]uint64, 0, len(visits))
+	lookups := make([][]interface{}, 0, len(visits))
+	for id := range visits {
+		ids = append(ids, id)
+		lookups = append(lookups, []interface{}{"HMGET", u.linkKey(id), "url", "indexes"})
+	}
+	replies, err := c.Pipeline(lookups)
+	if err != nil {
+		return err
+	}
+	var cmds [][]interface{}
+	for i, id := range ids {
+		fields, err := resp.Strings(replies[i], nil)
+		if err != nil {
+			return err
+		}
+		if fields[0] == "" {
+			continue
+		}
+		indexes, err := decodeIndexes(fields[1])
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, u.visitCmds(id, int64(visits[id]), indexes)...)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	// links deleted since their indexes were read are left out by XX
+	_, err = u.exec(c, cmds...)
+	return err
+}
+
+// List walks the sorted set of the requested order and of the index of a
+// filter, if any, in batches. The other filters are checked client side.
+// Batches start at the score of the last link seen, skipping the links of
+// that score already seen.
+func (u *shortURLRedisRepository) List(ctx context.Context, q *listQuery) (*listPage, error) {
+	cursor, err := decodeListCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	order, unit := "created", uint64(time.Microsecond)
+	if q.SortBy == sortByVisits {
+		order, unit = "visits", 1
+	}
+	key := u.orderKey(order, listIndex(q))
+	from, to := "-inf", "+inf"
+	if q.Desc {
+		from, to = to, from
+	}
+	if cursor != nil {
+		from = strconv.FormatUint(cursor.Key/unit, 10)
+	}
+
+	c, err := u.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer u.pool.Put(c)
+
+	page := &listPage{}
+	var last listCursor
+	batch := q.Limit*2 + 1
+	if batch < 50 {
+		batch = 50
+	}
+	for offset := 0; ; {
+		command := "ZRANGEBYSCORE"
+		if q.Desc {
+			command = "ZREVRANGEBYSCORE"
+		}
+		reply, err := resp.Strings(c.Do(command, key, from, to, "WITHSCORES", "LIMIT", offset, batch))
+		if err != nil {
+			return nil, err
+		}
+		n := len(reply) / 2
+		ids := make([]uint64, n)
+		positions := make([]listCursor, n)
+		for i := range positions {
+			positions[i].ID, _ = strconv.ParseUint(reply[2*i], 10, 64)
+			score, _ := strconv.ParseFloat(reply[2*i+1], 64)
+			positions[i].Key = uint64(score) * unit
+			ids[i] = positions[i].ID
+		}
+		links, err := u.load(c, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i, m := range links {
+			pos := positions[i]
+			if cursor != nil && !positionAfter(&pos, cursor, q.Desc) {
+				continue
+			}
+			if m == nil {
+				// deleted since the range was read
+				continue
+			}
+			if !q.matches(m) {
+				continue
+			}
+			if len(page.Items) == q.Limit {
+				page.NextCursor = encodeListCursor(&last)
+				return page, nil
+			}
+			page.Items = append(page.Items, m)
+			last = pos
+		}
+		if n < batch {
+			return page, nil
+		}
+		// the next batch starts at the last score, past the links seen
+		next := reply[2*n-1]
+		if next != from {
+			from, offset = next, 0
+		}
+		for i := n - 1; i >= 0 && reply[2*i+1] == next; i-- {
+			offset++
+		}
+	}
+}
+
+// positionAfter reports whether p comes after the cursor c in a listing.
+func positionAfter(p, c *listCursor, desc bool) bool {
+	if p.Key != c.Key {
+		return p.Key > c.Key != desc
+	}
+	return p.ID != c.ID && p.ID > c.ID != desc
+}
+
+func (u *shortURLRedisRepository) usageKey(owner string) string {
+	return u.prefix + "usage:" + owner
+}
+
+// AddUsage increments first and takes an increment past limit back, so a
+// concurrent increment may be refused while the counter is briefly over.
+func (u *shortURLRedisRepository) AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error) {
+	key := u.usageKey(owner)
+	value, err := resp.Int(u.pool.Do("HINCRBY", key, counter, n))
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case n > 0 && limit > 0 && uint64(value) > limit:
+		value, err = resp.Int(u.pool.Do("HINCRBY", key, counter, -n))
+		if value < 0 {
+			value = 0
+		}
+		return uint64(value), false, err
+	case value < 0:
+		// decrements of counters started after what they count
+		_, err = u.pool.Do("HINCRBY", key, counter, -value)
+		return 0, true, err
+	}
+	return uint64(value), true, nil
+}
+
+func (u *shortURLRedisRepository) Usage(ctx context.Context, owner string, counters ...string) (map[string]uint64, error) {
+	usage := make(map[string]uint64, len(counters))
+	if len(counters) == 0 {
+		return usage, nil
+	}
+	args := []interface{}{"HMGET", u.usageKey(owner)}
+	for _, c := range counters {
+		args = append(args, c)
+	}
+	reply, err := u.pool.Do(args...)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	for i, c := range counters {
+		var v interface{}
+		if i < len(values) {
+			v = values[i]
+		}
+		n, err := resp.Int(v, nil)
+		if err == resp.ErrNil {
+			n, err = 0, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			n = 0
+		}
+		usage[c] = uint64(n)
+	}
+	return usage, nil
+}
+
+// Close leaves the pool, shared by every tenant, open.
+func (u *shortURLRedisRepository) Close() error {
+	return nil
+}
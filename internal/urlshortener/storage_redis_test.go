@@ -0,0 +1,311 @@
+package urlshortener
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+	"github.com/friends-of-scalability/url-shortener/pkg/resp"
+	"github.com/friends-of-scalability/url-shortener/pkg/resp/resptest"
+)
+
+// newRedisTest returns a Redis storage leasing one ID at a time from a fake
+// server, a pool to that server and a function closing all of them.
+func newRedisTest(t *testing.T) (shortURLStorage, *resptest.Server, *resp.Pool, func()) {
+	t.Helper()
+	srv, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewRedisStorage(srv.Addr, "", 0, "", 1)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	pool := resp.NewPool(srv.Addr, resp.Options{})
+	return db, srv, pool, func() {
+		db.Close()
+		pool.Close()
+		srv.Close()
+	}
+}
+
+func TestRedisSave(t *testing.T) {
+	db, _, _, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	m, created, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "ann", Tags: []string{"x"}})
+	if err != nil || !created {
+		t.Fatalf("first save: created %v, %v", created, err)
+	}
+	again, created, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "ann"})
+	if err != nil || created {
+		t.Fatalf("second save: created %v, %v", created, err)
+	}
+	if again.ID != m.ID {
+		t.Errorf("saving a URL twice gave IDs %d and %d", m.ID, again.ID)
+	}
+	other, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == m.ID || other.Owner != "bob" {
+		t.Errorf("another owner saving the URL got %+v, want a link of its own", other)
+	}
+	got, err := db.ByID(ctx, base62.Encode(m.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != m.URL || got.Owner != "ann" || len(got.Tags) != 1 || !got.CreatedAt.Equal(m.CreatedAt) {
+		t.Errorf("ByID returned %+v, want %+v", got, m)
+	}
+	if _, err := db.ByURL(ctx, "ann", "https://example.com/b"); err != errURLNotFound {
+		t.Errorf("ByURL of an unknown URL: %v, want %v", err, errURLNotFound)
+	}
+}
+
+// A failed save must not leave its WATCH on the pooled connection, where it
+// would abort the next transaction.
+func TestRedisSaveUnwatchesOnError(t *testing.T) {
+	db, _, pool, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Do("SET", "seq", "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/b"}); err == nil {
+		t.Fatal("saving without IDs to lease succeeded")
+	}
+	if _, err := pool.Do("SET", "url:https://example.com/b", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ByURL(ctx, "", m.URL); err != errURLNotFound {
+		t.Errorf("ByURL after Delete: %v, want %v", err, errURLNotFound)
+	}
+}
+
+func TestRedisVisits(t *testing.T) {
+	db, _, _, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Variants: []linkVariant{{URL: "https://example.com/v", Weight: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.IncrementVisits(ctx, m.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddVisits(ctx, map[uint64]uint64{m.ID: 4, m.ID + 100: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.IncrementVariantVisits(ctx, m.ID, "https://example.com/v"); err != nil {
+		t.Fatal(err)
+	}
+	// an update carrying stale counters leaves them alone
+	if err := db.Update(ctx, &shortURL{ID: m.ID, URL: m.URL, Title: "a", Variants: m.Variants}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.ByURL(ctx, "", m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VisitsCounter != 7 || got.Title != "a" || got.Variants[0].Visits != 1 {
+		t.Errorf("got %d visits, %d variant visits and title %q, want 7, 1 and a", got.VisitsCounter, got.Variants[0].Visits, got.Title)
+	}
+}
+
+func TestRedisIncrementVisitsUpTo(t *testing.T) {
+	db, _, _, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", MaxVisits: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	counted, exhausted := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.IncrementVisitsUpTo(ctx, m.ID, m.MaxVisits)
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch err {
+			case nil:
+				counted++
+			case errLinkExhausted:
+				exhausted++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counted != 5 || exhausted != 15 {
+		t.Errorf("%d visits counted and %d refused, want 5 and 15", counted, exhausted)
+	}
+	got, err := db.ByURL(ctx, "", m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VisitsCounter != 5 {
+		t.Errorf("%d visits stored, want 5", got.VisitsCounter)
+	}
+}
+
+// Visits counted while a link is deleted must not recreate any of its keys.
+func TestRedisVisitsOfDeletedLink(t *testing.T) {
+	db, srv, _, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "ann", Tags: []string{"x"},
+		Variants: []linkVariant{{URL: "https://example.com/v", Weight: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				db.IncrementVisits(ctx, m.ID)
+				db.AddVisits(ctx, map[uint64]uint64{m.ID: 2})
+				db.IncrementVariantVisits(ctx, m.ID, "https://example.com/v")
+			}
+		}()
+	}
+	if err := db.Delete(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if keys := srv.Keys("*"); len(keys) != 2 || keys[0] != "schema" || keys[1] != "seq" {
+		t.Errorf("keys left after Delete: %v", keys)
+	}
+	if err := db.IncrementVisits(ctx, m.ID); err != errURLNotFound {
+		t.Errorf("IncrementVisits of a deleted link: %v, want %v", err, errURLNotFound)
+	}
+}
+
+func TestRedisList(t *testing.T) {
+	db, _, _, done := newRedisTest(t)
+	defer done()
+	ctx := context.Background()
+	var ids []uint64
+	for i := 0; i < 12; i++ {
+		owner := "ann"
+		if i%3 == 0 {
+			owner = "bob"
+		}
+		m, _, err := db.Save(ctx, &shortURL{URL: fmt.Sprintf("https://example.com/%d", i), Owner: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, m.ID)
+		if err := db.AddVisits(ctx, map[uint64]uint64{m.ID: uint64(i % 4)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		query listQuery
+		want  []int
+	}{
+		{listQuery{}, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{listQuery{Desc: true}, []int{11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{listQuery{Owner: "bob"}, []int{0, 3, 6, 9}},
+		{listQuery{Owner: "ann", SortBy: sortByVisits, Desc: true}, []int{11, 7, 10, 2, 5, 1, 8, 4}},
+		{listQuery{SortBy: sortByVisits}, []int{0, 4, 8, 1, 5, 9, 2, 6, 10, 3, 7, 11}},
+	} {
+		q := test.query
+		q.Limit = 5
+		var got []int
+		for pages := 0; pages < 10; pages++ {
+			page, err := db.List(ctx, &q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range page.Items {
+				for i, id := range ids {
+					if id == m.ID {
+						got = append(got, i)
+					}
+				}
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%+v: listed %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+// Links stored with the layout of version 0 are listed in creation order and
+// keep the visits of their variants once migrated.
+func TestRedisMigrate(t *testing.T) {
+	srv, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pool := resp.NewPool(srv.Addr, resp.Options{})
+	defer pool.Close()
+	for _, cmd := range [][]interface{}{
+		{"SET", "seq", 2},
+		{"HSET", "link:2", "url", "https://example.com/b", "created", 1000, "visits", 3, "tags", `["x"]`, "owner", "ann"},
+		{"HSET", "link:1", "url", "https://example.com/a", "created", 2000, "visits", 1,
+			"variants", `[{"url":"https://example.com/v","weight":1}]`, "variant:https://example.com/v", 4},
+		{"SET", "url:https://example.com/a", 1},
+		{"SET", "url:https://example.com/b", 2},
+		{"ZADD", "created", 1, member(1), 2, member(2)},
+		{"ZADD", "visits", 1, member(1), 3, member(2)},
+	} {
+		if _, err := pool.Do(cmd...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := NewRedisStorage(srv.Addr, "", 0, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	page, err := db.List(ctx, &listQuery{Tags: []string{"x"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != 2 || page.Items[0].VisitsCounter != 3 {
+		t.Errorf("listed %+v, want link 2 with 3 visits", page.Items)
+	}
+	page, err = db.List(ctx, &listQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[0].ID != 2 || page.Items[1].ID != 1 {
+		t.Fatalf("listed %+v, want links 2 then 1", page.Items)
+	}
+	if v := page.Items[1].Variants; len(v) != 1 || v[0].Visits != 4 {
+		t.Errorf("variants %+v, want 4 visits", v)
+	}
+	if m, err := db.ByURL(ctx, "ann", "https://example.com/b"); err != nil || m.ID != 2 {
+		t.Errorf("ByURL of the owner: %+v, %v, want link 2", m, err)
+	}
+	if _, err := db.ByURL(ctx, "", "https://example.com/b"); err != errURLNotFound {
+		t.Errorf("ByURL without owner: %v, want %v", err, errURLNotFound)
+	}
+}
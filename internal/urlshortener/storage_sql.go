@@ -0,0 +1,900 @@
+package urlshortener
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+)
+
+var errUnknownSQLDriver = errors.New("unsupported SQL driver, use postgres or sqlite3")
+
+// migrations are applied in order, each one exactly once, and recorded in
+// the schema_migrations table. Never edit a released migration, add a new
+// one instead. The statements are valid for both PostgreSQL and SQLite.
+var migrations = [][]string{
+	1: {
+		`CREATE TABLE links (
+			id         BIGINT PRIMARY KEY,
+			url        TEXT NOT NULL,
+			domain     TEXT NOT NULL DEFAULT '',
+			visits     BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			preview    BOOLEAN NOT NULL DEFAULT FALSE,
+			owner      TEXT NOT NULL DEFAULT '',
+			title      TEXT NOT NULL DEFAULT '',
+			metadata   TEXT NOT NULL DEFAULT '{}'
+		)`,
+		`CREATE UNIQUE INDEX links_url ON links (url)`,
+		`CREATE INDEX links_visits ON links (visits, id)`,
+		`CREATE INDEX links_owner ON links (owner, id)`,
+		`CREATE INDEX links_domain ON links (domain)`,
+		`CREATE TABLE link_tags (
+			link_id BIGINT NOT NULL REFERENCES links (id) ON DELETE CASCADE,
+			tag     TEXT NOT NULL,
+			PRIMARY KEY (link_id, tag)
+		)`,
+		`CREATE INDEX link_tags_tag ON link_tags (tag, link_id)`,
+		`CREATE TABLE sequences (
+			name  TEXT PRIMARY KEY,
+			value BIGINT NOT NULL
+		)`,
+		`INSERT INTO sequences (name, value) VALUES ('links', 0)`,
+	},
+	// links and tags belong to a tenant, the existing ones to the default
+	// tenant; IDs are unique within a tenant only
+	2: {
+		`CREATE TABLE tenant_links (
+			tenant     TEXT NOT NULL DEFAULT '',
+			id         BIGINT NOT NULL,
+			url        TEXT NOT NULL,
+			domain     TEXT NOT NULL DEFAULT '',
+			visits     BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			preview    BOOLEAN NOT NULL DEFAULT FALSE,
+			owner      TEXT NOT NULL DEFAULT '',
+			title      TEXT NOT NULL DEFAULT '',
+			metadata   TEXT NOT NULL DEFAULT '{}',
+			PRIMARY KEY (tenant, id)
+		)`,
+		`INSERT INTO tenant_links (id, url, domain, visits, created_at, preview, owner, title, metadata)
+			SELECT id, url, domain, visits, created_at, preview, owner, title, metadata FROM links`,
+		`CREATE TABLE tenant_link_tags (
+			tenant  TEXT NOT NULL DEFAULT '',
+			link_id BIGINT NOT NULL,
+			tag     TEXT NOT NULL,
+			PRIMARY KEY (tenant, link_id, tag)
+		)`,
+		`INSERT INTO tenant_link_tags (link_id, tag) SELECT link_id, tag FROM link_tags`,
+		`DROP TABLE link_tags`,
+		`DROP TABLE links`,
+		`ALTER TABLE tenant_links RENAME TO links`,
+		`ALTER TABLE tenant_link_tags RENAME TO link_tags`,
+		`CREATE UNIQUE INDEX links_url ON links (tenant, url)`,
+		`CREATE INDEX links_visits ON links (tenant, visits, id)`,
+		`CREATE INDEX links_owner ON links (tenant, owner, id)`,
+		`CREATE INDEX links_domain ON links (tenant, domain)`,
+		`CREATE INDEX link_tags_tag ON link_tags (tenant, tag, link_id)`,
+	},
+	3: {
+		`CREATE TABLE usage_counters (
+			tenant  TEXT NOT NULL,
+			owner   TEXT NOT NULL,
+			counter TEXT NOT NULL,
+			value   BIGINT NOT NULL,
+			PRIMARY KEY (tenant, owner, counter)
+		)`,
+	},
+	4: {
+		`ALTER TABLE links ADD COLUMN password TEXT NOT NULL DEFAULT ''`,
+	},
+	5: {
+		`ALTER TABLE links ADD COLUMN max_visits BIGINT NOT NULL DEFAULT 0`,
+	},
+	6: {
+		`ALTER TABLE links ADD COLUMN rules TEXT NOT NULL DEFAULT '[]'`,
+	},
+	7: {
+		`ALTER TABLE links ADD COLUMN variants TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE links ADD COLUMN sticky BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE link_variants (
+			tenant  TEXT NOT NULL,
+			link_id BIGINT NOT NULL,
+			url     TEXT NOT NULL,
+			visits  BIGINT NOT NULL,
+			PRIMARY KEY (tenant, link_id, url)
+		)`,
+	},
+	8: {
+		`ALTER TABLE links ADD COLUMN passthrough BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE links ADD COLUMN utm TEXT NOT NULL DEFAULT '{}'`,
+	},
+	9: {
+		`ALTER TABLE links ADD COLUMN prefix BOOLEAN NOT NULL DEFAULT FALSE`,
+	},
+	// checked_at is in nanoseconds since the epoch, 0 for links never checked
+	10: {
+		`ALTER TABLE links ADD COLUMN check_status INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE links ADD COLUMN check_error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE links ADD COLUMN check_failures INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE links ADD COLUMN checked_at BIGINT NOT NULL DEFAULT 0`,
+		`CREATE INDEX links_broken ON links (tenant, check_failures)`,
+	},
+	// listings are sorted by creation time, IDs leased by replicas don't
+	// tell it
+	11: {
+		`DROP INDEX links_owner`,
+		`CREATE INDEX links_owner ON links (tenant, owner, created_at, id)`,
+		`CREATE INDEX links_created ON links (tenant, created_at, id)`,
+	},
+	// the owners of a tenant don't share links
+	12: {
+		`DROP INDEX links_url`,
+		`CREATE UNIQUE INDEX links_url ON links (tenant, owner, url)`,
+	},
+}
+
+// shortURLSQLRepository stores the shortURLs of a tenant with database/sql.
+type shortURLSQLRepository struct {
+	db     *sql.DB
+	driver string
+	tenant string
+	// sequence is the row of sequences the IDs of tenant are leased from
+	sequence string
+	ids      *idAllocator
+}
+
+// NewSQLStorage opens a PostgreSQL ("postgres") or SQLite ("sqlite3")
+// database and migrates its schema. The driver itself must be linked in the
+// binary. IDs are leased idBlock at a time, from a sequence per tenant.
+func NewSQLStorage(driver, dsn string, idBlock uint64) (shortURLStorage, error) {
+	if driver != "postgres" && driver != "sqlite3" {
+		return nil, errUnknownSQLDriver
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer, serialize in the pool instead of
+		// failing with "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+	root := &shortURLSQLRepository{db: db, driver: driver}
+	if err := root.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newTenantStorage(func(tenant string) (shortURLStorage, error) {
+		u := &shortURLSQLRepository{db: db, driver: driver, tenant: tenant, sequence: "links"}
+		if tenant != "" {
+			u.sequence += ":" + tenant
+			if err := u.createSequence(); err != nil {
+				return nil, err
+			}
+		}
+		u.ids = newIDAllocator(idBlock, u.reserveIDs)
+		return u, nil
+	}, db.Close), nil
+}
+
+// createSequence adds the sequence of a new tenant. Replicas may race to
+// add it, the loser fails on the primary key and finds it there.
+func (u *shortURLSQLRepository) createSequence() error {
+	exists := func() (bool, error) {
+		var n int
+		err := u.db.QueryRow(u.rebind(`SELECT COUNT(*) FROM sequences WHERE name = ?`), u.sequence).Scan(&n)
+		return n > 0, err
+	}
+	if ok, err := exists(); err != nil || ok {
+		return err
+	}
+	_, err := u.db.Exec(u.rebind(`INSERT INTO sequences (name, value) VALUES (?, 0)`), u.sequence)
+	if err != nil {
+		if ok, existsErr := exists(); existsErr == nil && ok {
+			return nil
+		}
+	}
+	return err
+}
+
+// rebind turns the ? placeholders of query into $n for PostgreSQL.
+func (u *shortURLSQLRepository) rebind(query string) string {
+	if u.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (u *shortURLSQLRepository) migrate() error {
+	if _, err := u.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT PRIMARY KEY)`); err != nil {
+		return err
+	}
+	for version := 1; version < len(migrations); version++ {
+		if err := u.applyMigration(version); err != nil {
+			return fmt.Errorf("migration %d: %v", version, err)
+		}
+	}
+	return nil
+}
+
+func (u *shortURLSQLRepository) applyMigration(version int) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if u.driver == "postgres" {
+		// replicas starting together must not run the same migration
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(4242)`); err != nil {
+			return err
+		}
+	}
+	var applied int
+	err = tx.QueryRow(u.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`), version).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+	for _, stmt := range migrations[version] {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(u.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const linkColumns = `id, url, visits, created_at, preview, owner, title, metadata, password, max_visits, rules, variants, sticky, passthrough, utm, prefix,
+	check_status, check_error, check_failures, checked_at`
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLink(row scanner) (*shortURL, error) {
+	var (
+		m         shortURL
+		id        int64
+		visits    int64
+		maxVisits int64
+		metadata  string
+		rules     string
+		variants  string
+		utm       string
+		check     linkCheck
+		checkedAt int64
+	)
+	err := row.Scan(&id, &m.URL, &visits, &m.CreatedAt, &m.Preview, &m.Owner, &m.Title, &metadata, &m.PasswordHash, &maxVisits, &rules, &variants, &m.Sticky, &m.Passthrough, &utm, &m.Prefix,
+		&check.Status, &check.Error, &check.Failures, &checkedAt)
+	if err != nil {
+		return nil, err
+	}
+	m.ID, m.VisitsCounter, m.MaxVisits = uint64(id), uint64(visits), uint64(maxVisits)
+	m.CreatedAt = m.CreatedAt.UTC()
+	if err := json.Unmarshal([]byte(metadata), &m.Metadata); err != nil {
+		return nil, err
+	}
+	if len(m.Metadata) == 0 {
+		m.Metadata = nil
+	}
+	if err := json.Unmarshal([]byte(rules), &m.Rules); err != nil {
+		return nil, err
+	}
+	if len(m.Rules) == 0 {
+		m.Rules = nil
+	}
+	if m.Variants, err = unmarshalVariants(variants); err != nil {
+		return nil, err
+	}
+	if m.UTM, err = unmarshalUTM(utm); err != nil {
+		return nil, err
+	}
+	if checkedAt != 0 {
+		check.CheckedAt = time.Unix(0, checkedAt).UTC()
+		m.Check = &check
+	}
+	return &m, nil
+}
+
+// loadTags fills in the tags of links with a single query.
+func (u *shortURLSQLRepository) loadTags(ctx context.Context, q queryer, links ...*shortURL) error {
+	if len(links) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*shortURL, len(links))
+	args := make([]interface{}, 0, len(links))
+	for _, m := range links {
+		byID[int64(m.ID)] = m
+		args = append(args, int64(m.ID))
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(links)), ", ")
+	args = append([]interface{}{u.tenant}, args...)
+	rows, err := q.QueryContext(ctx, u.rebind(`SELECT link_id, tag FROM link_tags WHERE tenant = ? AND link_id IN (`+placeholders+`) ORDER BY link_id, tag`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id  int64
+			tag string
+		)
+		if err := rows.Scan(&id, &tag); err != nil {
+			return err
+		}
+		byID[id].Tags = append(byID[id].Tags, tag)
+	}
+	return rows.Err()
+}
+
+// loadVariantVisits fills in the visits of the variants of split links with
+// a single query.
+func (u *shortURLSQLRepository) loadVariantVisits(ctx context.Context, q queryer, links ...*shortURL) error {
+	byID := map[int64]*shortURL{}
+	args := []interface{}{u.tenant}
+	for _, m := range links {
+		if len(m.Variants) > 0 {
+			byID[int64(m.ID)] = m
+			args = append(args, int64(m.ID))
+		}
+	}
+	if len(byID) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(byID)), ", ")
+	rows, err := q.QueryContext(ctx, u.rebind(`SELECT link_id, url, visits FROM link_variants WHERE tenant = ? AND link_id IN (`+placeholders+`)`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, visits int64
+			url        string
+		)
+		if err := rows.Scan(&id, &url, &visits); err != nil {
+			return err
+		}
+		for i, v := range byID[id].Variants {
+			if v.URL == url {
+				byID[id].Variants[i].Visits = uint64(visits)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func (u *shortURLSQLRepository) get(ctx context.Context, q queryer, where string, args ...interface{}) (*shortURL, error) {
+	m, err := scanLink(q.QueryRowContext(ctx, u.rebind(`SELECT `+linkColumns+` FROM links WHERE tenant = ? AND `+where), append([]interface{}{u.tenant}, args...)...))
+	if err == sql.ErrNoRows {
+		return nil, errURLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := u.loadTags(ctx, q, m); err != nil {
+		return nil, err
+	}
+	return m, u.loadVariantVisits(ctx, q, m)
+}
+
+func (u *shortURLSQLRepository) ByURL(ctx context.Context, owner, URL string) (*shortURL, error) {
+	return u.get(ctx, u.db, `owner = ? AND url = ?`, owner, URL)
+}
+
+func (u *shortURLSQLRepository) ByID(ctx context.Context, id string) (*shortURL, error) {
+	key, err := base62.Decode(id)
+	if err != nil {
+		return nil, errMalformedURL
+	}
+	return u.get(ctx, u.db, `id = ?`, int64(key))
+}
+
+// reserveIDs advances the sequence of the tenant by n and returns its new
+// value.
+func (u *shortURLSQLRepository) reserveIDs(n uint64) (uint64, error) {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// the update locks the row until commit, so the select sees our value
+	if _, err := tx.Exec(u.rebind(`UPDATE sequences SET value = value + ? WHERE name = ?`), int64(n), u.sequence); err != nil {
+		return 0, err
+	}
+	var last int64
+	if err := tx.QueryRow(u.rebind(`SELECT value FROM sequences WHERE name = ?`), u.sequence).Scan(&last); err != nil {
+		return 0, err
+	}
+	return uint64(last), tx.Commit()
+}
+
+// Save stores item in a transaction. Concurrent saves of the same URL race
+// on the unique index of links (tenant, owner, url), the loser returns the winner's
+// shortURL.
+func (u *shortURLSQLRepository) Save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	m, created, err := u.save(ctx, item)
+	if err != nil {
+		if existing, lookupErr := u.ByURL(ctx, item.Owner, item.URL); lookupErr == nil {
+			return existing, false, nil
+		}
+	}
+	return m, created, err
+}
+
+func (u *shortURLSQLRepository) save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	if m, err := u.ByURL(ctx, item.Owner, item.URL); err != errURLNotFound {
+		return m, false, err
+	}
+	// before Begin, a lease may need a connection of its own
+	id, err := u.ids.nextID()
+	if err != nil {
+		return nil, false, err
+	}
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	mapping := &shortURL{
+		ID:           id,
+		URL:          item.URL,
+		CreatedAt:    time.Now().UTC(),
+		Preview:      item.Preview,
+		Owner:        item.Owner,
+		Title:        item.Title,
+		Tags:         item.Tags,
+		Metadata:     item.Metadata,
+		PasswordHash: item.PasswordHash,
+		MaxVisits:    item.MaxVisits,
+		Rules:        item.Rules,
+		Variants:     item.Variants,
+		Sticky:       item.Sticky,
+		Passthrough:  item.Passthrough,
+		UTM:          item.UTM,
+		Prefix:       item.Prefix,
+	}
+	metadata, err := marshalMetadata(mapping.Metadata)
+	if err != nil {
+		return nil, false, err
+	}
+	rules, err := marshalRules(mapping.Rules)
+	if err != nil {
+		return nil, false, err
+	}
+	variants, err := marshalVariants(mapping.Variants)
+	if err != nil {
+		return nil, false, err
+	}
+	utm, err := marshalUTM(mapping.UTM)
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = tx.ExecContext(ctx, u.rebind(`INSERT INTO links (tenant, id, url, domain, visits, created_at, preview, owner, title, metadata, password, max_visits, rules, variants, sticky, passthrough, utm, prefix)
+		VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		u.tenant, int64(id), mapping.URL, hostOf(mapping.URL), mapping.CreatedAt, mapping.Preview, mapping.Owner, mapping.Title, metadata, mapping.PasswordHash, int64(mapping.MaxVisits), rules, variants, mapping.Sticky, mapping.Passthrough, utm, mapping.Prefix)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := u.insertTags(ctx, tx, mapping); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return mapping, true, nil
+}
+
+func (u *shortURLSQLRepository) insertTags(ctx context.Context, tx *sql.Tx, m *shortURL) error {
+	for _, tag := range m.Tags {
+		if _, err := tx.ExecContext(ctx, u.rebind(`INSERT INTO link_tags (tenant, link_id, tag) VALUES (?, ?, ?)`), u.tenant, int64(m.ID), tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *shortURLSQLRepository) Update(ctx context.Context, item *shortURL) error {
+	metadata, err := marshalMetadata(item.Metadata)
+	if err != nil {
+		return err
+	}
+	rules, err := marshalRules(item.Rules)
+	if err != nil {
+		return err
+	}
+	variants, err := marshalVariants(item.Variants)
+	if err != nil {
+		return err
+	}
+	utm, err := marshalUTM(item.UTM)
+	if err != nil {
+		return err
+	}
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, u.rebind(`UPDATE links SET preview = ?, title = ?, metadata = ?, rules = ?, variants = ?, sticky = ?, passthrough = ?, utm = ?, prefix = ? WHERE tenant = ? AND id = ?`),
+		item.Preview, item.Title, metadata, rules, variants, item.Sticky, item.Passthrough, utm, item.Prefix, u.tenant, int64(item.ID))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errURLNotFound
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, u.rebind(`DELETE FROM link_tags WHERE tenant = ? AND link_id = ?`), u.tenant, int64(item.ID)); err != nil {
+		return err
+	}
+	if err := u.insertTags(ctx, tx, item); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *shortURLSQLRepository) Delete(ctx context.Context, id uint64) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// SQLite only cascades with foreign keys enabled, do not rely on it
+	if _, err := tx.ExecContext(ctx, u.rebind(`DELETE FROM link_tags WHERE tenant = ? AND link_id = ?`), u.tenant, int64(id)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, u.rebind(`DELETE FROM link_variants WHERE tenant = ? AND link_id = ?`), u.tenant, int64(id)); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, u.rebind(`DELETE FROM links WHERE tenant = ? AND id = ?`), u.tenant, int64(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = errURLNotFound
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *shortURLSQLRepository) IncrementVisits(ctx context.Context, id uint64) error {
+	res, err := u.db.ExecContext(ctx, u.rebind(`UPDATE links SET visits = visits + 1 WHERE tenant = ? AND id = ?`), u.tenant, int64(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errURLNotFound
+	}
+	return nil
+}
+
+// IncrementVisitsUpTo relies on the row lock of the conditional update, so
+// concurrent visits can't count past max.
+func (u *shortURLSQLRepository) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, u.rebind(`UPDATE links SET visits = visits + 1 WHERE tenant = ? AND id = ? AND visits < ?`),
+		u.tenant, int64(id), int64(max))
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	var visits int64
+	err = tx.QueryRowContext(ctx, u.rebind(`SELECT visits FROM links WHERE tenant = ? AND id = ?`), u.tenant, int64(id)).Scan(&visits)
+	if err == sql.ErrNoRows {
+		return 0, errURLNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return uint64(visits), errLinkExhausted
+	}
+	return uint64(visits), tx.Commit()
+}
+
+func (u *shortURLSQLRepository) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, u.rebind(`UPDATE links SET visits = visits + ? WHERE tenant = ? AND id = ?`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, n := range visits {
+		if _, err := stmt.ExecContext(ctx, int64(n), u.tenant, int64(id)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (u *shortURLSQLRepository) List(ctx context.Context, q *listQuery) (*listPage, error) {
+	cursor, err := decodeListCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	where := []string{`tenant = ?`}
+	args := []interface{}{u.tenant}
+	if q.Owner != "" {
+		where = append(where, `owner = ?`)
+		args = append(args, q.Owner)
+	}
+	if q.Domain != "" {
+		domain := strings.ToLower(q.Domain)
+		where = append(where, `(domain = ? OR domain LIKE ? ESCAPE '\')`)
+		args = append(args, domain, "%."+escapeLike(domain))
+	}
+	if q.Broken {
+		where = append(where, `check_failures > 0`)
+	}
+	if q.Contains != "" {
+		pattern := "%" + escapeLike(strings.ToLower(q.Contains)) + "%"
+		where = append(where, `(LOWER(url) LIKE ? ESCAPE '\' OR LOWER(title) LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern)
+	}
+	for _, tag := range q.Tags {
+		where = append(where, `EXISTS (SELECT 1 FROM link_tags t WHERE t.tenant = links.tenant AND t.link_id = links.id AND t.tag = ?)`)
+		args = append(args, tag)
+	}
+
+	cmp, dir := ">", "ASC"
+	if q.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	column := `created_at`
+	var key interface{}
+	if cursor != nil {
+		key = time.Unix(0, int64(cursor.Key)).UTC()
+	}
+	if q.SortBy == sortByVisits {
+		column = `visits`
+		if cursor != nil {
+			key = int64(cursor.Key)
+		}
+	}
+	order := column + ` ` + dir + `, id ` + dir
+	if cursor != nil {
+		where = append(where, `(`+column+` `+cmp+` ? OR (`+column+` = ? AND id `+cmp+` ?))`)
+		args = append(args, key, key, int64(cursor.ID))
+	}
+
+	query := `SELECT ` + linkColumns + ` FROM links WHERE ` + strings.Join(where, ` AND `)
+	// one more than asked for tells whether there is a next page
+	query += ` ORDER BY ` + order + ` LIMIT ` + strconv.Itoa(q.Limit+1)
+
+	rows, err := u.db.QueryContext(ctx, u.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []*shortURL
+	for rows.Next() {
+		m, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := u.loadTags(ctx, u.db, links...); err != nil {
+		return nil, err
+	}
+	if err := u.loadVariantVisits(ctx, u.db, links...); err != nil {
+		return nil, err
+	}
+	page := &listPage{}
+	for _, m := range links {
+		if page.add(m, q) {
+			break
+		}
+	}
+	return page, nil
+}
+
+func (u *shortURLSQLRepository) SetCheck(ctx context.Context, id uint64, check *linkCheck) error {
+	res, err := u.db.ExecContext(ctx, u.rebind(`UPDATE links SET check_status = ?, check_error = ?, check_failures = ?, checked_at = ? WHERE tenant = ? AND id = ?`),
+		check.Status, check.Error, check.Failures, check.CheckedAt.UnixNano(), u.tenant, int64(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errURLNotFound
+	}
+	return nil
+}
+
+func (u *shortURLSQLRepository) IncrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	err := u.incrementVariantVisits(ctx, id, variant)
+	if err != nil && err != errURLNotFound {
+		// a concurrent first visit inserted the row, try again
+		return u.incrementVariantVisits(ctx, id, variant)
+	}
+	return err
+}
+
+func (u *shortURLSQLRepository) incrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	res, err := u.db.ExecContext(ctx, u.rebind(`UPDATE link_variants SET visits = visits + 1 WHERE tenant = ? AND link_id = ? AND url = ?`),
+		u.tenant, int64(id), variant)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	// the first visit of the variant, if the link still exists
+	res, err = u.db.ExecContext(ctx, u.rebind(`INSERT INTO link_variants (tenant, link_id, url, visits)
+		SELECT tenant, id, ?, 1 FROM links WHERE tenant = ? AND id = ?`), variant, u.tenant, int64(id))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errURLNotFound
+	}
+	return nil
+}
+
+func (u *shortURLSQLRepository) AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error) {
+	value, ok, err := u.addUsage(ctx, owner, counter, n, limit)
+	if err != nil {
+		// a concurrent first increment inserted the row, try again
+		return u.addUsage(ctx, owner, counter, n, limit)
+	}
+	return value, ok, err
+}
+
+func (u *shortURLSQLRepository) addUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error) {
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	query := `SELECT value FROM usage_counters WHERE tenant = ? AND owner = ? AND counter = ?`
+	if u.driver == "postgres" {
+		// SQLite has a single writer, PostgreSQL needs the row locked
+		query += ` FOR UPDATE`
+	}
+	var current int64
+	err = tx.QueryRowContext(ctx, u.rebind(query), u.tenant, owner, counter).Scan(&current)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+	value, ok := addUsage(uint64(current), n, limit)
+	if !ok {
+		return value, false, nil
+	}
+	if exists {
+		_, err = tx.ExecContext(ctx, u.rebind(`UPDATE usage_counters SET value = ? WHERE tenant = ? AND owner = ? AND counter = ?`),
+			int64(value), u.tenant, owner, counter)
+	} else {
+		_, err = tx.ExecContext(ctx, u.rebind(`INSERT INTO usage_counters (tenant, owner, counter, value) VALUES (?, ?, ?, ?)`),
+			u.tenant, owner, counter, int64(value))
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, tx.Commit()
+}
+
+func (u *shortURLSQLRepository) Usage(ctx context.Context, owner string, counters ...string) (map[string]uint64, error) {
+	usage := make(map[string]uint64, len(counters))
+	if len(counters) == 0 {
+		return usage, nil
+	}
+	args := []interface{}{u.tenant, owner}
+	for _, c := range counters {
+		usage[c] = 0
+		args = append(args, c)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(counters)), ", ")
+	rows, err := u.db.QueryContext(ctx, u.rebind(`SELECT counter, value FROM usage_counters
+		WHERE tenant = ? AND owner = ? AND counter IN (`+placeholders+`)`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			counter string
+			value   int64
+		)
+		if err := rows.Scan(&counter, &value); err != nil {
+			return nil, err
+		}
+		usage[counter] = uint64(value)
+	}
+	return usage, rows.Err()
+}
+
+// Close leaves the database, shared by every tenant, open.
+func (u *shortURLSQLRepository) Close() error {
+	return nil
+}
+
+func marshalMetadata(metadata map[string]string) (string, error) {
+	if len(metadata) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(metadata)
+	return string(b), err
+}
+
+func marshalRules(rules []redirectRule) (string, error) {
+	if len(rules) == 0 {
+		return "[]", nil
+	}
+	b, err := json.Marshal(rules)
+	return string(b), err
+}
+
+func marshalUTM(utm *utmParams) (string, error) {
+	if utm == nil {
+		return "{}", nil
+	}
+	b, err := json.Marshal(utm)
+	return string(b), err
+}
+
+func unmarshalUTM(s string) (*utmParams, error) {
+	var utm utmParams
+	if err := json.Unmarshal([]byte(s), &utm); err != nil {
+		return nil, err
+	}
+	return normalizeUTM(&utm)
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
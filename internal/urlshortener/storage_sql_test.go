@@ -0,0 +1,165 @@
+//go:build sqlite
+// +build sqlite
+
+package urlshortener
+
+// SQLite needs cgo, run with CGO_ENABLED=1 go test -tags sqlite.
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newSQLTest returns the path of a new SQLite database and a function
+// removing it.
+func newSQLTest(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "url-shortener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "links.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestSQLSave(t *testing.T) {
+	path, done := newSQLTest(t)
+	defer done()
+	db, err := NewSQLStorage("sqlite3", path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	m, created, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "ann", Tags: []string{"x"}})
+	if err != nil || !created {
+		t.Fatalf("first save: created %v, %v", created, err)
+	}
+	again, created, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "ann"})
+	if err != nil || created {
+		t.Fatalf("second save: created %v, %v", created, err)
+	}
+	if again.ID != m.ID || len(again.Tags) != 1 {
+		t.Errorf("saving a URL twice gave %+v, want %+v", again, m)
+	}
+	other, created, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Owner: "bob"})
+	if err != nil || !created {
+		t.Fatalf("save of another owner: created %v, %v", created, err)
+	}
+	if other.ID == m.ID || other.Owner != "bob" {
+		t.Errorf("another owner saving the URL got %+v, want a link of its own", other)
+	}
+	// tenants have sequences and links of their own
+	t2 := withTenant(ctx, "t2")
+	if _, err := db.ByURL(t2, "ann", m.URL); err != errURLNotFound {
+		t.Errorf("link of another tenant: %v, want %v", err, errURLNotFound)
+	}
+	m2, created, err := db.Save(t2, &shortURL{URL: "https://example.com/a", Owner: "ann"})
+	if err != nil || !created {
+		t.Fatalf("save in another tenant: created %v, %v", created, err)
+	}
+	if m2.ID != 1 {
+		t.Errorf("first link of another tenant has ID %d, want 1", m2.ID)
+	}
+}
+
+func TestSQLIncrementVisitsUpTo(t *testing.T) {
+	path, done := newSQLTest(t)
+	defer done()
+	db, err := NewSQLStorage("sqlite3", path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", MaxVisits: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	counted, exhausted := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.IncrementVisitsUpTo(ctx, m.ID, m.MaxVisits)
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch err {
+			case nil:
+				counted++
+			case errLinkExhausted:
+				exhausted++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counted != 5 || exhausted != 15 {
+		t.Errorf("%d visits counted and %d refused, want 5 and 15", counted, exhausted)
+	}
+	// at the limit, the visits are still reported
+	if visits, err := db.IncrementVisitsUpTo(ctx, m.ID, m.MaxVisits); visits != 5 || err != errLinkExhausted {
+		t.Errorf("visit past the limit: %d, %v, want 5, %v", visits, err, errLinkExhausted)
+	}
+	if _, err := db.IncrementVisitsUpTo(ctx, m.ID+1, 5); err != errURLNotFound {
+		t.Errorf("visit of an unknown link: %v, want %v", err, errURLNotFound)
+	}
+}
+
+// Opening a migrated database applies nothing again and keeps its links.
+func TestSQLMigrate(t *testing.T) {
+	path, done := newSQLTest(t)
+	defer done()
+	ctx := context.Background()
+	db, err := NewSQLStorage("sqlite3", path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/a", Tags: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewSQLStorage("sqlite3", path, 1)
+	if err != nil {
+		t.Fatalf("migrating again: %v", err)
+	}
+	defer db.Close()
+	got, err := db.ByURL(ctx, "", m.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != m.ID || len(got.Tags) != 1 || got.Tags[0] != "x" {
+		t.Errorf("link after migrating again: %+v, want %+v", got, m)
+	}
+	// the sequence goes on where it was
+	next, _, err := db.Save(ctx, &shortURL{URL: "https://example.com/b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID != m.ID+1 {
+		t.Errorf("next link has ID %d, want %d", next.ID, m.ID+1)
+	}
+
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	var applied int
+	if err := raw.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations)-1 {
+		t.Errorf("%d migrations recorded, want %d", applied, len(migrations)-1)
+	}
+}
@@ -0,0 +1,394 @@
+package urlshortener
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+var errUnauthorized = errors.New("A valid API key is required")
+
+var (
+	contextKeyTenant = contextKey("URLShortenerTenant")
+	contextKeyAPIKey = contextKey("URLShortenerAPIKey")
+	contextKeyOwner  = contextKey("URLShortenerOwner")
+)
+
+// Tenant is a brand with its own domains and short-code space. Hosts not
+// matching the domains of any tenant belong to the default tenant, whose ID
+// is empty.
+type Tenant struct {
+	ID      string   `json:"id"`
+	Domains []string `json:"domains"`
+	// APIKeys, if any, are required to create, list and change links
+	APIKeys []APIKey `json:"apiKeys,omitempty"`
+	// Quota applies to the owners of keys without a quota of their own
+	Quota Quota `json:"quota"`
+}
+
+// APIKey authenticates the clients of a tenant, links created with it
+// belong to Owner.
+type APIKey struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Quota *Quota `json:"quota,omitempty"`
+
+	// hash is that of Key, compared with the hash of the key of a request
+	hash [sha256.Size]byte
+}
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenants resolves the tenant of a request from its Host header. A nil
+// *Tenants only knows the default tenant.
+type Tenants struct {
+	byID     map[string]*Tenant
+	byDomain map[string]*Tenant
+}
+
+// LoadTenants reads a JSON array of tenants from the file at path.
+func LoadTenants(path string) (*Tenants, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tenants []*Tenant
+	if err := json.NewDecoder(f).Decode(&tenants); err != nil {
+		return nil, err
+	}
+	return NewTenants(tenants...)
+}
+
+// NewTenants checks that IDs, domains and API keys are not shared.
+func NewTenants(tenants ...*Tenant) (*Tenants, error) {
+	t := &Tenants{byID: map[string]*Tenant{}, byDomain: map[string]*Tenant{}}
+	for _, tenant := range tenants {
+		if tenant.ID != "" && !tenantIDPattern.MatchString(tenant.ID) {
+			return nil, fmt.Errorf("tenant %q: IDs are lowercase letters, digits and dashes", tenant.ID)
+		}
+		if _, ok := t.byID[tenant.ID]; ok {
+			return nil, fmt.Errorf("tenant %q: defined twice", tenant.ID)
+		}
+		t.byID[tenant.ID] = tenant
+		for _, d := range tenant.Domains {
+			d = strings.ToLower(d)
+			if other, ok := t.byDomain[d]; ok {
+				return nil, fmt.Errorf("tenant %q: domain %s belongs to %q", tenant.ID, d, other.ID)
+			}
+			t.byDomain[d] = tenant
+		}
+		keys := map[string]bool{}
+		for i := range tenant.APIKeys {
+			k := &tenant.APIKeys[i]
+			if k.Key == "" || keys[k.Key] {
+				return nil, fmt.Errorf("tenant %q: API keys must be set and unique", tenant.ID)
+			}
+			keys[k.Key] = true
+			k.hash = sha256.Sum256([]byte(k.Key))
+			// the usage counters of links belong to owners with a slash
+			if strings.Contains(k.Owner, "/") {
+				return nil, fmt.Errorf("tenant %q: owner %q contains a slash", tenant.ID, k.Owner)
+			}
+		}
+	}
+	return t, nil
+}
+
+// resolve returns the tenant serving host, nil for a default tenant without
+// configuration.
+func (t *Tenants) resolve(host string) *Tenant {
+	if t == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if tenant, ok := t.byDomain[strings.ToLower(host)]; ok {
+		return tenant
+	}
+	return t.byID[""]
+}
+
+// ids returns the IDs of the tenants, the default one included.
+func (t *Tenants) ids() []string {
+	ids := []string{""}
+	if t == nil {
+		return ids
+	}
+	for id := range t.byID {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// quota returns the quota of owner in tenant, ok is false if no API key of
+// the tenant belongs to owner.
+func (t *Tenants) quota(tenant, owner string) (q Quota, ok bool) {
+	if t == nil || owner == "" {
+		return q, false
+	}
+	tn := t.byID[tenant]
+	if tn == nil {
+		return q, false
+	}
+	for _, k := range tn.APIKeys {
+		if k.Owner != owner {
+			continue
+		}
+		if k.Quota != nil {
+			return *k.Quota, true
+		}
+		q, ok = tn.Quota, true
+	}
+	return q, ok
+}
+
+// hasKeys reports whether the links of tenant may have owners with quotas.
+func (t *Tenants) hasKeys(tenant string) bool {
+	return t != nil && t.byID[tenant] != nil && len(t.byID[tenant].APIKeys) > 0
+}
+
+// populateContext is a kithttp.RequestFunc storing the tenant of the request
+// and the API key it was sent with, if any.
+func (t *Tenants) populateContext(ctx context.Context, r *http.Request) context.Context {
+	if tenant := t.resolve(r.Host); tenant != nil {
+		ctx = withTenant(ctx, tenant.ID)
+	}
+	if key := requestKey(r); key != "" {
+		ctx = context.WithValue(ctx, contextKeyAPIKey, key)
+	}
+	return ctx
+}
+
+// requestKey returns the API key sent as a Bearer token or in X-API-Key.
+func requestKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticate requires the API key of a tenant having keys, the owner of
+// the key is stored in the context of the endpoint.
+func (t *Tenants) authenticate() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if t == nil {
+				return next(ctx, request)
+			}
+			tenant := t.byID[tenantFrom(ctx)]
+			if tenant == nil || len(tenant.APIKeys) == 0 {
+				return next(ctx, request)
+			}
+			key, _ := ctx.Value(contextKeyAPIKey).(string)
+			if key == "" {
+				return nil, errUnauthorized
+			}
+			// hashes have the same length whatever the keys, and every key
+			// is compared
+			sent := sha256.Sum256([]byte(key))
+			owner, found := "", false
+			for _, k := range tenant.APIKeys {
+				if subtle.ConstantTimeCompare(sent[:], k.hash[:]) == 1 {
+					owner, found = k.Owner, true
+				}
+			}
+			if !found {
+				return nil, errUnauthorized
+			}
+			return next(context.WithValue(ctx, contextKeyOwner, owner), request)
+		}
+	}
+}
+
+// withTenant returns a context scoping storage calls to tenant.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, contextKeyTenant, tenant)
+}
+
+// tenantFrom returns the tenant of ctx, the default one if not set.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(contextKeyTenant).(string)
+	return tenant
+}
+
+// ownerFrom returns the owner of the API key the request was authenticated
+// with, empty if none.
+func ownerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(contextKeyOwner).(string)
+	return owner
+}
+
+// tenantStorage routes each call to the storage of the tenant in its
+// context, opened on first use.
+type tenantStorage struct {
+	open func(tenant string) (shortURLStorage, error)
+	// close releases what the partitions share, if not nil
+	close func() error
+
+	// partitions are opened once, then only read
+	mtx        sync.RWMutex
+	partitions map[string]shortURLStorage
+}
+
+func newTenantStorage(open func(tenant string) (shortURLStorage, error), close func() error) *tenantStorage {
+	return &tenantStorage{open: open, close: close, partitions: map[string]shortURLStorage{}}
+}
+
+func (t *tenantStorage) partition(ctx context.Context) (shortURLStorage, error) {
+	tenant := tenantFrom(ctx)
+	t.mtx.RLock()
+	p, ok := t.partitions[tenant]
+	t.mtx.RUnlock()
+	if ok {
+		return p, nil
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if p, ok := t.partitions[tenant]; ok {
+		return p, nil
+	}
+	p, err := t.open(tenant)
+	if err != nil {
+		return nil, err
+	}
+	t.partitions[tenant] = p
+	return p, nil
+}
+
+func (t *tenantStorage) Save(ctx context.Context, item *shortURL) (*shortURL, bool, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return p.Save(ctx, item)
+}
+
+func (t *tenantStorage) ByID(ctx context.Context, id string) (*shortURL, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.ByID(ctx, id)
+}
+
+func (t *tenantStorage) ByURL(ctx context.Context, owner, URL string) (*shortURL, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.ByURL(ctx, owner, URL)
+}
+
+func (t *tenantStorage) Update(ctx context.Context, item *shortURL) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.Update(ctx, item)
+}
+
+func (t *tenantStorage) Delete(ctx context.Context, id uint64) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.Delete(ctx, id)
+}
+
+func (t *tenantStorage) List(ctx context.Context, q *listQuery) (*listPage, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.List(ctx, q)
+}
+
+func (t *tenantStorage) IncrementVisits(ctx context.Context, id uint64) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.IncrementVisits(ctx, id)
+}
+
+func (t *tenantStorage) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (uint64, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return p.IncrementVisitsUpTo(ctx, id, max)
+}
+
+func (t *tenantStorage) IncrementVariantVisits(ctx context.Context, id uint64, variant string) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.IncrementVariantVisits(ctx, id, variant)
+}
+
+func (t *tenantStorage) SetCheck(ctx context.Context, id uint64, check *linkCheck) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.SetCheck(ctx, id, check)
+}
+
+func (t *tenantStorage) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return err
+	}
+	return p.AddVisits(ctx, visits)
+}
+
+func (t *tenantStorage) AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (uint64, bool, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	return p.AddUsage(ctx, owner, counter, n, limit)
+}
+
+func (t *tenantStorage) Usage(ctx context.Context, owner string, counters ...string) (map[string]uint64, error) {
+	p, err := t.partition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.Usage(ctx, owner, counters...)
+}
+
+func (t *tenantStorage) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	var err error
+	for _, p := range t.partitions {
+		if closeErr := p.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if t.close != nil {
+		if closeErr := t.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
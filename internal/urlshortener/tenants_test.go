@@ -0,0 +1,114 @@
+package urlshortener
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTenantsTest(t *testing.T) http.Handler {
+	t.Helper()
+	tenants, err := NewTenants(
+		&Tenant{ID: "t1", Domains: []string{"t1.example"}, APIKeys: []APIKey{{Key: "ka", Owner: "ann"}, {Key: "kb", Owner: "bob"}}},
+		&Tenant{ID: "t2", Domains: []string{"t2.example"}, APIKeys: []APIKey{{Key: "kc", Owner: "cat"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestHandler(t, tenants, NewInMemoryStorage(), "")
+}
+
+// listedURLs returns the destinations of the links listed by w.
+func listedURLs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var page struct {
+		Links []infoResponse `json:"links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", w.Code, w.Body)
+	}
+	var URLs []string
+	for _, l := range page.Links {
+		URLs = append(URLs, l.URL)
+	}
+	return URLs
+}
+
+func TestTenantsRequireKeys(t *testing.T) {
+	h := newTenantsTest(t)
+	code := shortCode(t, serve(h, "POST", "http://t1.example/", `{"url": "https://example.com/a"}`, "X-API-Key", "ka"))
+	for _, test := range []struct {
+		method, target, body string
+		headers              []string
+		want                 int
+	}{
+		{"POST", "http://t1.example/", `{"url": "https://example.com/b"}`, nil, http.StatusUnauthorized},
+		{"POST", "http://t1.example/", `{"url": "https://example.com/b"}`, []string{"X-API-Key", "kc"}, http.StatusUnauthorized},
+		{"POST", "http://t1.example/", `{"url": "https://example.com/b"}`, []string{"Authorization", "Bearer kx"}, http.StatusUnauthorized},
+		{"POST", "http://t1.example/", `{"url": "https://example.com/b"}`, []string{"Authorization", "Bearer kb"}, http.StatusOK},
+		{"GET", "http://t1.example/links", "", nil, http.StatusUnauthorized},
+		{"PATCH", "http://t1.example/links/" + code, `{"title": "A"}`, nil, http.StatusUnauthorized},
+		{"PATCH", "http://t1.example/links/" + code, `{"title": "A"}`, []string{"X-API-Key", "k"}, http.StatusUnauthorized},
+		// visits need no key
+		{"GET", "http://t1.example/" + code, "", nil, http.StatusPermanentRedirect},
+		{"GET", "http://t1.example/info/" + code, "", nil, http.StatusOK},
+	} {
+		if w := serve(h, test.method, test.target, test.body, test.headers...); w.Code != test.want {
+			t.Errorf("%s %s with %v: %d %s, want %d", test.method, test.target, test.headers, w.Code, w.Body, test.want)
+		}
+	}
+}
+
+func TestTenantsIsolation(t *testing.T) {
+	h := newTenantsTest(t)
+	URL := `{"url": "https://example.com/a"}`
+	code := shortCode(t, serve(h, "POST", "http://t1.example/", URL, "X-API-Key", "ka"))
+
+	// the short codes of a tenant mean nothing to another one
+	for _, target := range []string{"http://t2.example/" + code, "http://t2.example/info/" + code} {
+		if w := serve(h, "GET", target, ""); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d %s, want 404", target, w.Code, w.Body)
+		}
+	}
+	if w := serve(h, "PATCH", "http://t2.example/links/"+code, `{"title": "B"}`, "X-API-Key", "kc"); w.Code != http.StatusNotFound {
+		t.Errorf("update from another tenant: %d %s, want 404", w.Code, w.Body)
+	}
+	w := serve(h, "GET", "http://t2.example/links", "", "X-API-Key", "kc")
+	if URLs := listedURLs(t, w); len(URLs) != 0 {
+		t.Errorf("another tenant lists %v", URLs)
+	}
+
+	// nor do the links of another owner of the tenant
+	if w := serve(h, "PATCH", "http://t1.example/links/"+code, `{"title": "B"}`, "X-API-Key", "kb"); w.Code != http.StatusNotFound {
+		t.Errorf("update by another owner: %d %s, want 404", w.Code, w.Body)
+	}
+	w = serve(h, "GET", "http://t1.example/links", "", "X-API-Key", "kb")
+	if URLs := listedURLs(t, w); len(URLs) != 0 {
+		t.Errorf("another owner lists %v", URLs)
+	}
+	w = serve(h, "GET", "http://t1.example/links", "", "X-API-Key", "ka")
+	if URLs := listedURLs(t, w); len(URLs) != 1 || URLs[0] != "https://example.com/a" {
+		t.Errorf("the owner lists %v", URLs)
+	}
+
+	// shortening the URL again only reuses the link of the same owner and
+	// tenant
+	if again := shortCode(t, serve(h, "POST", "http://t1.example/", URL, "X-API-Key", "ka")); again != code {
+		t.Errorf("the owner got %s, want %s", again, code)
+	}
+	bob := shortCode(t, serve(h, "POST", "http://t1.example/", URL, "X-API-Key", "kb"))
+	if bob == code {
+		t.Error("another owner got the same link")
+	}
+	cat := shortCode(t, serve(h, "POST", "http://t2.example/", URL, "X-API-Key", "kc"))
+	w = serve(h, "GET", "http://t2.example/info/"+cat, "")
+	var info infoResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Owner != "cat" {
+		t.Errorf("link of another tenant: %d %s, want one owned by cat", w.Code, w.Body)
+	}
+	w = serve(h, "GET", "http://t1.example/info/"+code, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil || info.Owner != "ann" {
+		t.Errorf("link of the tenant: %d %s, want one owned by ann", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,215 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/trace"
+	"github.com/gorilla/mux"
+)
+
+// startServerSpan is a kithttp.RequestFunc starting the span of a request,
+// child of the caller's span if the request has a traceparent header.
+func startServerSpan(tracer *trace.Tracer) func(context.Context, *http.Request) context.Context {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if sc, ok := trace.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = trace.ContextWithRemote(ctx, sc)
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("http.host", r.Host)
+		span.SetAttribute("http.user_agent", r.UserAgent())
+		return ctx
+	}
+}
+
+// finishServerSpan is a kithttp.ServerFinalizerFunc ending the span of a
+// request.
+func finishServerSpan(ctx context.Context, code int, r *http.Request) {
+	span := trace.FromContext(ctx)
+	span.SetAttribute("http.status_code", code)
+	if code >= 500 {
+		span.SetError(errorStatus(code))
+	}
+	span.Finish()
+}
+
+// startClientSpan starts the span of an outbound request, child of the span
+// in its context if any, and sends the span context along.
+func startClientSpan(tracer *trace.Tracer, name string, req *http.Request) (*http.Request, *trace.Span) {
+	ctx, span := tracer.Start(req.Context(), name, trace.KindClient)
+	span.SetAttribute("http.method", req.Method)
+	trace.Inject(ctx, req.Header)
+	return req.WithContext(ctx), span
+}
+
+// finishClientSpan ends the span of an outbound request answered with code,
+// or failed with err.
+func finishClientSpan(span *trace.Span, code int, err error) {
+	if code != 0 {
+		span.SetAttribute("http.status_code", code)
+	}
+	if err == nil && code >= 500 {
+		err = errorStatus(code)
+	}
+	span.SetError(err)
+	span.Finish()
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string { return http.StatusText(int(e)) }
+
+type tracingService struct {
+	tracer *trace.Tracer
+	Service
+}
+
+// NewTracingService returns a Service recording a span for each call.
+func NewTracingService(tracer *trace.Tracer, s Service) Service {
+	return &tracingService{tracer, s}
+}
+
+func (s *tracingService) Shortify(ctx context.Context, item *shortURL) (mapping *shortURL, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.Shortify", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	span.SetAttribute("url", item.URL)
+	return s.Service.Shortify(ctx, item)
+}
+
+func (s *tracingService) Resolve(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.Resolve", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	span.SetAttribute("shortURL", shortURL)
+	return s.Service.Resolve(ctx, shortURL)
+}
+
+func (s *tracingService) GetInfo(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.GetInfo", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	span.SetAttribute("shortURL", shortURL)
+	return s.Service.GetInfo(ctx, shortURL)
+}
+
+func (s *tracingService) Update(ctx context.Context, shortURL string, u *linkUpdate) (mapping *shortURL, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.Update", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	span.SetAttribute("shortURL", shortURL)
+	return s.Service.Update(ctx, shortURL, u)
+}
+
+func (s *tracingService) List(ctx context.Context, q *listQuery) (page *listPage, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.List", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	span.SetAttribute("sort", q.SortBy)
+	return s.Service.List(ctx, q)
+}
+
+func (s *tracingService) IsHealthy(ctx context.Context) (healthy bool, err error) {
+	ctx, span := s.tracer.Start(ctx, "Service.IsHealthy", trace.KindInternal)
+	defer func() { span.SetError(err); span.Finish() }()
+	return s.Service.IsHealthy(ctx)
+}
+
+type tracingStorage struct {
+	tracer *trace.Tracer
+	shortURLStorage
+}
+
+// NewTracingStorage returns a storage recording a span for each call to
+// next.
+func NewTracingStorage(tracer *trace.Tracer, next shortURLStorage) shortURLStorage {
+	return &tracingStorage{tracer, next}
+}
+
+// start starts the span of a storage call, errURLNotFound is an answer
+// rather than a failure.
+func (u *tracingStorage) start(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := u.tracer.Start(ctx, "storage."+name, trace.KindClient)
+	return ctx, func(err error) {
+		if err != errURLNotFound {
+			span.SetError(err)
+		}
+		span.Finish()
+	}
+}
+
+func (u *tracingStorage) Save(ctx context.Context, item *shortURL) (m *shortURL, created bool, err error) {
+	ctx, finish := u.start(ctx, "Save")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.Save(ctx, item)
+}
+
+func (u *tracingStorage) ByID(ctx context.Context, id string) (m *shortURL, err error) {
+	ctx, finish := u.start(ctx, "ByID")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.ByID(ctx, id)
+}
+
+func (u *tracingStorage) ByURL(ctx context.Context, owner, URL string) (m *shortURL, err error) {
+	ctx, finish := u.start(ctx, "ByURL")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.ByURL(ctx, owner, URL)
+}
+
+func (u *tracingStorage) Update(ctx context.Context, item *shortURL) (err error) {
+	ctx, finish := u.start(ctx, "Update")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.Update(ctx, item)
+}
+
+func (u *tracingStorage) Delete(ctx context.Context, id uint64) (err error) {
+	ctx, finish := u.start(ctx, "Delete")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.Delete(ctx, id)
+}
+
+func (u *tracingStorage) List(ctx context.Context, q *listQuery) (page *listPage, err error) {
+	ctx, finish := u.start(ctx, "List")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.List(ctx, q)
+}
+
+func (u *tracingStorage) IncrementVisits(ctx context.Context, id uint64) (err error) {
+	ctx, finish := u.start(ctx, "IncrementVisits")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.IncrementVisits(ctx, id)
+}
+
+func (u *tracingStorage) AddUsage(ctx context.Context, owner, counter string, n int64, limit uint64) (value uint64, ok bool, err error) {
+	ctx, finish := u.start(ctx, "AddUsage")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.AddUsage(ctx, owner, counter, n, limit)
+}
+
+func (u *tracingStorage) IncrementVisitsUpTo(ctx context.Context, id uint64, max uint64) (visits uint64, err error) {
+	ctx, finish := u.start(ctx, "IncrementVisitsUpTo")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.IncrementVisitsUpTo(ctx, id, max)
+}
+
+func (u *tracingStorage) IncrementVariantVisits(ctx context.Context, id uint64, variant string) (err error) {
+	ctx, finish := u.start(ctx, "IncrementVariantVisits")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.IncrementVariantVisits(ctx, id, variant)
+}
+
+func (u *tracingStorage) SetCheck(ctx context.Context, id uint64, check *linkCheck) (err error) {
+	ctx, finish := u.start(ctx, "SetCheck")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.SetCheck(ctx, id, check)
+}
+
+func (u *tracingStorage) AddVisits(ctx context.Context, visits map[uint64]uint64) (err error) {
+	ctx, finish := u.start(ctx, "AddVisits")
+	defer func() { finish(err) }()
+	return u.shortURLStorage.AddVisits(ctx, visits)
+}
@@ -0,0 +1,99 @@
+package urlshortener
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/trace"
+	"github.com/go-kit/kit/log"
+)
+
+// spanRecorder keeps the spans exported.
+type spanRecorder struct {
+	mtx   sync.Mutex
+	spans []*trace.Span
+}
+
+func (r *spanRecorder) Export(spans []*trace.Span) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *spanRecorder) Close() error { return nil }
+
+// Webhook deliveries and link checks send the context of their client span.
+func TestOutboundRequestsCarryTraceparent(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		parents []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		parents = append(parents, r.Header.Get("traceparent"))
+		mtx.Unlock()
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	rec := &spanRecorder{}
+	tracer := trace.NewTracer(rec, 1, nil)
+
+	hooks, err := NewWebhooks("", nil, tracer, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+	hooks.client = srv.Client()
+	d := &webhookDelivery{ID: "d1", Event: eventLinkCreated, Payload: []byte(`{}`)}
+	if _, err := hooks.post(d, Webhook{ID: "h1", URL: srv.URL + "/hook"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestChecker(NewInMemoryStorage(), srv.Client(), 1)
+	c.tracer = tracer
+	c.check(context.Background(), &shortURL{ID: 1, URL: srv.URL + "/gone"})
+	tracer.Close()
+
+	// a webhook delivery, then a HEAD and a GET of the broken destination
+	if len(parents) != 3 {
+		t.Fatalf("%d requests, want 3", len(parents))
+	}
+	clients := map[string]*trace.Span{}
+	var check *trace.Span
+	for _, s := range rec.spans {
+		switch s.Kind {
+		case trace.KindClient:
+			clients[s.Context.Traceparent()] = s
+		case trace.KindInternal:
+			check = s
+		}
+	}
+	if check == nil || check.Attributes["linkcheck.broken"] != true {
+		t.Fatalf("no check span of a broken link in %v", rec.spans)
+	}
+	for i, p := range parents {
+		s := clients[p]
+		if s == nil {
+			t.Errorf("request %d: traceparent %q is not that of a client span", i, p)
+			continue
+		}
+		if i == 0 {
+			if s.Name != "webhook."+eventLinkCreated || s.Attributes["webhook.delivery"] != "d1" {
+				t.Errorf("webhook span %s %v", s.Name, s.Attributes)
+			}
+			continue
+		}
+		if s.Context.TraceID != check.Context.TraceID || s.Parent != check.Context.SpanID {
+			t.Errorf("request %d: span %s is not a child of the check", i, s.Name)
+		}
+		if s.Attributes["http.status_code"] != http.StatusNotFound {
+			t.Errorf("request %d: span attributes %v, want a 404", i, s.Attributes)
+		}
+	}
+}
@@ -4,33 +4,52 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/friends-of-scalability/url-shortener/pkg/qrcode"
+	"github.com/friends-of-scalability/url-shortener/pkg/trace"
 	"github.com/gorilla/mux"
 
+	"github.com/go-kit/kit/endpoint"
 	kitlog "github.com/go-kit/kit/log"
 	kithttp "github.com/go-kit/kit/transport/http"
 )
 
 // MakeHandler returns a handler for the urlshortener service.
-func MakeHandler(ctx context.Context, us Service, logger kitlog.Logger) http.Handler {
+func MakeHandler(ctx context.Context, us Service, tenants *Tenants, quotas *Quotas, passwords *PasswordGuard, geo *Geo, load *LoadGenerator, faults *FaultInjector, hooks *Webhooks, recent *MemoryBroker, adminKey string, tracer *trace.Tracer, logger kitlog.Logger) http.Handler {
 	r := mux.NewRouter()
 
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
 		kithttp.ServerErrorEncoder(encodeError),
-		kithttp.ServerBefore(kithttp.PopulateRequestContext, func(c context.Context, r *http.Request) context.Context {
+		kithttp.ServerBefore(startServerSpan(tracer), kithttp.PopulateRequestContext, func(c context.Context, r *http.Request) context.Context {
 			var scheme = "http"
 			if r.TLS != nil {
 				scheme = "https"
 			}
 			c = context.WithValue(c, contextKeyHTTPAddress, scheme+"://"+r.Host+"/")
 			return c
-		}),
+		}, tenants.populateContext, geo.populateContext, faults.populateContext),
+		kithttp.ServerFinalizer(finishServerSpan),
 	}
 
+	// synthetic load and faults are configured per endpoint name
+	chaos := func(name string) endpoint.Middleware {
+		return endpoint.Chain(faults.middleware(name), load.middleware(name))
+	}
+	// links are created, listed and changed with an API key of the tenant,
+	// if it has any
+	auth := tenants.authenticate()
+	// synthetic load, faults, webhooks, events and stats are managed with
+	// the admin key
+	admin := adminOnly(adminKey)
+
 	URLHealthzHandler := kithttp.NewServer(
-		makeURLHealthzEndpoint(us),
+		chaos("healthz")(makeURLHealthzEndpoint(us)),
 		func(c context.Context, r *http.Request) (interface{}, error) {
 			return nil, nil
 		},
@@ -38,35 +57,167 @@ func MakeHandler(ctx context.Context, us Service, logger kitlog.Logger) http.Han
 		opts...,
 	)
 	URLShortifyHandler := kithttp.NewServer(
-		makeURLShortifyEndpoint(us),
+		chaos("shortify")(auth(makeURLShortifyEndpoint(us))),
 		decodeURLShortenerRequest,
 		encodeResponse,
 		opts...,
 	)
 	URLRedirectHandler := kithttp.NewServer(
-		makeURLRedirectEndpoint(us),
+		chaos("redirect")(makeURLRedirectEndpoint(us, passwords)),
 		decodeURLRedirectRequest,
 		encodeRedirectResponse,
 		opts...,
 	)
 	URLInfoHandler := kithttp.NewServer(
-		makeURLInfoEndpoint(us),
+		chaos("info")(makeURLInfoEndpoint(us)),
 		decodeURLInfoRequest,
 		encodeResponse,
 		opts...,
 	)
+	URLQRCodeHandler := kithttp.NewServer(
+		chaos("qrcode")(makeURLQRCodeEndpoint(us)),
+		decodeURLQRCodeRequest,
+		encodeQRCodeResponse,
+		opts...,
+	)
+	URLListHandler := kithttp.NewServer(
+		chaos("list")(auth(makeURLListEndpoint(us))),
+		decodeURLListRequest,
+		encodeResponse,
+		opts...,
+	)
+	URLUpdateHandler := kithttp.NewServer(
+		chaos("update")(auth(makeURLUpdateEndpoint(us))),
+		decodeURLUpdateRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	UsageHandler := kithttp.NewServer(
+		auth(makeUsageEndpoint(quotas)),
+		decodeEmptyRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	LoadStatusHandler := kithttp.NewServer(
+		admin(makeLoadStatusEndpoint(load)),
+		decodeLoadStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+	LoadSetHandler := kithttp.NewServer(
+		admin(makeLoadSetEndpoint(load)),
+		decodeLoadSetRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	FaultStatusHandler := kithttp.NewServer(
+		admin(makeFaultStatusEndpoint(faults)),
+		decodeFaultStatusRequest,
+		encodeResponse,
+		opts...,
+	)
+	FaultSetHandler := kithttp.NewServer(
+		admin(makeFaultSetEndpoint(faults)),
+		decodeFaultSetRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	WebhookListHandler := kithttp.NewServer(
+		admin(makeWebhookListEndpoint(hooks)),
+		decodeEmptyRequest,
+		encodeResponse,
+		opts...,
+	)
+	WebhookRegisterHandler := kithttp.NewServer(
+		admin(makeWebhookRegisterEndpoint(hooks)),
+		decodeWebhookRequest,
+		encodeResponse,
+		opts...,
+	)
+	WebhookUnregisterHandler := kithttp.NewServer(
+		admin(makeWebhookUnregisterEndpoint(hooks)),
+		decodeWebhookRequest,
+		encodeResponse,
+		opts...,
+	)
+	WebhookDeliveriesHandler := kithttp.NewServer(
+		admin(makeWebhookDeliveriesEndpoint(hooks)),
+		decodeEmptyRequest,
+		encodeResponse,
+		opts...,
+	)
+
+	RecentEventsHandler := kithttp.NewServer(
+		admin(makeRecentEventsEndpoint(recent)),
+		decodeRecentEventsRequest,
+		encodeResponse,
+		opts...,
+	)
 
 	r.Handle("/", URLShortifyHandler).Methods("POST")
 	r.Handle("/healthz", URLHealthzHandler).Methods("GET")
-	r.Handle("/{shortURL}", URLRedirectHandler).Methods("GET")
+	r.HandleFunc("/ui", serveUI).Methods("GET")
+	r.Handle("/usage", UsageHandler).Methods("GET")
+	r.Handle("/links", URLListHandler).Methods("GET")
+	r.Handle("/links/{shortURL}", URLUpdateHandler).Methods("PATCH")
+	// the password prompt of protected links posts to the link itself
+	r.Handle("/{shortURL}", URLRedirectHandler).Methods("GET", "POST")
 	r.Handle("/info/{shortURL}", URLInfoHandler).Methods("GET")
+	r.Handle("/info/{shortURL}/qr", URLQRCodeHandler).Methods("GET")
+	r.Handle("/admin/load", LoadStatusHandler).Methods("GET")
+	r.Handle("/admin/load/{endpoint}", LoadSetHandler).Methods("PUT", "DELETE")
+	r.Handle("/admin/faults", FaultStatusHandler).Methods("GET")
+	r.Handle("/admin/faults/{endpoint}", FaultSetHandler).Methods("PUT", "DELETE")
+	r.Handle("/admin/webhooks", WebhookListHandler).Methods("GET")
+	r.Handle("/admin/webhooks", WebhookRegisterHandler).Methods("POST")
+	r.Handle("/admin/webhooks/deliveries", WebhookDeliveriesHandler).Methods("GET")
+	r.Handle("/admin/webhooks/{id}", WebhookUnregisterHandler).Methods("DELETE")
+	r.Handle("/admin/events/{type}", RecentEventsHandler).Methods("GET")
+	r.Handle("/debug/vars", adminHandler(adminKey, http.HandlerFunc(serveStats))).Methods("GET")
+	// the path following a short URL is forwarded by prefix links and fills
+	// the placeholders of destinations, after every other route had its
+	// chance
+	r.Handle("/{shortURL}/{suffix:.*}", URLRedirectHandler).Methods("GET", "POST")
 
 	return r
 }
 
+// statsMaps are the expvar maps served on /debug/vars. expvar.Handler also
+// serves cmdline, with the credentials of the storage flags.
+var statsMaps = []string{"events", "link_checker", "storage_cache", "visit_batcher"}
+
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{")
+	first := true
+	for _, name := range statsMaps {
+		v := expvar.Get(name)
+		if v == nil {
+			continue
+		}
+		if !first {
+			fmt.Fprint(w, ",")
+		}
+		first = false
+		fmt.Fprintf(w, "\n%q: %s", name, v)
+	}
+	fmt.Fprint(w, "\n}\n")
+}
+
+func decodeEmptyRequest(c context.Context, r *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
 func decodeURLShortenerRequest(c context.Context, r *http.Request) (interface{}, error) {
 	decoder := json.NewDecoder(r.Body)
-	var t shortURL
+	var t struct {
+		shortURL
+		Password string `json:"password"`
+	}
 	if !decoder.More() {
 		return nil, errors.New("Empty request, cannot shortify the emptiness")
 
@@ -78,12 +229,50 @@ func decodeURLShortenerRequest(c context.Context, r *http.Request) (interface{},
 	if t.URL == "" {
 		return nil, errors.New("Empty request, cannot shortify the emptiness")
 	}
-	return shortenerRequest{URL: t.URL}, nil
+	return shortenerRequest{
+		URL:         t.URL,
+		Preview:     t.Preview,
+		Owner:       t.Owner,
+		Title:       t.Title,
+		Tags:        t.Tags,
+		Metadata:    t.Metadata,
+		Password:    t.Password,
+		MaxVisits:   t.MaxVisits,
+		Rules:       t.Rules,
+		Variants:    t.Variants,
+		Sticky:      t.Sticky,
+		Passthrough: t.Passthrough,
+		UTM:         t.UTM,
+		Prefix:      t.Prefix,
+	}, nil
 }
 
 func decodeURLRedirectRequest(c context.Context, r *http.Request) (interface{}, error) {
 	shURL := mux.Vars(r)
-	return redirectRequest{id: shURL["shortURL"]}, nil
+	id := shURL["shortURL"]
+	// "/{shortURL}+" and "?preview=1" both ask for the preview page,
+	// "?preview=0" follows a link through its forced preview page
+	preview, proceed := strings.HasSuffix(id, "+"), false
+	if p, err := strconv.ParseBool(r.URL.Query().Get("preview")); err == nil {
+		preview, proceed = preview || p, !p
+	}
+	// the preview parameter is ours, the others may be passed through
+	query := r.URL.Query()
+	query.Del("preview")
+	req := redirectRequest{
+		id:      strings.TrimSuffix(id, "+"),
+		suffix:  shURL["suffix"],
+		query:   query,
+		preview: preview,
+		proceed: proceed,
+	}
+	// the password of a protected link, from the prompt or a header
+	if r.Method == "POST" {
+		req.password, req.form = r.PostFormValue("password"), true
+	} else {
+		req.password = r.Header.Get("X-Link-Password")
+	}
+	return req, nil
 }
 
 func decodeURLInfoRequest(c context.Context, r *http.Request) (interface{}, error) {
@@ -92,14 +281,144 @@ func decodeURLInfoRequest(c context.Context, r *http.Request) (interface{}, erro
 
 }
 
+func decodeURLUpdateRequest(c context.Context, r *http.Request) (interface{}, error) {
+	var t struct {
+		Preview     *bool              `json:"preview"`
+		Title       *string            `json:"title"`
+		Tags        *[]string          `json:"tags"`
+		Metadata    *map[string]string `json:"metadata"`
+		Rules       *[]redirectRule    `json:"rules"`
+		Variants    *[]linkVariant     `json:"variants"`
+		Sticky      *bool              `json:"sticky"`
+		Passthrough *bool              `json:"passthrough"`
+		UTM         *utmParams         `json:"utm"`
+		Prefix      *bool              `json:"prefix"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		return nil, errInvalidLinkData
+	}
+	return updateRequest{
+		id: mux.Vars(r)["shortURL"],
+		update: linkUpdate{
+			Preview:     t.Preview,
+			Title:       t.Title,
+			Tags:        t.Tags,
+			Metadata:    t.Metadata,
+			Rules:       t.Rules,
+			Variants:    t.Variants,
+			Sticky:      t.Sticky,
+			Passthrough: t.Passthrough,
+			UTM:         t.UTM,
+			Prefix:      t.Prefix,
+		},
+	}, nil
+}
+
+func decodeURLListRequest(c context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	query := listQuery{
+		Owner:    q.Get("owner"),
+		Tags:     q["tag"],
+		Domain:   q.Get("domain"),
+		Contains: q.Get("q"),
+		SortBy:   q.Get("sort"),
+		Cursor:   q.Get("cursor"),
+		// newest or most visited first unless asked otherwise
+		Desc: q.Get("order") != "asc",
+	}
+	var err error
+	if query.Limit, err = intParam(q.Get("limit"), defaultListLimit, 1, maxListLimit); err != nil {
+		return nil, errInvalidListQuery
+	}
+	if b := q.Get("broken"); b != "" {
+		if query.Broken, err = strconv.ParseBool(b); err != nil {
+			return nil, errInvalidListQuery
+		}
+	}
+	return listRequest{query: query}, nil
+}
+
+func decodeURLQRCodeRequest(c context.Context, r *http.Request) (interface{}, error) {
+	shURL := mux.Vars(r)
+	q := r.URL.Query()
+	req := qrCodeRequest{id: shURL["shortURL"], format: "png", size: 256, level: qrcode.Medium, margin: 4}
+	if f := q.Get("format"); f != "" {
+		if f != "png" && f != "svg" {
+			return nil, errQRCodeParams
+		}
+		req.format = f
+	}
+	if l := q.Get("level"); l != "" {
+		level, err := qrcode.ParseLevel(l)
+		if err != nil {
+			return nil, errQRCodeParams
+		}
+		req.level = level
+	}
+	var err error
+	if req.size, err = intParam(q.Get("size"), req.size, 32, 4096); err != nil {
+		return nil, errQRCodeParams
+	}
+	if req.margin, err = intParam(q.Get("margin"), req.margin, 0, 32); err != nil {
+		return nil, errQRCodeParams
+	}
+	return req, nil
+}
+
+// intParam parses an optional integer query parameter within [min, max].
+func intParam(v string, def, min, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < min || n > max {
+		return 0, errors.New("out of range")
+	}
+	return n, nil
+}
+
+func encodeQRCodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		encodeError(ctx, e.error(), w)
+		return nil
+	}
+	qr := response.(qrCodeResponse)
+	w.Header().Set("Content-Type", qr.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(qr.body)))
+	_, err := w.Write(qr.body)
+	return err
+}
+
 func encodeRedirectResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	if e, ok := response.(errorer); ok && e.error() != nil {
+		if isPasswordError(e.error()) {
+			return encodePasswordPrompt(ctx, e.error(), w)
+		}
 		encodeError(ctx, e.error(), w)
 		return nil
 	}
 	if e, ok := response.(redirectResponse); ok && e.error() == nil {
+		if e.preview {
+			return encodePreviewResponse(ctx, w, e)
+		}
 		w.Header().Set("Location", e.URL)
 		w.Header().Set("Referer", e.id)
+		if e.stickTo != "" {
+			setVariantCookie(w, e.path, e.stickTo)
+		}
+		if e.noStore {
+			// the next visit must ask for the password, count again or be
+			// routed by the rules again
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if e.seeOther {
+			// a posted prompt must not be posted again to the destination
+			w.WriteHeader(http.StatusSeeOther)
+			return nil
+		}
 		w.WriteHeader(http.StatusPermanentRedirect)
 		return nil
 	}
@@ -122,11 +441,28 @@ type errorer interface {
 
 // encode errors from business-logic
 func encodeError(_ context.Context, err error, w http.ResponseWriter) {
+	if f, ok := err.(*faultError); ok {
+		encodeFaultError(f, w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	switch err {
-	case errURLNotFound:
+	case errUnauthorized, errAdminRequired:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+	case errLinkQuotaExceeded, errCreationQuotaExceeded, errRedirectQuotaExceeded:
+		w.WriteHeader(http.StatusForbidden)
+	case errPasswordRequired, errWrongPassword:
+		w.WriteHeader(http.StatusUnauthorized)
+	case errPasswordLocked:
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errPasswordConflict, errVisitsConflict, errPrefixConflict, errPreviewConflict, errRulesConflict, errVariantsConflict, errPassthroughConflict, errDetailsConflict:
+		w.WriteHeader(http.StatusConflict)
+	case errLinkExhausted:
+		w.WriteHeader(http.StatusGone)
+	case errURLNotFound, errUnknownTarget, errWebhookNotFound:
 		w.WriteHeader(http.StatusNotFound)
-	case errMalformedURL:
+	case errMalformedURL, errQRCodeParams, errQRCodeTooSmall, qrcode.ErrTooLong, errInvalidListQuery, errInvalidCursor, errInvalidLinkData, errInvalidRules, errInvalidVariants, errInvalidLoad, errLoadTooHigh, errInvalidFault, errInvalidWebhook:
 		w.WriteHeader(http.StatusBadRequest)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
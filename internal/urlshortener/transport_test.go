@@ -0,0 +1,71 @@
+package urlshortener
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// newTestHandler serves the links of db to the clients of tenants.
+func newTestHandler(t *testing.T, tenants *Tenants, db shortURLStorage, adminKey string) http.Handler {
+	t.Helper()
+	logger := log.NewNopLogger()
+	hooks, err := NewWebhooks("", nil, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := NewQuotas(tenants, db, logger)
+	s := NewQuotaService(quotas, NewService(db))
+	return MakeHandler(context.Background(), s, tenants, quotas, NewPasswordGuard(db, logger), NewGeo(nil, ""),
+		NewLoadGenerator(1, 1, 1), NewFaultInjector(false), hooks, NewMemoryBroker(10), adminKey, nil, logger)
+}
+
+// serve sends a request with body, if not empty, and headers as pairs of
+// names and values to h.
+func serve(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// shortCode returns the short code of the link created by w.
+func shortCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var res struct {
+		ShortURL string `json:"shortURL"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.ShortURL == "" {
+		t.Fatalf("no link created: %d %s", w.Code, w.Body)
+	}
+	return res.ShortURL[strings.LastIndex(res.ShortURL, "/")+1:]
+}
+
+// Every first path segment routed before the short URLs is reserved, or a
+// link encoding to it could not forward the paths following it.
+func TestReservedIDs(t *testing.T) {
+	h := newTestHandler(t, nil, NewInMemoryStorage(), "")
+	err := h.(*mux.Router).Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+		if segment != "" && !strings.HasPrefix(segment, "{") && !reservedIDs[segment] {
+			t.Errorf("route %s: %s is not a reserved ID", path, segment)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package urlshortener
+
+import (
+	"net/http"
+)
+
+// uiPage is a self-contained single page for people who would rather not
+// POST JSON by hand. Links created from a browser are remembered in its
+// localStorage, visit counts are refreshed from /info/{shortURL}.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>URL shortener</title>
+<style>
+body { font-family: sans-serif; max-width: 56em; margin: 2em auto; padding: 0 1em; color: #222; }
+form { display: flex; gap: .5em; margin-bottom: 1em; }
+input[type=url] { flex: 1; padding: .5em; font-size: 1em; }
+button { padding: .5em 1em; cursor: pointer; }
+table { width: 100%; border-collapse: collapse; }
+th, td { text-align: left; padding: .5em; border-bottom: 1px solid #ddd; vertical-align: middle; }
+td.url { word-break: break-all; max-width: 24em; }
+td.visits { text-align: right; }
+img.qr { width: 64px; height: 64px; }
+#error { color: #b00; min-height: 1.2em; }
+</style>
+</head>
+<body>
+<h1>URL shortener</h1>
+<form id="shortify">
+<input type="url" id="url" placeholder="https://example.com/a/very/long/link" required>
+<label><input type="checkbox" id="preview"> preview</label>
+<button type="submit">Shorten</button>
+</form>
+<p id="error"></p>
+<table>
+<thead><tr><th>Short link</th><th>Destination</th><th>Visits</th><th>QR</th><th></th></tr></thead>
+<tbody id="links"></tbody>
+</table>
+<p><button id="refresh">Refresh visit counts</button> <button id="forget">Forget all</button></p>
+<script>
+(function () {
+  var storageKey = "urlshortener.links";
+
+  function load() {
+    try { return JSON.parse(localStorage.getItem(storageKey)) || []; } catch (e) { return []; }
+  }
+
+  function save(links) {
+    localStorage.setItem(storageKey, JSON.stringify(links));
+  }
+
+  function idOf(shortURL) {
+    return shortURL.substring(shortURL.lastIndexOf("/") + 1);
+  }
+
+  function cell(row, text, className) {
+    var td = document.createElement("td");
+    if (className) { td.className = className; }
+    td.textContent = text;
+    row.appendChild(td);
+    return td;
+  }
+
+  function render() {
+    var tbody = document.getElementById("links");
+    tbody.innerHTML = "";
+    load().forEach(function (link) {
+      var row = document.createElement("tr");
+      var a = document.createElement("a");
+      a.href = link.shortURL;
+      a.textContent = link.shortURL;
+      cell(row, "").appendChild(a);
+      cell(row, link.URL, "url");
+      cell(row, link.visits === undefined ? "-" : link.visits, "visits");
+      var qr = document.createElement("a");
+      qr.href = "info/" + idOf(link.shortURL) + "/qr?size=512";
+      qr.innerHTML = "<img class=\"qr\" alt=\"QR code\">";
+      qr.firstChild.src = "info/" + idOf(link.shortURL) + "/qr?size=128&margin=1";
+      cell(row, "").appendChild(qr);
+      var copy = document.createElement("button");
+      copy.textContent = "Copy";
+      copy.onclick = function () {
+        navigator.clipboard.writeText(link.shortURL).then(function () {
+          copy.textContent = "Copied";
+          setTimeout(function () { copy.textContent = "Copy"; }, 1500);
+        });
+      };
+      cell(row, "").appendChild(copy);
+      tbody.appendChild(row);
+    });
+  }
+
+  function refresh() {
+    var links = load();
+    Promise.all(links.map(function (link) {
+      return fetch("info/" + idOf(link.shortURL)).then(function (r) {
+        return r.ok ? r.json() : null;
+      }).then(function (info) {
+        if (info) { link.visits = info.visitsCount || 0; }
+      });
+    })).then(function () {
+      save(links);
+      render();
+    });
+  }
+
+  document.getElementById("shortify").onsubmit = function (e) {
+    e.preventDefault();
+    var error = document.getElementById("error");
+    error.textContent = "";
+    fetch("./", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        url: document.getElementById("url").value,
+        preview: document.getElementById("preview").checked
+      })
+    }).then(function (r) {
+      return r.json();
+    }).then(function (res) {
+      if (res.error) {
+        error.textContent = res.error;
+        return;
+      }
+      var links = load().filter(function (l) { return l.shortURL !== res.shortURL; });
+      links.unshift({ shortURL: res.shortURL, URL: res.URL });
+      save(links);
+      document.getElementById("url").value = "";
+      refresh();
+    }).catch(function (err) {
+      error.textContent = err;
+    });
+  };
+
+  document.getElementById("refresh").onclick = refresh;
+  document.getElementById("forget").onclick = function () {
+    save([]);
+    render();
+  };
+
+  render();
+  refresh();
+})();
+</script>
+</body>
+</html>
+`
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(uiPage))
+}
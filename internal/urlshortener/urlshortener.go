@@ -1,10 +1,8 @@
 package urlshortener
 
 import (
-	"fmt"
-	"os"
-	"os/exec"
-	"runtime"
+	"context"
+	"reflect"
 	"strings"
 	"time"
 
@@ -16,91 +14,353 @@ type shortURL struct {
 	ID            uint64
 	URL           string `json:"url,omitempty"`
 	VisitsCounter uint64
+	CreatedAt     time.Time
+	// Preview forces the preview page instead of a redirect.
+	Preview  bool              `json:"preview,omitempty"`
+	Owner    string            `json:"owner,omitempty"`
+	Title    string            `json:"title,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// PasswordHash, if set, must be matched before redirecting
+	PasswordHash string `json:"-"`
+	// MaxVisits, if not 0, is the number of redirects before the link is
+	// gone. Single-use links are deleted by their visit.
+	MaxVisits uint64 `json:"maxVisits,omitempty"`
+	// Rules pick another destination by device or country, URL is the
+	// destination of the clients none matches
+	Rules []redirectRule `json:"rules,omitempty"`
+	// Variants split the visits no rule matches among several destinations,
+	// Sticky clients keep the variant of their first visit
+	Variants []linkVariant `json:"variants,omitempty"`
+	Sticky   bool          `json:"sticky,omitempty"`
+	// Passthrough adds the query parameters of a visit to the destination,
+	// UTM the parameters the destination lacks
+	Passthrough bool       `json:"passthrough,omitempty"`
+	UTM         *utmParams `json:"utm,omitempty"`
+	// Prefix links append the path following the short URL to the path of
+	// their destination
+	Prefix bool `json:"prefix,omitempty"`
+	// Check is the last check of the destinations by the LinkChecker
+	Check *linkCheck `json:"check,omitempty"`
+
+	// password is the plain password a link is created with, never stored
+	password string
+	// variant is the one picked for a visit by Resolve, plus one
+	variant int
+	// created is set by Shortify on the links it stored, not on those of
+	// URLs shortened before
+	created bool
 }
 
-type shortURLService struct {
-	urlDatabase  shortURLStorage
-	makeFakeLoad bool
+// clone returns a copy callers can modify without touching the stored one.
+// Tags, Metadata, Rules, Variants, UTM and Check are replaced, never
+// modified in place, so they are shared.
+func (m *shortURL) clone() *shortURL {
+	c := *m
+	return &c
 }
 
-func (s *shortURLService) IsHealthy() (bool, error) {
-	return true, nil
+// linkUpdate holds the fields changed by Update, nil fields are left as is.
+type linkUpdate struct {
+	Preview     *bool
+	Title       *string
+	Tags        *[]string
+	Metadata    *map[string]string
+	Rules       *[]redirectRule
+	Variants    *[]linkVariant
+	Sticky      *bool
+	Passthrough *bool
+	UTM         *utmParams
+	Prefix      *bool
 }
 
-func (s *shortURLService) generateFakeLoad(span string) error {
-	duration, err := time.ParseDuration(span)
+const (
+	maxTitleLength    = 256
+	maxTags           = 32
+	maxTagLength      = 64
+	maxMetadataKeys   = 32
+	maxMetadataLength = 1024
+)
+
+// normalize trims and validates the user supplied attributes of a shortURL.
+func (m *shortURL) normalize() error {
+	m.Title = strings.TrimSpace(m.Title)
+	if len(m.Title) > maxTitleLength {
+		return errInvalidLinkData
+	}
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range m.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLength {
+			return errInvalidLinkData
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	if len(tags) > maxTags {
+		return errInvalidLinkData
+	}
+	m.Tags = tags
+	if len(m.Metadata) > maxMetadataKeys {
+		return errInvalidLinkData
+	}
+	for k, v := range m.Metadata {
+		if k == "" || len(k)+len(v) > maxMetadataLength {
+			return errInvalidLinkData
+		}
+	}
+	if len(m.Metadata) == 0 {
+		m.Metadata = nil
+	}
+	rules, err := normalizeRules(m.Rules)
 	if err != nil {
 		return err
 	}
-	if duration.Seconds() <= 0 {
-		return nil
+	m.Rules = rules
+	variants, err := normalizeVariants(m.Variants)
+	if err != nil {
+		return err
 	}
-	argCPUs := fmt.Sprintf("%d", runtime.NumCPU())
-	argSeconds := fmt.Sprintf("%d", int(duration.Seconds()))
-
-	cmd := exec.Command("stress", "--cpu", strings.Trim(argCPUs, " "), "--timeout", strings.Trim(argSeconds, " "))
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	go func() error {
-		err = cmd.Run()
-		if err != nil {
-			return err
-		}
-		return nil
-	}()
+	m.Variants = variants
+	utm, err := normalizeUTM(m.UTM)
+	if err != nil {
+		return err
+	}
+	m.UTM = utm
 	return nil
 }
 
+// hasDetails reports whether m has the title, tags and metadata set in item.
+func (m *shortURL) hasDetails(item *shortURL) bool {
+	return (item.Title == "" || item.Title == m.Title) &&
+		(item.Tags == nil || reflect.DeepEqual(item.Tags, m.Tags)) &&
+		(item.Metadata == nil || reflect.DeepEqual(item.Metadata, m.Metadata))
+}
+
+func (m *shortURL) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+type shortURLService struct {
+	urlDatabase shortURLStorage
+}
+
+func (s *shortURLService) IsHealthy(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
 // NewService gets you a shiny shortURLService!
-func NewService(makeFakeLoad bool) Service {
+func NewService(db shortURLStorage) Service {
 	return &shortURLService{
-		urlDatabase: &shortURLInMemoryRepository{
-			shortURLRepository: map[string]*shortURL{},
-		},
-		makeFakeLoad: makeFakeLoad,
+		urlDatabase: db,
 	}
 }
 
 // Login to the system.
-func (s *shortURLService) Shortify(URL string) (mapping *shortURL, err error) {
+func (s *shortURLService) Shortify(ctx context.Context, item *shortURL) (mapping *shortURL, err error) {
 
-	if !valid.IsURL(URL) {
+	if !valid.IsURL(item.URL) {
 		return nil, errMalformedURL
 	}
+	if err := item.normalize(); err != nil {
+		return nil, err
+	}
+	// links created with an API key belong to its owner
+	if owner := ownerFrom(ctx); owner != "" {
+		item.Owner = owner
+	}
 
-	_, err = s.urlDatabase.ByURL(URL)
+	existing, err := s.urlDatabase.ByURL(ctx, item.Owner, item.URL)
 	// URL not found is an expected error, otherwise return err
 	if err != errURLNotFound && err != nil {
 		return nil, err
 	}
-	item := &shortURL{URL: URL}
-	item, err = s.urlDatabase.Save(item)
+	// a URL has a single link, limited to a single number of visits
+	if existing != nil && item.MaxVisits != existing.MaxVisits {
+		return nil, errVisitsConflict
+	}
+	// nor redirected by other rules
+	if existing != nil && !reflect.DeepEqual(item.Rules, existing.Rules) {
+		return nil, errRulesConflict
+	}
+	// nor previewed otherwise
+	if existing != nil && item.Preview != existing.Preview {
+		return nil, errPreviewConflict
+	}
+	// nor forwarding paths otherwise
+	if existing != nil && item.Prefix != existing.Prefix {
+		return nil, errPrefixConflict
+	}
+	// nor split otherwise
+	if existing != nil && (!sameVariants(item.Variants, existing.Variants) || item.Sticky != existing.Sticky) {
+		return nil, errVariantsConflict
+	}
+	// nor given other query parameters
+	if existing != nil && (item.Passthrough != existing.Passthrough || !reflect.DeepEqual(item.UTM, existing.UTM)) {
+		return nil, errPassthroughConflict
+	}
+	// the details sent are not dropped silently, those left out are kept
+	if existing != nil && !existing.hasDetails(item) {
+		return nil, errDetailsConflict
+	}
+	// protected links are not shared: comparing passwords here would let
+	// clients guess them past the lockouts of PasswordGuard
+	if existing != nil && (existing.PasswordHash != "" || item.password != "") {
+		return nil, errPasswordConflict
+	}
+	if err := item.setPassword(); err != nil {
+		return nil, err
+	}
+	item, created, err := s.urlDatabase.Save(ctx, item)
 	if err != nil {
 		return nil, err
 	}
+	item.created = created
 	return item, nil
 }
 
-func (s *shortURLService) GetInfo(shortURL string) (mapping *shortURL, err error) {
-	URL, err := s.urlDatabase.ByID(shortURL)
+func (s *shortURLService) GetInfo(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
+	URL, err := s.urlDatabase.ByID(ctx, shortURL)
 	if err != nil {
 		return nil, err
 	}
 	return URL, nil
 }
 
-func (s *shortURLService) Resolve(shortURL string) (mapping *shortURL, err error) {
-	URL, err := s.GetInfo(shortURL)
+func (s *shortURLService) Resolve(ctx context.Context, shortURL string) (mapping *shortURL, err error) {
+	URL, err := s.GetInfo(ctx, shortURL)
 	if err != nil {
 		return nil, err
 	}
-	if s.makeFakeLoad {
-		err = s.generateFakeLoad("5s")
-		if err != nil {
-			return nil, fmt.Errorf("something went wrong generating load %v", err)
+	if URL.MaxVisits > 0 {
+		URL, err = s.resolveLimited(ctx, URL)
+	} else if err = s.urlDatabase.IncrementVisits(ctx, URL.ID); err == nil {
+		URL.VisitsCounter++
+	}
+	if err != nil {
+		return nil, err
+	}
+	return URL, s.resolveVariant(ctx, URL)
+}
+
+// resolveVariant picks the variant of a visit of a split link, unless a rule
+// sends the client elsewhere, and counts it.
+func (s *shortURLService) resolveVariant(ctx context.Context, URL *shortURL) error {
+	c := clientFrom(ctx)
+	if URL.rule(c) != nil {
+		return nil
+	}
+	URL.variant = URL.pickVariant(c)
+	if URL.variant == 0 {
+		return nil
+	}
+	if err := s.urlDatabase.IncrementVariantVisits(ctx, URL.ID, URL.Variants[URL.variant-1].URL); err != nil {
+		return err
+	}
+	URL.Variants = countVariantVisit(URL.Variants, URL.variant-1)
+	return nil
+}
+
+// resolveLimited counts the visit of a link with MaxVisits in the storage,
+// which checks the limit atomically, rather than in a batch.
+func (s *shortURLService) resolveLimited(ctx context.Context, URL *shortURL) (*shortURL, error) {
+	visits, err := s.urlDatabase.IncrementVisitsUpTo(ctx, URL.ID, URL.MaxVisits)
+	if err != nil {
+		return nil, err
+	}
+	URL.VisitsCounter = visits
+	if URL.MaxVisits == 1 {
+		// a concurrent visit may have been first to delete it
+		if err := s.urlDatabase.Delete(ctx, URL.ID); err != nil && err != errURLNotFound {
+			return nil, err
 		}
 	}
-	URL.VisitsCounter++
 	return URL, nil
 }
+
+func (s *shortURLService) List(ctx context.Context, q *listQuery) (*listPage, error) {
+	if q.SortBy == "" {
+		q.SortBy = sortByCreation
+	}
+	if q.SortBy != sortByCreation && q.SortBy != sortByVisits {
+		return nil, errInvalidListQuery
+	}
+	if q.Limit <= 0 {
+		q.Limit = defaultListLimit
+	}
+	if q.Limit > maxListLimit {
+		q.Limit = maxListLimit
+	}
+	if owner := ownerFrom(ctx); owner != "" {
+		q.Owner = owner
+	}
+	return s.urlDatabase.List(ctx, q)
+}
+
+func (s *shortURLService) Update(ctx context.Context, shortURL string, u *linkUpdate) (mapping *shortURL, err error) {
+	m, err := s.owned(ctx, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	updated := *m
+	if u.Preview != nil {
+		updated.Preview = *u.Preview
+	}
+	if u.Title != nil {
+		updated.Title = *u.Title
+	}
+	if u.Tags != nil {
+		updated.Tags = *u.Tags
+	}
+	if u.Metadata != nil {
+		updated.Metadata = *u.Metadata
+	}
+	if u.Rules != nil {
+		updated.Rules = *u.Rules
+	}
+	if u.Variants != nil {
+		updated.Variants = *u.Variants
+	}
+	if u.Sticky != nil {
+		updated.Sticky = *u.Sticky
+	}
+	if u.Passthrough != nil {
+		updated.Passthrough = *u.Passthrough
+	}
+	if u.UTM != nil {
+		updated.UTM = u.UTM
+	}
+	if u.Prefix != nil {
+		updated.Prefix = *u.Prefix
+	}
+	if err := updated.normalize(); err != nil {
+		return nil, err
+	}
+	keepVariantVisits(updated.Variants, m.Variants)
+	if err := s.urlDatabase.Update(ctx, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// owned returns a shortURL the caller may change: the links of other owners
+// are not found for callers authenticated with an API key.
+func (s *shortURLService) owned(ctx context.Context, shortURL string) (*shortURL, error) {
+	m, err := s.urlDatabase.ByID(ctx, shortURL)
+	if err != nil {
+		return nil, err
+	}
+	if owner := ownerFrom(ctx); owner != "" && m.Owner != owner {
+		return nil, errURLNotFound
+	}
+	return m, nil
+}
@@ -0,0 +1,137 @@
+package urlshortener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg"
+)
+
+// Shortifying the URL of a protected link must not tell whether a password
+// is the right one.
+func TestShortifyProtectedConflict(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewInMemoryStorage())
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a", password: "right"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pass := range []string{"right", "wrong", ""} {
+		if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a", password: pass}); err != errPasswordConflict {
+			t.Errorf("password %q: %v, want %v", pass, err, errPasswordConflict)
+		}
+	}
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/b", password: "new"}); err != errPasswordConflict {
+		t.Errorf("protecting a shortened URL: %v, want %v", err, errPasswordConflict)
+	}
+}
+
+func TestShortifyConflicts(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewInMemoryStorage())
+	if _, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a", Passthrough: true, UTM: &utmParams{Source: "mail"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		item *shortURL
+		want error
+	}{
+		{&shortURL{Passthrough: true, UTM: &utmParams{Source: " mail "}}, nil},
+		{&shortURL{UTM: &utmParams{Source: "mail"}}, errPassthroughConflict},
+		{&shortURL{Passthrough: true}, errPassthroughConflict},
+		{&shortURL{Passthrough: true, UTM: &utmParams{Source: "web"}}, errPassthroughConflict},
+		{&shortURL{Passthrough: true, UTM: &utmParams{Source: "mail"}, MaxVisits: 3}, errVisitsConflict},
+		{&shortURL{Passthrough: true, UTM: &utmParams{Source: "mail"}, Preview: true}, errPreviewConflict},
+		{&shortURL{Passthrough: true, UTM: &utmParams{Source: "mail"}, Prefix: true}, errPrefixConflict},
+	} {
+		test.item.URL = "https://example.com/a"
+		if _, err := s.Shortify(ctx, test.item); err != test.want {
+			t.Errorf("%+v: %v, want %v", test.item, err, test.want)
+		}
+	}
+}
+
+func TestShortifyDetailsConflict(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(NewInMemoryStorage())
+	m, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a", Title: "A", Tags: []string{"x"}, Metadata: map[string]string{"k": "v"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		item *shortURL
+		want error
+	}{
+		{&shortURL{}, nil},
+		{&shortURL{Title: " A ", Tags: []string{"x", "x"}}, nil},
+		{&shortURL{Title: "B"}, errDetailsConflict},
+		{&shortURL{Tags: []string{"y"}}, errDetailsConflict},
+		{&shortURL{Metadata: map[string]string{"k": "w"}}, errDetailsConflict},
+	} {
+		test.item.URL = "https://example.com/a"
+		got, err := s.Shortify(ctx, test.item)
+		if err != test.want {
+			t.Errorf("%+v: %v, want %v", test.item, err, test.want)
+		}
+		if err == nil && got.ID != m.ID {
+			t.Errorf("%+v: link %d, want %d", test.item, got.ID, m.ID)
+		}
+	}
+}
+
+// Concurrent visits of a link with a maximum number of visits, behind the
+// cache and the visit batcher, are only allowed up to it.
+func TestResolveMaxVisitsRace(t *testing.T) {
+	ctx := context.Background()
+	for _, max := range []uint64{1, 5} {
+		db := NewVisitBatcher(NewCachedStorage(NewInMemoryStorage(), 10, time.Minute, time.Minute), time.Hour, 100)
+		s := NewService(db)
+		m, err := s.Shortify(ctx, &shortURL{URL: "https://example.com/a", MaxVisits: max})
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := base62.Encode(m.ID)
+		var (
+			wg       sync.WaitGroup
+			mtx      sync.Mutex
+			resolved []uint64
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m, err := s.Resolve(ctx, code)
+				if err != nil {
+					// a single-use link is gone after its visit
+					if err != errLinkExhausted && err != errURLNotFound {
+						t.Error(err)
+					}
+					return
+				}
+				mtx.Lock()
+				resolved = append(resolved, m.VisitsCounter)
+				mtx.Unlock()
+			}()
+		}
+		wg.Wait()
+		if _, err := s.GetInfo(ctx, code); max == 1 && err != errURLNotFound {
+			t.Errorf("single-use link still found after its visit: %v", err)
+		}
+		db.Close()
+		if uint64(len(resolved)) != max {
+			t.Errorf("max %d: %d visits allowed", max, len(resolved))
+		}
+		seen := map[uint64]bool{}
+		for _, n := range resolved {
+			if n < 1 || n > max || seen[n] {
+				t.Errorf("max %d: visits counted %v", max, resolved)
+				break
+			}
+			seen[n] = true
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package urlshortener
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	valid "github.com/asaskevich/govalidator"
+)
+
+var (
+	errInvalidVariants  = errors.New("Invalid split destinations")
+	errVariantsConflict = errors.New("This URL is already shortened with other split destinations")
+)
+
+const (
+	maxVariants      = 10
+	maxVariantWeight = 10000
+	// variantCookie remembers the variant of a sticky link, it is scoped to
+	// the path of the link
+	variantCookie    = "variant"
+	variantCookieAge = 30 * 24 * time.Hour
+)
+
+// linkVariant is one of the destinations visits of a split link are shared
+// among, in proportion to their weights.
+type linkVariant struct {
+	URL    string `json:"url"`
+	Weight uint32 `json:"weight"`
+	// Visits are counted by URL, they survive changes of the weights
+	Visits uint64 `json:"visits"`
+}
+
+// storedVariant is a linkVariant as stored with its link, its visits are
+// counted apart.
+type storedVariant struct {
+	URL    string `json:"url"`
+	Weight uint32 `json:"weight"`
+}
+
+// marshalVariants encodes variants without their visits, "[]" if none.
+func marshalVariants(variants []linkVariant) (string, error) {
+	stored := make([]storedVariant, 0, len(variants))
+	for _, v := range variants {
+		stored = append(stored, storedVariant{URL: v.URL, Weight: v.Weight})
+	}
+	b, err := json.Marshal(stored)
+	return string(b), err
+}
+
+// unmarshalVariants decodes what marshalVariants encoded, nil if empty.
+func unmarshalVariants(s string) ([]linkVariant, error) {
+	var stored []storedVariant
+	if err := json.Unmarshal([]byte(s), &stored); err != nil {
+		return nil, err
+	}
+	var variants []linkVariant
+	for _, v := range stored {
+		variants = append(variants, linkVariant{URL: v.URL, Weight: v.Weight})
+	}
+	return variants, nil
+}
+
+// normalizeVariants validates the destinations of a split link, which has
+// at least two of them.
+func normalizeVariants(variants []linkVariant) ([]linkVariant, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return nil, errInvalidVariants
+	}
+	seen := map[string]bool{}
+	normalized := make([]linkVariant, 0, len(variants))
+	for _, v := range variants {
+		if !valid.IsURL(v.URL) || seen[v.URL] || v.Weight == 0 || v.Weight > maxVariantWeight {
+			return nil, errInvalidVariants
+		}
+		seen[v.URL] = true
+		// visits are counted by the storage only
+		normalized = append(normalized, linkVariant{URL: v.URL, Weight: v.Weight})
+	}
+	return normalized, nil
+}
+
+// sameVariants reports whether a and b split visits alike, whatever their
+// visits.
+func sameVariants(a, b []linkVariant) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].URL != b[i].URL || a[i].Weight != b[i].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+// keepVariantVisits copies the visits of the variants in old to those of
+// variants with the same URL.
+func keepVariantVisits(variants, old []linkVariant) {
+	for i := range variants {
+		for _, o := range old {
+			if o.URL == variants[i].URL {
+				variants[i].Visits = o.Visits
+			}
+		}
+	}
+}
+
+// countVariantVisit returns a copy of variants with a visit of the i-th.
+func countVariantVisit(variants []linkVariant, i int) []linkVariant {
+	counted := append([]linkVariant(nil), variants...)
+	counted[i].Visits++
+	return counted
+}
+
+// pickVariant chooses the variant of a visit, the one the client stuck to if
+// the link is sticky. It returns the index of the variant plus one, 0 if the
+// link is not split.
+func (m *shortURL) pickVariant(c client) int {
+	if len(m.Variants) == 0 {
+		return 0
+	}
+	if m.Sticky && c.variant != "" {
+		for i, v := range m.Variants {
+			if variantKey(v.URL) == c.variant {
+				return i + 1
+			}
+		}
+	}
+	var total int
+	for _, v := range m.Variants {
+		total += int(v.Weight)
+	}
+	n := rand.Intn(total)
+	for i, v := range m.Variants {
+		if n < int(v.Weight) {
+			return i + 1
+		}
+		n -= int(v.Weight)
+	}
+	return len(m.Variants)
+}
+
+// variantKey identifies a variant in the cookies of clients by its URL, so
+// they keep it when the variants are reordered, added or removed. The URL
+// itself is not revealed.
+func variantKey(URL string) string {
+	sum := sha256.Sum256([]byte(URL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// variantFromCookie returns the key of the variant a client stuck to, empty
+// if none.
+func variantFromCookie(r *http.Request) string {
+	cookie, err := r.Cookie(variantCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// setVariantCookie sticks the client to the variant of key on the link at
+// path.
+func setVariantCookie(w http.ResponseWriter, path string, key string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookie,
+		Value:    key,
+		Path:     path,
+		MaxAge:   int(variantCookieAge / time.Second),
+		HttpOnly: true,
+	})
+}
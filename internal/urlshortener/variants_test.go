@@ -0,0 +1,40 @@
+package urlshortener
+
+import (
+	"net/http"
+	"testing"
+)
+
+// Clients stick to the URL of their variant, wherever it moves.
+func TestStickyVariantSurvivesUpdates(t *testing.T) {
+	h := newTestHandler(t, nil, NewInMemoryStorage(), "")
+	code := shortCode(t, serve(h, "POST", "/", `{"url": "https://example.com/a", "sticky": true, "variants": [
+		{"url": "https://example.com/b", "weight": 1}, {"url": "https://example.com/c", "weight": 1}]}`))
+	w := serve(h, "GET", "/"+code, "")
+	dest := w.Header().Get("Location")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != variantCookie {
+		t.Fatalf("cookies %v, want the variant", cookies)
+	}
+	cookie := cookies[0].Name + "=" + cookies[0].Value
+
+	// the variant of the client moves last, behind a new one
+	other := "https://example.com/b"
+	if dest == other {
+		other = "https://example.com/c"
+	}
+	w = serve(h, "PATCH", "/links/"+code, `{"variants": [
+		{"url": "`+other+`", "weight": 1}, {"url": "https://example.com/d", "weight": 1}, {"url": "`+dest+`", "weight": 1}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	for i := 0; i < 5; i++ {
+		w = serve(h, "GET", "/"+code, "", "Cookie", cookie)
+		if got := w.Header().Get("Location"); got != dest {
+			t.Fatalf("visit %d redirected to %s, want %s", i, got, dest)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("visit %d set the cookie again", i)
+		}
+	}
+}
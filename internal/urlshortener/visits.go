@@ -0,0 +1,168 @@
+package urlshortener
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// visitStats are published at /debug/vars.
+var visitStats = expvar.NewMap("visit_batcher")
+
+// visitBatcher takes visit increments off the redirect path: they are summed
+// in memory and written to the storage every interval, or sooner once size
+// visits are pending. Reads lag behind by up to one interval.
+//
+// Pending visits are flushed by Close, so only a crash loses them: at most
+// one interval or size visits, whichever comes first. A failed flush keeps
+// its visits for the next one, tried after a backoff doubling up to
+// visitMaxBackoff. Meanwhile visits of links without pending visits are
+// dropped once maxLinks have some. The visits of variants and of links with
+// a maximum are written right away.
+type visitBatcher struct {
+	shortURLStorage
+
+	size     int
+	maxLinks int
+
+	mtx sync.Mutex
+	// pending holds the visits of each tenant by link ID
+	pending map[string]map[uint64]uint64
+	count   int
+	links   int
+
+	full chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// visitMaxBackoff bounds the delay between flushes failing in a row.
+const visitMaxBackoff = time.Minute
+
+// NewVisitBatcher buffers the visits of next, flushing them every interval
+// or once size visits are pending. Up to 100 times size links keep pending
+// visits while the storage fails.
+func NewVisitBatcher(next shortURLStorage, interval time.Duration, size int) shortURLStorage {
+	b := &visitBatcher{
+		shortURLStorage: next,
+		size:            size,
+		maxLinks:        100 * size,
+		pending:         map[string]map[uint64]uint64{},
+		full:            make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	visitStats.Set("pending", expvar.Func(func() interface{} {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		return b.count
+	}))
+	go b.loop(interval)
+	return b
+}
+
+func (b *visitBatcher) IncrementVisits(ctx context.Context, id uint64) error {
+	b.mtx.Lock()
+	b.add(tenantFrom(ctx), id, 1)
+	full := b.count >= b.size
+	b.mtx.Unlock()
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+			// a flush is already requested
+		}
+	}
+	return nil
+}
+
+// add adds n pending visits to a link, b.mtx is held.
+func (b *visitBatcher) add(tenant string, id, n uint64) {
+	batch := b.pending[tenant]
+	if batch == nil {
+		batch = map[uint64]uint64{}
+		b.pending[tenant] = batch
+	}
+	if _, ok := batch[id]; !ok {
+		if b.links >= b.maxLinks {
+			visitStats.Add("dropped", int64(n))
+			return
+		}
+		b.links++
+	}
+	batch[id] += n
+	b.count += int(n)
+}
+
+func (b *visitBatcher) loop(interval time.Duration) {
+	defer close(b.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var backoff time.Duration
+	var retry time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.stop:
+			return
+		}
+		if time.Now().Before(retry) {
+			continue
+		}
+		if err := b.flush(); err != nil {
+			if backoff *= 2; backoff == 0 {
+				backoff = interval
+			}
+			if backoff > visitMaxBackoff {
+				backoff = visitMaxBackoff
+			}
+			retry = time.Now().Add(backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+func (b *visitBatcher) flush() error {
+	b.mtx.Lock()
+	pending, count := b.pending, b.count
+	b.pending, b.count, b.links = map[string]map[uint64]uint64{}, 0, 0
+	b.mtx.Unlock()
+	if count == 0 {
+		return nil
+	}
+
+	var err error
+	for tenant, batch := range pending {
+		var visits int
+		for _, n := range batch {
+			visits += int(n)
+		}
+		if addErr := b.shortURLStorage.AddVisits(withTenant(context.Background(), tenant), batch); addErr != nil {
+			visitStats.Add("errors", 1)
+			b.mtx.Lock()
+			for id, n := range batch {
+				b.add(tenant, id, n)
+			}
+			b.mtx.Unlock()
+			err = addErr
+			continue
+		}
+		visitStats.Add("batches", 1)
+		visitStats.Add("flushed", int64(visits))
+	}
+	return err
+}
+
+// Close flushes the pending visits and closes the storage.
+func (b *visitBatcher) Close() error {
+	close(b.stop)
+	<-b.done
+	err := b.flush()
+	if closeErr := b.shortURLStorage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
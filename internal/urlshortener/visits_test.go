@@ -0,0 +1,56 @@
+package urlshortener
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failingVisits fails every AddVisits.
+type failingVisits struct {
+	shortURLStorage
+	calls int32
+}
+
+func (f *failingVisits) AddVisits(ctx context.Context, visits map[uint64]uint64) error {
+	atomic.AddInt32(&f.calls, 1)
+	return errors.New("storage down")
+}
+
+func TestVisitBatcherBacksOff(t *testing.T) {
+	ctx := context.Background()
+	backend := &failingVisits{shortURLStorage: NewInMemoryStorage()}
+	b := NewVisitBatcher(backend, time.Hour, 1).(*visitBatcher)
+	defer b.Close()
+
+	b.IncrementVisits(ctx, 1)
+	// wait for the failed flush to put its visit back
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&backend.calls) == 0 || b.pendingLinks() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the first full batch was not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for id := uint64(2); id <= 150; id++ {
+		b.IncrementVisits(ctx, id)
+	}
+	b.IncrementVisits(ctx, 1)
+	time.Sleep(50 * time.Millisecond)
+	if calls := atomic.LoadInt32(&backend.calls); calls != 1 {
+		t.Errorf("%d flushes during the backoff, want 1", calls)
+	}
+	b.mtx.Lock()
+	links, count := b.links, b.count
+	b.mtx.Unlock()
+	if links != 100 || count != 101 {
+		t.Errorf("%d links and %d visits pending, want 100 and 101", links, count)
+	}
+}
+
+func (b *visitBatcher) pendingLinks() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.links
+}
@@ -0,0 +1,602 @@
+package urlshortener
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/trace"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidWebhook  = errors.New("Invalid webhook")
+	errWebhookNotFound = errors.New("Webhook not found")
+)
+
+// Events derived from link.visited for webhooks.
+const (
+	eventLinkFirstClick = "link.first_click"
+	eventLinkMilestone  = "link.milestone"
+)
+
+var webhookEvents = map[string]bool{
+	eventLinkCreated:    true,
+	eventLinkUpdated:    true,
+	eventLinkDeleted:    true,
+	eventLinkExpired:    true,
+	eventLinkFirstClick: true,
+	eventLinkMilestone:  true,
+}
+
+const (
+	webhookMaxAttempts = 8
+	webhookMinBackoff  = time.Second
+	webhookMaxBackoff  = 10 * time.Minute
+	// webhookMaxPending deliveries are queued, newer events are dropped
+	webhookMaxPending = 10000
+	// webhookLogSize finished deliveries are kept for the admin API
+	webhookLogSize = 200
+)
+
+// Webhook is an endpoint notified of link events. Each payload is signed
+// with Secret, the X-Webhook-Signature header holds "sha256=" followed by
+// the hex HMAC-SHA256 of the body.
+type Webhook struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	// Events the webhook is subscribed to, all of them if empty
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// validate also resolves the host of the URL, webhooks may only target
+// public addresses.
+func (h *Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errInvalidWebhook
+	}
+	if _, err := publicAddrs(context.Background(), u.Hostname()); err != nil {
+		return errInvalidWebhook
+	}
+	for _, e := range h.Events {
+		if !webhookEvents[e] {
+			return errInvalidWebhook
+		}
+	}
+	return nil
+}
+
+func (h *Webhook) subscribed(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Milestone uint64    `json:"milestone,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Link      eventLink `json:"link"`
+}
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	Webhook     string          `json:"webhook"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt,omitempty"`
+	LastCode    int             `json:"lastCode,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// webhookState is what is persisted between restarts.
+type webhookState struct {
+	Webhooks []*Webhook         `json:"webhooks"`
+	Queue    []*webhookDelivery `json:"queue"`
+	Log      []*webhookDelivery `json:"log"`
+	// Milestones is the highest milestone notified per link, so lagging
+	// visit counters don't notify twice. Links are keyed by ID, prefixed by
+	// "<tenant>/" outside the default tenant.
+	Milestones map[string]uint64 `json:"milestones"`
+}
+
+// Webhooks is a Sink notifying registered endpoints of link events.
+// Deliveries are queued and sent by a single worker, failed ones are retried
+// with an exponential backoff. The webhooks, the queue and the delivery log
+// are persisted in a JSON file, if any.
+//
+// Each replica notifies the events it sees, sharing the state file between
+// replicas is not supported.
+type Webhooks struct {
+	path       string
+	milestones []uint64
+	client     *http.Client
+	tracer     *trace.Tracer
+	logger     log.Logger
+
+	mtx   sync.Mutex
+	state webhookState
+	// saveMtx orders the writes of the state file
+	saveMtx sync.Mutex
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWebhooks loads the state saved in path, if not empty, and starts
+// delivering. Visit counts reaching one of milestones are notified. Each
+// delivery attempt is traced with tracer, which may be nil.
+func NewWebhooks(path string, milestones []uint64, tracer *trace.Tracer, logger log.Logger) (*Webhooks, error) {
+	w := &Webhooks{
+		path:       path,
+		milestones: append([]uint64(nil), milestones...),
+		client:     newPublicClient(10 * time.Second),
+		tracer:     tracer,
+		logger:     logger,
+		state:      webhookState{Milestones: map[string]uint64{}},
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	sort.Slice(w.milestones, func(i, j int) bool { return w.milestones[i] < w.milestones[j] })
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &w.state); err != nil {
+				return nil, err
+			}
+			if w.state.Milestones == nil {
+				w.state.Milestones = map[string]uint64{}
+			}
+		}
+	}
+	go w.loop()
+	return w, nil
+}
+
+// Close stops delivering, pending deliveries are resumed on the next start.
+func (w *Webhooks) Close() error {
+	close(w.stop)
+	<-w.done
+	return w.save()
+}
+
+func (w *Webhooks) save() error {
+	if w.path == "" {
+		return nil
+	}
+	w.saveMtx.Lock()
+	defer w.saveMtx.Unlock()
+	w.mtx.Lock()
+	data, err := json.Marshal(&w.state)
+	w.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := w.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.path)
+}
+
+func (w *Webhooks) saveOrLog() {
+	if err := w.save(); err != nil {
+		w.logger.Log("err", err)
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Register adds a webhook, a secret is generated if none is given.
+func (w *Webhooks) Register(h Webhook) (*Webhook, error) {
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	h.ID = randomID()
+	if h.Secret == "" {
+		h.Secret = randomID() + randomID()
+	}
+	h.CreatedAt = time.Now().UTC()
+	w.mtx.Lock()
+	w.state.Webhooks = append(w.state.Webhooks, &h)
+	w.mtx.Unlock()
+	w.saveOrLog()
+	return &h, nil
+}
+
+// Unregister removes a webhook and drops its pending deliveries.
+func (w *Webhooks) Unregister(id string) error {
+	w.mtx.Lock()
+	found := false
+	hooks := w.state.Webhooks[:0]
+	for _, h := range w.state.Webhooks {
+		if h.ID == id {
+			found = true
+			continue
+		}
+		hooks = append(hooks, h)
+	}
+	w.state.Webhooks = hooks
+	queue := w.state.Queue[:0]
+	for _, d := range w.state.Queue {
+		if d.Webhook != id {
+			queue = append(queue, d)
+		}
+	}
+	w.state.Queue = queue
+	w.mtx.Unlock()
+	if !found {
+		return errWebhookNotFound
+	}
+	w.saveOrLog()
+	return nil
+}
+
+// webhooks returns the registered webhooks without their secrets.
+func (w *Webhooks) webhooks() []Webhook {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	hooks := make([]Webhook, len(w.state.Webhooks))
+	for i, h := range w.state.Webhooks {
+		hooks[i] = *h
+		hooks[i].Secret = ""
+	}
+	return hooks
+}
+
+func (w *Webhooks) deliveries() (pending, log []webhookDelivery) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	pending = make([]webhookDelivery, 0, len(w.state.Queue))
+	log = make([]webhookDelivery, 0, len(w.state.Log))
+	for _, d := range w.state.Queue {
+		pending = append(pending, *d)
+	}
+	for _, d := range w.state.Log {
+		log = append(log, *d)
+	}
+	return pending, log
+}
+
+// notify queues a delivery of the event to every subscribed webhook.
+func (w *Webhooks) notify(event string, e Event, milestone uint64) {
+	payload, err := json.Marshal(webhookEvent{
+		ID:        e.ID,
+		Type:      event,
+		Time:      e.Time,
+		Milestone: milestone,
+		Tenant:    e.Tenant,
+		Link:      e.Link,
+	})
+	if err != nil {
+		w.logger.Log("event", event, "err", err)
+		return
+	}
+	now := time.Now().UTC()
+	queued := 0
+	w.mtx.Lock()
+	for _, h := range w.state.Webhooks {
+		if !h.subscribed(event) {
+			continue
+		}
+		if len(w.state.Queue) >= webhookMaxPending {
+			w.logger.Log("event", event, "webhook", h.ID, "err", "queue full, event dropped")
+			continue
+		}
+		w.state.Queue = append(w.state.Queue, &webhookDelivery{
+			ID:          randomID(),
+			Webhook:     h.ID,
+			Event:       event,
+			Payload:     payload,
+			Status:      deliveryPending,
+			NextAttempt: now,
+			UpdatedAt:   now,
+		})
+		queued++
+	}
+	w.mtx.Unlock()
+	if queued == 0 {
+		return
+	}
+	w.saveOrLog()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Publish notifies the webhooks subscribed to e. Visits are only notified
+// on the first click and when reaching a milestone.
+func (w *Webhooks) Publish(e Event) error {
+	switch e.Type {
+	case eventLinkVisited:
+		w.visited(e)
+	case eventLinkDeleted, eventLinkExpired:
+		// no more visits to notify
+		w.mtx.Lock()
+		delete(w.state.Milestones, milestoneKey(e))
+		w.mtx.Unlock()
+		w.notify(e.Type, e, 0)
+	default:
+		w.notify(e.Type, e, 0)
+	}
+	return nil
+}
+
+// visited notifies the first click and the milestones reached by a visit.
+func (w *Webhooks) visited(e Event) {
+	visits := e.link.VisitsCounter
+	key := milestoneKey(e)
+	w.mtx.Lock()
+	last := w.state.Milestones[key]
+	var reached []uint64
+	if visits >= 1 && last < 1 {
+		reached = append(reached, 1)
+	}
+	for _, milestone := range w.milestones {
+		if milestone > last && milestone <= visits && milestone > 1 {
+			reached = append(reached, milestone)
+		}
+	}
+	if len(reached) > 0 {
+		w.state.Milestones[key] = reached[len(reached)-1]
+	}
+	w.mtx.Unlock()
+	for _, milestone := range reached {
+		if milestone == 1 {
+			w.notify(eventLinkFirstClick, e, 0)
+			continue
+		}
+		w.notify(eventLinkMilestone, e, milestone)
+	}
+}
+
+// milestoneKey identifies the link of e in the milestones state, the keys
+// of the default tenant are the plain IDs used before tenants existed.
+func milestoneKey(e Event) string {
+	id := strconv.FormatUint(e.link.ID, 10)
+	if e.Tenant == "" {
+		return id
+	}
+	return e.Tenant + "/" + id
+}
+
+func (w *Webhooks) loop() {
+	defer close(w.done)
+	for {
+		d, h, wait := w.next()
+		if d != nil {
+			w.attempt(d, h)
+			continue
+		}
+		select {
+		case <-w.wake:
+		case <-time.After(wait):
+		case <-w.stop:
+			return
+		}
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+	}
+}
+
+// next returns the delivery due first, or how long to wait for it.
+func (w *Webhooks) next() (*webhookDelivery, Webhook, time.Duration) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	now := time.Now()
+	wait := time.Hour
+	for _, d := range w.state.Queue {
+		if until := d.NextAttempt.Sub(now); until > 0 {
+			if until < wait {
+				wait = until
+			}
+			continue
+		}
+		for _, h := range w.state.Webhooks {
+			if h.ID == d.Webhook {
+				return d, *h, 0
+			}
+		}
+	}
+	return nil, Webhook{}, wait
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhooks) attempt(d *webhookDelivery, h Webhook) {
+	code, err := w.post(d, h)
+
+	w.mtx.Lock()
+	d.Attempts++
+	d.LastCode = code
+	d.LastError = ""
+	d.UpdatedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		d.Status = deliveryDelivered
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = deliveryFailed
+		d.LastError = err.Error()
+	default:
+		d.LastError = err.Error()
+		d.NextAttempt = d.UpdatedAt.Add(webhookBackoff(d.Attempts))
+	}
+	if d.Status != deliveryPending {
+		w.finish(d)
+	}
+	w.mtx.Unlock()
+	w.saveOrLog()
+}
+
+// webhookBackoff doubles the delay after each attempt, with up to 20% of
+// jitter so failed deliveries don't retry in lockstep.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := float64(webhookMinBackoff) * math.Pow(2, float64(attempts-1))
+	if backoff > float64(webhookMaxBackoff) {
+		backoff = float64(webhookMaxBackoff)
+	}
+	return time.Duration(backoff * (1 + 0.2*mathrand.Float64()))
+}
+
+// finish moves d from the queue to the log, w.mtx must be held.
+func (w *Webhooks) finish(d *webhookDelivery) {
+	for i, q := range w.state.Queue {
+		if q == d {
+			w.state.Queue = append(w.state.Queue[:i], w.state.Queue[i+1:]...)
+			break
+		}
+	}
+	w.state.Log = append(w.state.Log, d)
+	if n := len(w.state.Log); n > webhookLogSize {
+		w.state.Log = append([]*webhookDelivery(nil), w.state.Log[n-webhookLogSize:]...)
+	}
+}
+
+func (w *Webhooks) post(d *webhookDelivery, h Webhook) (code int, err error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req, span := startClientSpan(w.tracer, "webhook."+d.Event, req)
+	defer func() { finishClientSpan(span, code, err) }()
+	span.SetAttribute("webhook.id", h.ID)
+	span.SetAttribute("webhook.delivery", d.ID)
+	span.SetAttribute("webhook.attempt", d.Attempts+1)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "url-shortener-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID)
+	req.Header.Set("X-Webhook-Signature", sign(h.Secret, d.Payload))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	return resp.StatusCode, nil
+}
+
+type webhookRequest struct {
+	id      string
+	webhook Webhook
+}
+
+type webhookResponse struct {
+	Webhook *Webhook `json:"webhook,omitempty"`
+	Err     error    `json:"error,omitempty"`
+}
+
+func (r webhookResponse) error() error { return r.Err }
+
+type webhookListResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type webhookDeliveriesResponse struct {
+	Pending []webhookDelivery `json:"pending"`
+	Log     []webhookDelivery `json:"log"`
+}
+
+func makeWebhookListEndpoint(w *Webhooks) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return webhookListResponse{Webhooks: w.webhooks()}, nil
+	}
+}
+
+func makeWebhookRegisterEndpoint(w *Webhooks) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(webhookRequest)
+		h, err := w.Register(req.webhook)
+		return webhookResponse{Webhook: h, Err: err}, nil
+	}
+}
+
+func makeWebhookUnregisterEndpoint(w *Webhooks) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(webhookRequest)
+		return webhookResponse{Err: w.Unregister(req.id)}, nil
+	}
+}
+
+func makeWebhookDeliveriesEndpoint(w *Webhooks) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		pending, log := w.deliveries()
+		return webhookDeliveriesResponse{Pending: pending, Log: log}, nil
+	}
+}
+
+func decodeWebhookRequest(c context.Context, r *http.Request) (interface{}, error) {
+	req := webhookRequest{id: mux.Vars(r)["id"]}
+	if r.Method == "DELETE" {
+		return req, nil
+	}
+	var t struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		return nil, errInvalidWebhook
+	}
+	req.webhook = Webhook{URL: t.URL, Secret: t.Secret, Events: t.Events}
+	return req, nil
+}
@@ -0,0 +1,105 @@
+// Package geoip maps IP addresses to countries with a local database.
+//
+// The database is a CSV file of address ranges, one per line, as published
+// by DB-IP and others in their "country lite" editions:
+//
+//	1.0.0.0,1.0.0.255,AU
+//	2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP
+//
+// Lines starting with # are comments. Ranges must not overlap.
+package geoip
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ipRange struct {
+	start, end net.IP // 16 bytes
+	country    string
+}
+
+// DB is an in-memory copy of a database, safe for concurrent lookups.
+type DB struct {
+	ranges []ipRange
+}
+
+// Open loads the database at path.
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read loads a database from r.
+func Read(r io.Reader) (*DB, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	db := &DB{}
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("geoip: line %d: want start,end,country", line)
+		}
+		start, end := net.ParseIP(strings.TrimSpace(record[0])), net.ParseIP(strings.TrimSpace(record[1]))
+		if start == nil || end == nil {
+			// a header line
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("geoip: line %d: invalid address", line)
+		}
+		start, end = start.To16(), end.To16()
+		if bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("geoip: line %d: range ends before it starts", line)
+		}
+		db.ranges = append(db.ranges, ipRange{start, end, strings.ToUpper(strings.TrimSpace(record[2]))})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	for i := 1; i < len(db.ranges); i++ {
+		if bytes.Compare(db.ranges[i].start, db.ranges[i-1].end) <= 0 {
+			return nil, fmt.Errorf("geoip: ranges starting at %s and %s overlap", db.ranges[i-1].start, db.ranges[i].start)
+		}
+	}
+	return db, nil
+}
+
+// Len returns the number of ranges.
+func (db *DB) Len() int {
+	return len(db.ranges)
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of ip, empty
+// if unknown.
+func (db *DB) Country(ip net.IP) string {
+	if db == nil || ip == nil {
+		return ""
+	}
+	ip = ip.To16()
+	// the first range ending at or after ip is the only one that may hold it
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].end, ip) >= 0
+	})
+	if i < len(db.ranges) && bytes.Compare(db.ranges[i].start, ip) <= 0 {
+		return db.ranges[i].country
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+// Package password hashes passwords with PBKDF2-HMAC-SHA256 (RFC 8018).
+//
+// Hashes are self-describing strings, "pbkdf2-sha256$<iterations>$<salt>$<key>"
+// with the salt and key in unpadded base64, so the cost can be raised later
+// without invalidating the hashes already stored.
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Iterations is the cost of new hashes.
+const Iterations = 100000
+
+const (
+	scheme  = "pbkdf2-sha256"
+	saltLen = 16
+	keyLen  = 32
+)
+
+// ErrMalformed is returned by Verify for hashes not produced by Hash.
+var ErrMalformed = errors.New("password: malformed hash")
+
+var encoding = base64.RawStdEncoding
+
+// Hash returns the hash of password with a random salt.
+func Hash(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, Iterations, keyLen)
+	return scheme + "$" + strconv.Itoa(Iterations) + "$" + encoding.EncodeToString(salt) + "$" + encoding.EncodeToString(key), nil
+}
+
+// Verify reports whether password matches hash, in constant time.
+func Verify(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != scheme {
+		return false, ErrMalformed
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false, ErrMalformed
+	}
+	salt, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return false, ErrMalformed
+	}
+	key, err := encoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false, ErrMalformed
+	}
+	return hmac.Equal(key, pbkdf2([]byte(password), salt, iterations, len(key))), nil
+}
+
+// pbkdf2 derives a keyLen bytes key, block by block: each block is the XOR
+// of iterations chained HMACs of the salt followed by the block number.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	size := prf.Size()
+	var (
+		key []byte
+		buf [4]byte
+		u   []byte
+	)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], block)
+		prf.Write(buf[:])
+		u = prf.Sum(u[:0])
+		t := make([]byte, size)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,529 @@
+// Package qrcode encodes text as a QR Code symbol (ISO/IEC 18004, model 2).
+//
+// Only byte mode segments are produced, which is enough for URLs. The
+// implementation follows the reference algorithm: pick the smallest version
+// that fits, add Reed-Solomon error correction, place the codewords and keep
+// the mask with the lowest penalty score.
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// Level is the error correction level of a symbol.
+type Level int
+
+// Error correction levels, from lowest to highest redundancy.
+const (
+	Low      Level = iota // recovers ~7% of the codewords
+	Medium                // recovers ~15% of the codewords
+	Quartile              // recovers ~25% of the codewords
+	High                  // recovers ~30% of the codewords
+)
+
+// ErrTooLong is returned when the text does not fit in a version 40 symbol.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+// ParseLevel converts one of "L", "M", "Q" or "H" to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return Low, nil
+	case "M":
+		return Medium, nil
+	case "Q":
+		return Quartile, nil
+	case "H":
+		return High, nil
+	}
+	return 0, errors.New("qrcode: unknown error correction level " + s)
+}
+
+// formatBits are the two bits encoding each level in the format information.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+var eccCodewordsPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var numErrorCorrectionBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// Code is an encoded QR Code symbol.
+type Code struct {
+	// Size is the number of modules on each side, without quiet zone.
+	Size    int
+	version int
+	level   Level
+	modules [][]bool
+	isFunc  [][]bool
+}
+
+// Encode builds the smallest symbol holding text at the given level.
+func Encode(text string, level Level) (*Code, error) {
+	if level < Low || level > High {
+		return nil, errors.New("qrcode: invalid error correction level")
+	}
+	data := []byte(text)
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if len(data) >= 1<<uint(countBits) {
+			continue
+		}
+		if 4+countBits+8*len(data) <= numDataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	c := &Code{Size: version*4 + 17, version: version, level: level}
+	c.modules = newGrid(c.Size)
+	c.isFunc = newGrid(c.Size)
+	c.drawFunctionPatterns()
+	c.drawCodewords(c.addECCAndInterleave(c.dataCodewords(data)))
+
+	best, minPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); minPenalty < 0 || p < minPenalty {
+			best, minPenalty = mask, p
+		}
+		c.applyMask(mask) // masks are XOR, applying twice undoes it
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c, nil
+}
+
+// Black reports whether the module at column x and row y is dark. Coordinates
+// outside the symbol are light, which makes the quiet zone free.
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && y >= 0 && x < c.Size && y < c.Size && c.modules[y][x]
+}
+
+func newGrid(size int) [][]bool {
+	g := make([][]bool, size)
+	for i := range g {
+		g[i] = make([]bool, size)
+	}
+	return g
+}
+
+func numRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func numDataCodewords(version int, level Level) int {
+	return numRawDataModules(version)/8 -
+		eccCodewordsPerBlock[level][version]*numErrorCorrectionBlocks[level][version]
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) appendBits(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (val>>uint(i))&1 != 0)
+	}
+}
+
+// dataCodewords builds the byte mode segment padded to the symbol capacity.
+func (c *Code) dataCodewords(data []byte) []byte {
+	countBits := 8
+	if c.version >= 10 {
+		countBits = 16
+	}
+	var bb bitBuffer
+	bb.appendBits(0x4, 4)
+	bb.appendBits(len(data), countBits)
+	for _, b := range data {
+		bb.appendBits(int(b), 8)
+	}
+
+	capacity := numDataCodewords(c.version, c.level) * 8
+	terminator := capacity - len(bb)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bb.appendBits(0, terminator)
+	bb.appendBits(0, (8-len(bb)%8)%8)
+	for pad := 0xEC; len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.appendBits(pad, 8)
+	}
+
+	result := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			result[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+	return result
+}
+
+// addECCAndInterleave splits data into blocks, appends the Reed-Solomon
+// codewords to each one and interleaves them.
+func (c *Code) addECCAndInterleave(data []byte) []byte {
+	numBlocks := numErrorCorrectionBlocks[c.level][c.version]
+	blockECCLen := eccCodewordsPerBlock[c.level][c.version]
+	rawCodewords := numRawDataModules(c.version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(blockECCLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		n := shortBlockLen - blockECCLen
+		if i >= numShortBlocks {
+			n++
+		}
+		dat := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := reedSolomonRemainder(dat, divisor)
+		if i < numShortBlocks {
+			dat = append(dat, 0)
+		}
+		blocks[i] = append(dat, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			// skip the padding byte of short blocks
+			if i != shortBlockLen-blockECCLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunc[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinderPattern(3, 3)
+	c.drawFinderPattern(c.Size-4, 3)
+	c.drawFinderPattern(3, c.Size-4)
+
+	pos := c.alignmentPatternPositions()
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			// the corners are taken by the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignmentPattern(pos[i], pos[j])
+		}
+	}
+
+	// reserve the format area, the real bits are drawn once a mask is chosen
+	c.drawFormatBits(0)
+	c.drawVersion()
+}
+
+func (c *Code) drawFinderPattern(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignmentPattern(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+func (c *Code) alignmentPatternPositions() []int {
+	if c.version == 1 {
+		return nil
+	}
+	numAlign := c.version/7 + 2
+	step := (c.version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, c.Size-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// formatInfo returns the 15 bits of format information of a symbol: the
+// level and mask, their BCH code and the XOR mask of the standard.
+func formatInfo(level Level, mask int) int {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatInfo(c.level, mask)
+
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+// versionInfo returns the 18 bits of version information of symbols of
+// version 7 and up: the version and its BCH code.
+func versionInfo(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawVersion() {
+	if c.version < 7 {
+		return
+	}
+	bits := versionInfo(c.version)
+	for i := 0; i < 18; i++ {
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords fills the data area in the zigzag order of the standard.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.isFunc[y][x] && i < len(data)*8 {
+					c.modules[y][x] = bit(int(data[i>>3]), 7-i&7)
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.isFunc[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+var finderLike = [][]bool{
+	{true, false, true, true, true, false, true, false, false, false, false},
+	{false, false, false, false, true, false, true, true, true, false, true},
+}
+
+// penalty scores the current modules with the four rules of the standard.
+func (c *Code) penalty() int {
+	result := 0
+	line := make([]bool, c.Size)
+	for _, horizontal := range []bool{true, false} {
+		for a := 0; a < c.Size; a++ {
+			for b := 0; b < c.Size; b++ {
+				if horizontal {
+					line[b] = c.modules[a][b]
+				} else {
+					line[b] = c.modules[b][a]
+				}
+			}
+			result += runPenalty(line) + finderPenalty(line)
+		}
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			color := c.modules[y][x]
+			if color {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size &&
+				color == c.modules[y][x+1] &&
+				color == c.modules[y+1][x] &&
+				color == c.modules[y+1][x+1] {
+				result += 3
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return result + k*10
+}
+
+func runPenalty(line []bool) int {
+	result, run := 0, 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += 3 + run - 5
+		}
+		run = 1
+	}
+	return result
+}
+
+func finderPenalty(line []bool) int {
+	result := 0
+	for _, pattern := range finderLike {
+	next:
+		for i := 0; i+len(pattern) <= len(line); i++ {
+			for j, dark := range pattern {
+				if line[i+j] != dark {
+					continue next
+				}
+			}
+			result += 40
+		}
+	}
+	return result
+}
+
+func bit(x, i int) bool {
+	return (x>>uint(i))&1 != 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
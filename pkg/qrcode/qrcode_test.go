@@ -0,0 +1,158 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The format information of every level and mask, ISO/IEC 18004 table C.1.
+var formatInfoTests = map[Level][8]string{
+	Low:      {"111011111000100", "111001011110011", "111110110101010", "111100010011101", "110011000101111", "110001100011000", "110110001000001", "110100101110110"},
+	Medium:   {"101010000010010", "101000100100101", "101111001111100", "101101101001011", "100010111111001", "100000011001110", "100111110010111", "100101010100000"},
+	Quartile: {"011010101011111", "011000001101000", "011111100110001", "011101000000110", "010010010110100", "010000110000011", "010111011011010", "010101111101101"},
+	High:     {"001011010001001", "001001110111110", "001110011100111", "001100111010000", "000011101100010", "000001001010101", "000110100001100", "000100000111011"},
+}
+
+func TestFormatInfo(t *testing.T) {
+	for level, masks := range formatInfoTests {
+		for mask, want := range masks {
+			if got := formatInfo(level, mask); got != parseBits(t, want) {
+				t.Errorf("formatInfo(%d, %d) = %015b, want %s", level, mask, got, want)
+			}
+		}
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	// ISO/IEC 18004 table D.1
+	for version, want := range map[int]string{
+		7:  "000111110010010100",
+		8:  "001000010110111100",
+		21: "010101011010000011",
+		40: "101000110001101001",
+	} {
+		if got := versionInfo(version); got != parseBits(t, want) {
+			t.Errorf("versionInfo(%d) = %018b, want %s", version, got, want)
+		}
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		data, ecc []byte
+	}{
+		{
+			// ISO/IEC 18004 annex I, "01234567" in a 1-M symbol
+			name: "01234567",
+			data: []byte{16, 32, 12, 86, 97, 128, 236, 17, 236, 17, 236, 17, 236, 17, 236, 17},
+			ecc:  []byte{165, 36, 212, 193, 237, 54, 199, 135, 44, 85},
+		},
+		{
+			name: "HELLO WORLD",
+			data: []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+			ecc:  []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+		},
+	} {
+		if got := reedSolomonRemainder(test.data, reedSolomonDivisor(len(test.ecc))); !bytes.Equal(got, test.ecc) {
+			t.Errorf("%s: error correction codewords %v, want %v", test.name, got, test.ecc)
+		}
+	}
+}
+
+func TestDataCodewords(t *testing.T) {
+	c := &Code{version: 1, level: Medium}
+	// byte mode, 3 bytes, terminator and pad codewords
+	want := []byte{0x40, 0x36, 0x36, 0x16, 0x20, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC}
+	if got := c.dataCodewords([]byte("cab")); !bytes.Equal(got, want) {
+		t.Errorf("data codewords % X, want % X", got, want)
+	}
+}
+
+// A 1-L symbol checked with an independent decoder.
+var symbol = []string{
+	"#######..##...#######",
+	"#.....#..#..#.#.....#",
+	"#.###.#..#.#..#.###.#",
+	"#.###.#.#.##..#.###.#",
+	"#.###.#.#.#...#.###.#",
+	"#.....#...#.#.#.....#",
+	"#######.#.#.#.#######",
+	".........##.#........",
+	"##...###.#.##...##...",
+	"###.##.#.#.#.#...###.",
+	".###..###..#####..##.",
+	"##.###..#....#.####..",
+	"#.###.#...###......#.",
+	"........####....###.#",
+	"#######.#.######..##.",
+	"#.....#.###..##..##.#",
+	"#.###.#...##..####...",
+	"#.###.#..#....###.##.",
+	"#.###.#..############",
+	"#.....#.##.#.#.####..",
+	"#######.#..#..##.#.#.",
+}
+
+func TestEncode(t *testing.T) {
+	c, err := Encode("https://sho.rt/1", Low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Size != len(symbol) {
+		t.Fatalf("size %d, want %d", c.Size, len(symbol))
+	}
+	for y, row := range symbol {
+		var got strings.Builder
+		for x := 0; x < c.Size; x++ {
+			if c.Black(x, y) {
+				got.WriteByte('#')
+			} else {
+				got.WriteByte('.')
+			}
+		}
+		if got.String() != row {
+			t.Errorf("row %2d: %s\n          want %s", y, got.String(), row)
+		}
+	}
+}
+
+func TestEncodeVersion(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		level  Level
+		size   int
+	}{
+		{17, Low, 21},
+		{18, Low, 25},
+		{14, Medium, 21},
+		{7, High, 21},
+		// the character count takes 16 bits from version 10
+		{2953, Low, 177},
+	} {
+		c, err := Encode(strings.Repeat("a", test.length), test.level)
+		if err != nil {
+			t.Errorf("%d bytes at level %d: %v", test.length, test.level, err)
+			continue
+		}
+		if c.Size != test.size {
+			t.Errorf("%d bytes at level %d: size %d, want %d", test.length, test.level, c.Size, test.size)
+		}
+	}
+	if _, err := Encode(strings.Repeat("a", 2954), Low); err != ErrTooLong {
+		t.Errorf("2954 bytes at level L: %v, want %v", err, ErrTooLong)
+	}
+}
+
+func parseBits(t *testing.T, s string) int {
+	t.Helper()
+	n := 0
+	for _, c := range s {
+		n <<= 1
+		if c == '1' {
+			n |= 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// Image renders the symbol with scale pixels per module and a quiet zone of
+// margin modules on every side.
+func (c *Code) Image(scale, margin int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	if margin < 0 {
+		margin = 0
+	}
+	side := (c.Size + 2*margin) * scale
+	img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			if c.Black(x/scale-margin, y/scale-margin) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// PNG encodes the symbol as a PNG image, see Image.
+func (c *Code) PNG(scale, margin int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.Image(scale, margin)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the symbol as an SVG document, see Image.
+func (c *Code) SVG(scale, margin int) []byte {
+	if scale < 1 {
+		scale = 1
+	}
+	if margin < 0 {
+		margin = 0
+	}
+	side := c.Size + 2*margin
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		side*scale, side*scale, side, side)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n")
+	buf.WriteString(`<path fill="#000000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d,%dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString("\"/>\n</svg>\n")
+	return buf.Bytes()
+}
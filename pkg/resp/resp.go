@@ -0,0 +1,324 @@
+// Package resp is a minimal client for servers speaking the Redis
+// serialization protocol (Redis, KeyDB, Dragonfly...).
+//
+// Replies are returned as Go values: simple and bulk strings as string,
+// integers as int64, arrays as []interface{} and null replies as nil. Error
+// replies are returned as Error.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrNil is returned by the typed helpers when the reply is null.
+var ErrNil = errors.New("resp: nil reply")
+
+var errPoolClosed = errors.New("resp: pool closed")
+
+// Options configure the connections of a Pool.
+type Options struct {
+	Password string
+	DB       int
+	// MaxIdle connections are kept open between commands.
+	MaxIdle int
+	Timeout time.Duration
+}
+
+// Pool is a pool of connections to one server, safe for concurrent use.
+type Pool struct {
+	addr string
+	opts Options
+
+	mtx    sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+// NewPool returns a pool of connections to addr, they are opened on demand.
+func NewPool(addr string, opts Options) *Pool {
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 8
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	return &Pool{addr: addr, opts: opts}
+}
+
+// Get returns an idle connection or dials a new one. It must be given back
+// with Put.
+func (p *Pool) Get() (*Conn, error) {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		return nil, errPoolClosed
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mtx.Unlock()
+		return c, nil
+	}
+	p.mtx.Unlock()
+	return p.dial()
+}
+
+// Put gives c back to the pool, broken connections are closed.
+func (p *Pool) Put(c *Conn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if c.err != nil || p.closed || len(p.idle) >= p.opts.MaxIdle {
+		c.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Do runs a single command on a pooled connection.
+func (p *Pool) Do(args ...interface{}) (interface{}, error) {
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Do(args...)
+}
+
+// Close closes the idle connections, connections in use are closed when
+// they are given back.
+func (p *Pool) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+	return nil
+}
+
+func (p *Pool) dial() (*Conn, error) {
+	nc, err := net.DialTimeout("tcp", p.addr, p.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{
+		conn:    nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		timeout: p.opts.Timeout,
+	}
+	if p.opts.Password != "" {
+		if _, err := c.Do("AUTH", p.opts.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if p.opts.DB != 0 {
+		if _, err := c.Do("SELECT", p.opts.DB); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Conn is a single connection, needed for WATCH/MULTI/EXEC sequences. It is
+// not safe for concurrent use.
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	// err is set once the connection is out of sync and must be dropped
+	err error
+}
+
+// Do sends a command and waits for its reply.
+func (c *Conn) Do(args ...interface{}) (interface{}, error) {
+	replies, err := c.Pipeline([][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends all commands before reading their replies. Error replies
+// are returned in place, the error is only set for I/O failures.
+func (c *Conn) Pipeline(cmds [][]interface{}) ([]interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	for _, args := range cmds {
+		if err := c.write(args); err != nil {
+			c.err = err
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		c.err = err
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		reply, err := c.read()
+		if err != nil {
+			c.err = err
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (c *Conn) write(args []interface{}) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = v
+		case []byte:
+			s = string(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case uint64:
+			s = strconv.FormatUint(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("resp: unsupported argument type %T", arg)
+		}
+		if _, err := fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(s), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return Error(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("resp: unknown reply type %q", kind)
+}
+
+// Int converts an integer or numeric string reply.
+func Int(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, fmt.Errorf("resp: unexpected reply %T", reply)
+}
+
+// String converts a string reply.
+func String(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", ErrNil
+	}
+	return "", fmt.Errorf("resp: unexpected reply %T", reply)
+}
+
+// Strings converts an array reply of strings, null items become "".
+func Strings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		if reply == nil {
+			return nil, ErrNil
+		}
+		return nil, fmt.Errorf("resp: unexpected reply %T", reply)
+	}
+	result := make([]string, len(items))
+	for i, item := range items {
+		if s, ok := item.(string); ok {
+			result[i] = s
+		}
+	}
+	return result, nil
+}
+
+// StringMap converts a flat array of field/value pairs, as sent by HGETALL.
+func StringMap(reply interface{}, err error) (map[string]string, error) {
+	values, err := Strings(reply, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(values)%2 != 0 {
+		return nil, errors.New("resp: odd number of items for a map")
+	}
+	result := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		result[values[i]] = values[i+1]
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package resp_test
+
+import (
+	"testing"
+
+	"github.com/friends-of-scalability/url-shortener/pkg/resp"
+	"github.com/friends-of-scalability/url-shortener/pkg/resp/resptest"
+)
+
+func newPool(t *testing.T) (*resp.Pool, func()) {
+	t.Helper()
+	srv, err := resptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := resp.NewPool(srv.Addr, resp.Options{Password: "secret", DB: 1})
+	return pool, func() {
+		pool.Close()
+		srv.Close()
+	}
+}
+
+func TestReplies(t *testing.T) {
+	pool, done := newPool(t)
+	defer done()
+	if n, err := resp.Int(pool.Do("INCRBY", "n", int64(41))); err != nil || n != 41 {
+		t.Errorf("INCRBY: %d, %v", n, err)
+	}
+	if s, err := resp.String(pool.Do("GET", "n")); err != nil || s != "41" {
+		t.Errorf("GET: %q, %v", s, err)
+	}
+	if _, err := resp.String(pool.Do("GET", "missing")); err != resp.ErrNil {
+		t.Errorf("GET of a missing key: %v, want %v", err, resp.ErrNil)
+	}
+	if _, err := pool.Do("HSET", "h", "a", "1", "b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := resp.StringMap(pool.Do("HGETALL", "h"))
+	if err != nil || len(m) != 2 || m["a"] != "1" || m["b"] != "2" {
+		t.Errorf("HGETALL: %v, %v", m, err)
+	}
+	if _, err := pool.Do("HGETALL", "n"); err == nil {
+		t.Error("HGETALL of a string succeeded")
+	} else if _, ok := err.(resp.Error); !ok {
+		t.Errorf("HGETALL of a string: %T, want an error reply", err)
+	}
+	if _, err := pool.Do("ZADD", "z", 1.5, "a", 2, "b", 2, "c"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := resp.Strings(pool.Do("ZREVRANGEBYSCORE", "z", "+inf", "(1.5", "WITHSCORES", "LIMIT", 1, 5))
+	if err != nil || len(got) != 2 || got[0] != "b" || got[1] != "2" {
+		t.Errorf("ZREVRANGEBYSCORE: %v, %v", got, err)
+	}
+	if score, err := pool.Do("ZADD", "z", "XX", "INCR", 1, "missing"); err != nil || score != nil {
+		t.Errorf("ZADD XX INCR of a missing member: %v, %v", score, err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	pool, done := newPool(t)
+	defer done()
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(c)
+	if _, err := c.Do("WATCH", "k"); err != nil {
+		t.Fatal(err)
+	}
+	// another client changes the watched key
+	if _, err := pool.Do("SET", "k", "theirs"); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := c.Pipeline([][]interface{}{{"MULTI"}, {"SET", "k", "mine"}, {"EXEC"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replies[2] != nil {
+		t.Errorf("EXEC after a watched key changed: %v, want a null reply", replies[2])
+	}
+	replies, err = c.Pipeline([][]interface{}{{"MULTI"}, {"SET", "k", "mine"}, {"GET", "k"}, {"EXEC"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, ok := replies[3].([]interface{})
+	if !ok || len(results) != 2 || results[1] != "mine" {
+		t.Errorf("EXEC: %v, want the replies of SET and GET", replies[3])
+	}
+}
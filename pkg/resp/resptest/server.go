@@ -0,0 +1,771 @@
+// Package resptest provides an in-process server speaking the Redis
+// serialization protocol, for tests of code using package resp.
+//
+// It keeps strings, hashes and sorted sets in memory and implements the
+// commands the url-shortener uses, including WATCH/MULTI/EXEC. Every command
+// runs under a single lock, so commands and transactions are atomic as they
+// are on Redis.
+package resptest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Redis server listening on a local port.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mtx     sync.Mutex
+	strs    map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	version map[string]uint64
+	conns   map[net.Conn]bool
+}
+
+// NewServer starts a server on a random local port.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		ln:      ln,
+		strs:    map[string]string{},
+		hashes:  map[string]map[string]string{},
+		zsets:   map[string]map[string]float64{},
+		version: map[string]uint64{},
+		conns:   map[net.Conn]bool{},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mtx.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+}
+
+// Keys returns the keys matching a glob pattern, sorted.
+func (s *Server) Keys(pattern string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.keys(pattern)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mtx.Lock()
+		s.conns[c] = true
+		s.mtx.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+// status is a simple string reply, errReply an error reply and nullArray
+// the reply of an aborted transaction. Other replies are string (bulk),
+// int64, nil (null bulk) and []interface{}.
+type (
+	status    string
+	errReply  string
+	nullArray struct{}
+)
+
+var (
+	statusOK     = status("OK")
+	errSyntax    = errReply("ERR syntax error")
+	errNotInt    = errReply("ERR value is not an integer or out of range")
+	errNotFloat  = errReply("ERR value is not a valid float")
+	errWrongType = errReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// session is the state of a connection.
+type session struct {
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+	// dirty aborts the transaction, a command could not be queued
+	dirty bool
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		s.mtx.Unlock()
+		c.Close()
+	}()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+	sess := &session{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		writeReply(w, s.run(sess, args))
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("resptest: expected a bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case errReply:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case nil:
+		w.WriteString("$-1\r\n")
+	case nullArray:
+		w.WriteString("*-1\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
+
+func (s *Server) run(sess *session, args []string) interface{} {
+	if len(args) == 0 {
+		return errReply("ERR empty command")
+	}
+	name := strings.ToUpper(args[0])
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch name {
+	case "MULTI":
+		if sess.multi {
+			return errReply("ERR MULTI calls can not be nested")
+		}
+		sess.multi, sess.queued, sess.dirty = true, nil, false
+		return statusOK
+	case "EXEC":
+		if !sess.multi {
+			return errReply("ERR EXEC without MULTI")
+		}
+		queued, dirty := sess.queued, sess.dirty
+		aborted := s.watchedChanged(sess)
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		if dirty {
+			return errReply("EXECABORT Transaction discarded because of previous errors.")
+		}
+		if aborted {
+			return nullArray{}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, cmd := range queued {
+			replies[i] = s.exec(strings.ToUpper(cmd[0]), cmd[1:])
+		}
+		return replies
+	case "DISCARD":
+		if !sess.multi {
+			return errReply("ERR DISCARD without MULTI")
+		}
+		sess.multi, sess.queued, sess.watched = false, nil, nil
+		return statusOK
+	case "WATCH":
+		if sess.multi {
+			return errReply("ERR WATCH inside MULTI is not allowed")
+		}
+		if len(args) < 2 {
+			return wrongArgs(name)
+		}
+		if sess.watched == nil {
+			sess.watched = map[string]uint64{}
+		}
+		for _, key := range args[1:] {
+			if _, ok := sess.watched[key]; !ok {
+				sess.watched[key] = s.version[key]
+			}
+		}
+		return statusOK
+	case "UNWATCH":
+		sess.watched = nil
+		return statusOK
+	}
+	if _, known := commands[name]; !known {
+		if sess.multi {
+			sess.dirty = true
+		}
+		return errReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if sess.multi {
+		sess.queued = append(sess.queued, args)
+		return status("QUEUED")
+	}
+	return s.exec(name, args[1:])
+}
+
+func (s *Server) watchedChanged(sess *session) bool {
+	for key, v := range sess.watched {
+		if s.version[key] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// touch marks key as written, aborting the transactions watching it.
+func (s *Server) touch(key string) {
+	s.version[key]++
+}
+
+// commands are the supported commands and their minimal number of
+// arguments, the command name excluded.
+var commands = map[string]int{
+	"PING": 0, "AUTH": 1, "SELECT": 1, "FLUSHALL": 0, "KEYS": 1,
+	"GET": 1, "SET": 2, "INCR": 1, "INCRBY": 2, "DEL": 1, "EXISTS": 1,
+	"HSET": 3, "HGET": 2, "HGETALL": 1, "HMGET": 2, "HINCRBY": 3, "HDEL": 2,
+	"ZADD": 3, "ZINCRBY": 3, "ZREM": 2, "ZSCORE": 2, "ZCARD": 1,
+	"ZRANGE": 3, "ZRANGEBYSCORE": 3, "ZREVRANGEBYSCORE": 3,
+}
+
+func wrongArgs(name string) errReply {
+	return errReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func (s *Server) exec(name string, args []string) interface{} {
+	if len(args) < commands[name] {
+		return wrongArgs(name)
+	}
+	switch name {
+	case "PING":
+		return status("PONG")
+	case "AUTH", "SELECT":
+		return statusOK
+	case "FLUSHALL":
+		for _, key := range s.keys("*") {
+			s.del(key)
+		}
+		return statusOK
+	case "KEYS":
+		keys := s.keys(args[0])
+		reply := make([]interface{}, len(keys))
+		for i, k := range keys {
+			reply[i] = k
+		}
+		return reply
+	case "GET":
+		if s.hashes[args[0]] != nil || s.zsets[args[0]] != nil {
+			return errWrongType
+		}
+		if v, ok := s.strs[args[0]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		if len(args) != 2 {
+			return errSyntax
+		}
+		s.del(args[0])
+		s.strs[args[0]] = args[1]
+		s.touch(args[0])
+		return statusOK
+	case "INCR":
+		return s.incrBy(args[0], "1")
+	case "INCRBY":
+		return s.incrBy(args[0], args[1])
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			if s.del(key) {
+				n++
+			}
+		}
+		return n
+	case "EXISTS":
+		var n int64
+		for _, key := range args {
+			if s.exists(key) {
+				n++
+			}
+		}
+		return n
+	}
+	if strings.HasPrefix(name, "H") {
+		return s.execHash(name, args)
+	}
+	return s.execZSet(name, args)
+}
+
+func (s *Server) keys(pattern string) []string {
+	var keys []string
+	add := func(key string) {
+		if matched, _ := path.Match(pattern, key); matched {
+			keys = append(keys, key)
+		}
+	}
+	for key := range s.strs {
+		add(key)
+	}
+	for key := range s.hashes {
+		add(key)
+	}
+	for key := range s.zsets {
+		add(key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) exists(key string) bool {
+	_, str := s.strs[key]
+	return str || s.hashes[key] != nil || s.zsets[key] != nil
+}
+
+func (s *Server) del(key string) bool {
+	if !s.exists(key) {
+		return false
+	}
+	delete(s.strs, key)
+	delete(s.hashes, key)
+	delete(s.zsets, key)
+	s.touch(key)
+	return true
+}
+
+func (s *Server) incrBy(key, by string) interface{} {
+	if s.hashes[key] != nil || s.zsets[key] != nil {
+		return errWrongType
+	}
+	n, err := strconv.ParseInt(by, 10, 64)
+	if err != nil {
+		return errNotInt
+	}
+	var v int64
+	if str, ok := s.strs[key]; ok {
+		if v, err = strconv.ParseInt(str, 10, 64); err != nil {
+			return errNotInt
+		}
+	}
+	v += n
+	s.strs[key] = strconv.FormatInt(v, 10)
+	s.touch(key)
+	return v
+}
+
+func (s *Server) hash(key string, create bool) (map[string]string, interface{}) {
+	if _, ok := s.strs[key]; ok || s.zsets[key] != nil {
+		return nil, errWrongType
+	}
+	h := s.hashes[key]
+	if h == nil && create {
+		h = map[string]string{}
+		s.hashes[key] = h
+	}
+	return h, nil
+}
+
+func (s *Server) execHash(name string, args []string) interface{} {
+	key := args[0]
+	h, e := s.hash(key, name == "HSET" || name == "HINCRBY")
+	if e != nil {
+		return e
+	}
+	switch name {
+	case "HSET":
+		if len(args)%2 != 1 {
+			return wrongArgs(name)
+		}
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		s.touch(key)
+		return added
+	case "HGET":
+		if v, ok := h[args[1]]; ok {
+			return v
+		}
+		return nil
+	case "HGETALL":
+		fields := make([]string, 0, len(h))
+		for f := range h {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		reply := make([]interface{}, 0, 2*len(h))
+		for _, f := range fields {
+			reply = append(reply, f, h[f])
+		}
+		return reply
+	case "HMGET":
+		reply := make([]interface{}, len(args)-1)
+		for i, f := range args[1:] {
+			if v, ok := h[f]; ok {
+				reply[i] = v
+			}
+		}
+		return reply
+	case "HINCRBY":
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		var v int64
+		if str, ok := h[args[1]]; ok {
+			if v, err = strconv.ParseInt(str, 10, 64); err != nil {
+				return errReply("ERR hash value is not an integer")
+			}
+		}
+		v += n
+		h[args[1]] = strconv.FormatInt(v, 10)
+		s.touch(key)
+		return v
+	case "HDEL":
+		var n int64
+		for _, f := range args[1:] {
+			if _, ok := h[f]; ok {
+				delete(h, f)
+				n++
+			}
+		}
+		if n > 0 {
+			if len(h) == 0 {
+				delete(s.hashes, key)
+			}
+			s.touch(key)
+		}
+		return n
+	}
+	return errReply("ERR unknown command")
+}
+
+// formatScore formats a score as Redis does, integers without a decimal
+// point.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+func parseScore(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errors.New("not a float")
+	}
+	return f, nil
+}
+
+// parseBound parses a ZRANGEBYSCORE bound, exclusive if prefixed by (.
+func parseBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	f, err := parseScore(s)
+	return f, exclusive, err
+}
+
+func (s *Server) zset(key string, create bool) (map[string]float64, interface{}) {
+	if _, ok := s.strs[key]; ok || s.hashes[key] != nil {
+		return nil, errWrongType
+	}
+	z := s.zsets[key]
+	if z == nil && create {
+		z = map[string]float64{}
+		s.zsets[key] = z
+	}
+	return z, nil
+}
+
+type entry struct {
+	member string
+	score  float64
+}
+
+// sorted returns the members of z by score, then member.
+func sorted(z map[string]float64) []entry {
+	entries := make([]entry, 0, len(z))
+	for m, score := range z {
+		entries = append(entries, entry{m, score})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].score != entries[j].score {
+			return entries[i].score < entries[j].score
+		}
+		return entries[i].member < entries[j].member
+	})
+	return entries
+}
+
+func rangeReply(entries []entry, withScores bool) []interface{} {
+	reply := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		reply = append(reply, e.member)
+		if withScores {
+			reply = append(reply, formatScore(e.score))
+		}
+	}
+	return reply
+}
+
+func (s *Server) execZSet(name string, args []string) interface{} {
+	key := args[0]
+	z, e := s.zset(key, false)
+	if e != nil {
+		return e
+	}
+	switch name {
+	case "ZADD":
+		return s.zadd(key, args[1:])
+	case "ZINCRBY":
+		by, err := parseScore(args[1])
+		if err != nil {
+			return errNotFloat
+		}
+		z, _ = s.zset(key, true)
+		z[args[2]] += by
+		s.touch(key)
+		return formatScore(z[args[2]])
+	case "ZREM":
+		var n int64
+		for _, m := range args[1:] {
+			if _, ok := z[m]; ok {
+				delete(z, m)
+				n++
+			}
+		}
+		if n > 0 {
+			if len(z) == 0 {
+				delete(s.zsets, key)
+			}
+			s.touch(key)
+		}
+		return n
+	case "ZSCORE":
+		if score, ok := z[args[1]]; ok {
+			return formatScore(score)
+		}
+		return nil
+	case "ZCARD":
+		return int64(len(z))
+	case "ZRANGE":
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			return errNotInt
+		}
+		withScores := len(args) == 4 && strings.ToUpper(args[3]) == "WITHSCORES"
+		if len(args) > 4 || len(args) == 4 && !withScores {
+			return errSyntax
+		}
+		entries := sorted(z)
+		n := len(entries)
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		if start > stop {
+			return []interface{}{}
+		}
+		return rangeReply(entries[start:stop+1], withScores)
+	}
+	// ZRANGEBYSCORE key min max, ZREVRANGEBYSCORE key max min
+	lo, hi := args[1], args[2]
+	if name == "ZREVRANGEBYSCORE" {
+		lo, hi = hi, lo
+	}
+	min, minEx, err1 := parseBound(lo)
+	max, maxEx, err2 := parseBound(hi)
+	if err1 != nil || err2 != nil {
+		return errReply("ERR min or max is not a float")
+	}
+	withScores, offset, count := false, 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errSyntax
+			}
+			var err1, err2 error
+			offset, err1 = strconv.Atoi(args[i+1])
+			count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return errNotInt
+			}
+			i += 2
+		default:
+			return errSyntax
+		}
+	}
+	var entries []entry
+	for _, e := range sorted(z) {
+		if e.score < min || minEx && e.score == min || e.score > max || maxEx && e.score == max {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if name == "ZREVRANGEBYSCORE" {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	if offset < 0 || offset >= len(entries) {
+		return []interface{}{}
+	}
+	entries = entries[offset:]
+	if count >= 0 && count < len(entries) {
+		entries = entries[:count]
+	}
+	return rangeReply(entries, withScores)
+}
+
+// zadd implements ZADD key [NX|XX] [INCR] score member [score member ...].
+func (s *Server) zadd(key string, args []string) interface{} {
+	var nx, xx, incr bool
+options:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || len(args)%2 != 0 || nx && xx || incr && len(args) != 2 {
+		return errSyntax
+	}
+	scores := make([]float64, len(args)/2)
+	for i := range scores {
+		f, err := parseScore(args[2*i])
+		if err != nil {
+			return errNotFloat
+		}
+		scores[i] = f
+	}
+	z, _ := s.zset(key, false)
+	var added int64
+	var result interface{}
+	for i, score := range scores {
+		m := args[2*i+1]
+		old, exists := z[m]
+		if exists && nx || !exists && xx {
+			continue
+		}
+		if z == nil {
+			z, _ = s.zset(key, true)
+		}
+		if incr {
+			score += old
+			result = formatScore(score)
+		}
+		if !exists {
+			added++
+		}
+		z[m] = score
+		s.touch(key)
+	}
+	if incr {
+		return result
+	}
+	return added
+}
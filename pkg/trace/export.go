@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type writerExporter struct {
+	w io.Writer
+}
+
+// NewWriterExporter writes spans to w as JSON lines.
+func NewWriterExporter(w io.Writer) Exporter {
+	return &writerExporter{w: w}
+}
+
+type jsonSpan struct {
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentSpanId,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       Kind                   `json:"kind"`
+	Start      time.Time              `json:"start"`
+	DurationMS float64                `json:"durationMs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Err        string                 `json:"error,omitempty"`
+}
+
+func (e *writerExporter) Export(spans []*Span) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start.UTC(),
+			DurationMS: float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Attributes: s.Attributes,
+			Err:        s.Err,
+		}
+		if s.Parent != (SpanID{}) {
+			js.ParentID = s.Parent.String()
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *writerExporter) Close() error {
+	return nil
+}
+
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+// NewOTLPExporter posts spans to an OpenTelemetry collector with OTLP/HTTP
+// in its JSON encoding, endpoint is usually http://collector:4318/v1/traces.
+func NewOTLPExporter(endpoint, service string) Exporter {
+	return &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributeOf(key string, v interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := v.(type) {
+	case string:
+		a.Value.StringValue = &v
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         Kind            `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+func (e *otlpExporter) Export(spans []*Span) error {
+	converted := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID: s.Context.TraceID.String(),
+			SpanID:  s.Context.SpanID.String(),
+			Name:    s.Name,
+			Kind:    s.Kind,
+			Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			o.ParentSpanID = s.Parent.String()
+		}
+		for k, v := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttributeOf(k, v))
+		}
+		if s.Err != "" {
+			// STATUS_CODE_ERROR
+			o.Status = otlpStatus{Code: 2, Message: s.Err}
+		}
+		converted[i] = o
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{otlpAttributeOf("service.name", e.service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/friends-of-scalability/url-shortener/pkg/trace"},
+				"spans": converted,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("trace: collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	sc, _ := ParseTraceparent("00-" + traceID + "-" + spanID + "-01")
+	start := time.Unix(1500000000, 5)
+	s := &Span{
+		Name:    "GET /{shortURL}",
+		Kind:    KindServer,
+		Context: SpanContext{TraceID: sc.TraceID, SpanID: SpanID{1, 2, 3, 4, 5, 6, 7, 8}, Sampled: true},
+		Parent:  sc.SpanID,
+		Start:   start,
+		End:     start.Add(time.Millisecond),
+		Attributes: map[string]interface{}{
+			"http.status_code": 500,
+			"cache.hit":        true,
+			"ratio":            0.5,
+			"http.route":       "/{shortURL}",
+		},
+		Err: "Internal Server Error",
+	}
+	if err := NewOTLPExporter(srv.URL, "url-shortener").Export([]*Span{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.ResourceSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans) != 1 || len(payload.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("payload %s, want one resource, scope and span", body)
+	}
+	rs := payload.ResourceSpans[0]
+	if a := rs.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value.StringValue == nil || *a[0].Value.StringValue != "url-shortener" {
+		t.Errorf("resource attributes %+v, want the service name", a)
+	}
+	if rs.ScopeSpans[0].Scope.Name == "" {
+		t.Error("scope without a name")
+	}
+	got := rs.ScopeSpans[0].Spans[0]
+	want := otlpSpan{
+		TraceID:      traceID,
+		SpanID:       "0102030405060708",
+		ParentSpanID: spanID,
+		Name:         "GET /{shortURL}",
+		Kind:         KindServer,
+		Start:        "1500000000000000005",
+		End:          "1500000000001000005",
+		Status:       otlpStatus{Code: 2, Message: "Internal Server Error"},
+	}
+	attributes := got.Attributes
+	got.Attributes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("span %+v, want %+v", got, want)
+	}
+	values := map[string]otlpValue{}
+	for _, a := range attributes {
+		values[a.Key] = a.Value
+	}
+	if v := values["http.status_code"]; v.IntValue == nil || *v.IntValue != "500" {
+		t.Errorf("integer attribute %+v, want the string 500", v)
+	}
+	if v := values["cache.hit"]; v.BoolValue == nil || !*v.BoolValue {
+		t.Errorf("bool attribute %+v", v)
+	}
+	if v := values["ratio"]; v.DoubleValue == nil || *v.DoubleValue != 0.5 {
+		t.Errorf("double attribute %+v", v)
+	}
+	if v := values["http.route"]; v.StringValue == nil || *v.StringValue != "/{shortURL}" {
+		t.Errorf("string attribute %+v", v)
+	}
+	// integers are strings, as in the OTLP JSON encoding of int64
+	if !strings.Contains(string(body), `"intValue":"500"`) {
+		t.Errorf("payload %s, want an intValue string", body)
+	}
+}
+
+func TestOTLPExporterFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	s := &Span{Name: "a", Kind: KindInternal, Start: time.Now(), End: time.Now()}
+	if err := NewOTLPExporter(srv.URL, "url-shortener").Export([]*Span{s}); err == nil {
+		t.Error("rejected export succeeded")
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var b strings.Builder
+	start := time.Unix(1500000000, 0)
+	spans := []*Span{
+		{Name: "root", Kind: KindServer, Start: start, End: start.Add(1500 * time.Microsecond), Context: SpanContext{SpanID: SpanID{1}}},
+		{Name: "child", Kind: KindClient, Start: start, End: start, Parent: SpanID{1}, Err: "down"},
+	}
+	if err := NewWriterExporter(&b).Export(spans); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want 2: %s", len(lines), b.String())
+	}
+	var root, child jsonSpan
+	if err := json.Unmarshal([]byte(lines[0]), &root); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &child); err != nil {
+		t.Fatal(err)
+	}
+	if root.Name != "root" || root.ParentID != "" || root.DurationMS != 1.5 {
+		t.Errorf("root span %+v", root)
+	}
+	if child.ParentID != root.SpanID || child.Err != "down" {
+		t.Errorf("child span %+v, want a failed child of %s", child, root.SpanID)
+	}
+}
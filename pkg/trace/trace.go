@@ -0,0 +1,299 @@
+// Package trace records the spans of distributed traces. Traces are
+// propagated with the W3C trace context traceparent header and finished
+// spans are exported in batches, as JSON lines or to an OpenTelemetry
+// collector.
+//
+// A nil *Tracer and a nil *Span are valid and record nothing, so tracing can
+// be disabled without checks at every call site.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// SpanContext is the part of a span propagated across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value.
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	var version [1]byte
+	if len(parts) < 4 || !decodeHex(version[:], parts[0]) || version[0] == 0xff {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Inject sets the traceparent header h of an outbound request to the span
+// in ctx, if any.
+func Inject(ctx context.Context, h http.Header) {
+	if s := FromContext(ctx); s != nil {
+		h.Set("traceparent", s.Context.Traceparent())
+	}
+}
+
+// Kind is the role of a span in a trace.
+type Kind int
+
+// Kinds of span, numbered as in OpenTelemetry.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is an operation of a trace. Its fields must not be changed once
+// ended.
+type Span struct {
+	Name       string
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	// Err is the error the operation failed with, if any
+	Err string
+
+	tracer *Tracer
+	mtx    sync.Mutex
+	ended  bool
+}
+
+// SetAttribute records a string, bool, integer or float64 value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed, a nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.Err = err.Error()
+}
+
+// Finish ends the span and queues it for export. Only the first call has an
+// effect.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mtx.Unlock()
+	if s.Context.Sampled {
+		s.tracer.queue(s)
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// FromContext returns the span stored in ctx, if any.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// ContextWithRemote stores the span context of a remote parent in ctx, the
+// next span started from ctx becomes its child.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+const (
+	maxQueued = 4096
+	batchSize = 512
+)
+
+// Tracer starts spans and exports them with an Exporter. Spans are exported
+// every second, or sooner once batchSize are waiting; spans finished while
+// maxQueued are waiting are dropped.
+type Tracer struct {
+	exporter Exporter
+	ratio    float64
+	onError  func(error)
+
+	mtx    sync.RWMutex
+	closed bool
+	spans  chan *Span
+	done   chan struct{}
+}
+
+// NewTracer samples ratio, in [0, 1], of the traces started here. Traces
+// continued from a remote parent follow its sampling decision. Export
+// errors are passed to onError, if not nil.
+func NewTracer(exporter Exporter, ratio float64, onError func(error)) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		ratio:    ratio,
+		onError:  onError,
+		spans:    make(chan *Span, maxQueued),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// Start starts a span, child of the span or remote parent in ctx, and
+// returns a context holding it. The span must be finished with Finish.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), tracer: t}
+	if parent := FromContext(ctx); parent != nil {
+		s.Context.TraceID = parent.Context.TraceID
+		s.Context.Sampled = parent.Context.Sampled
+		s.Parent = parent.Context.SpanID
+	} else if remote, ok := ctx.Value(remoteKey).(SpanContext); ok {
+		s.Context.TraceID = remote.TraceID
+		s.Context.Sampled = remote.Sampled
+		s.Parent = remote.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.ratio >= 1 || mathrand.Float64() < t.ratio
+	}
+	rand.Read(s.Context.SpanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+func (t *Tracer) queue(s *Span) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		// exporter too slow, drop the span
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil && t.onError != nil {
+			t.onError(err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close exports the spans finished so far and closes the exporter. Spans
+// finished afterwards are dropped.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mtx.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mtx.Unlock()
+	<-t.done
+	return t.exporter.Close()
+}
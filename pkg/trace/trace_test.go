@@ -0,0 +1,115 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+const (
+	traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, test := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-" + traceID + "-" + spanID + "-01", true, true},
+		{"00-" + traceID + "-" + spanID + "-00", true, false},
+		{" 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		// only the sampled flag is known, the others are ignored
+		{"00-" + traceID + "-" + spanID + "-03", true, true},
+		{"00-" + traceID + "-" + spanID + "-02", true, false},
+		// later versions may add fields after the flags
+		{"01-" + traceID + "-" + spanID + "-01", true, true},
+		{"cc-" + traceID + "-" + spanID + "-01-what-comes-next", true, true},
+		{"00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		// version ff is invalid, versions are two lowercase hex digits
+		{"ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"zz-" + traceID + "-" + spanID + "-01", false, false},
+		{"0-" + traceID + "-" + spanID + "-01", false, false},
+		{"AA-" + traceID + "-" + spanID + "-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"00-" + traceID + "-0000000000000000-01", false, false},
+		{"00-" + traceID[1:] + "-" + spanID + "-01", false, false},
+		{"00-" + traceID + "-" + spanID + "-1", false, false},
+		{"00-" + traceID + "-" + spanID, false, false},
+		{"", false, false},
+	} {
+		sc, ok := ParseTraceparent(test.header)
+		if ok != test.ok || ok && sc.Sampled != test.sampled {
+			t.Errorf("%q: %+v, %v, want ok %v and sampled %v", test.header, sc, ok, test.ok, test.sampled)
+			continue
+		}
+		if ok && (sc.TraceID.String() != traceID || sc.SpanID.String() != spanID) {
+			t.Errorf("%q: IDs %s and %s", test.header, sc.TraceID, sc.SpanID)
+		}
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, h := range []string{"00-" + traceID + "-" + spanID + "-01", "00-" + traceID + "-" + spanID + "-00"} {
+		sc, ok := ParseTraceparent(h)
+		if !ok {
+			t.Fatalf("%q not parsed", h)
+		}
+		if got := sc.Traceparent(); got != h {
+			t.Errorf("%q formatted as %q", h, got)
+		}
+	}
+}
+
+// recorder keeps the spans exported.
+type recorder struct {
+	mtx   sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(spans []*Span) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func (r *recorder) Close() error { return nil }
+
+func TestTracerContinuesRemoteTraces(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(rec, 0, nil)
+	remote, _ := ParseTraceparent("00-" + traceID + "-" + spanID + "-01")
+	ctx, server := tracer.Start(ContextWithRemote(context.Background(), remote), "server", KindServer)
+	ctx, client := tracer.Start(ctx, "client", KindClient)
+	h := http.Header{}
+	Inject(ctx, h)
+	client.Finish()
+	server.Finish()
+	// not sampled here, but the remote parent is
+	_, local := tracer.Start(context.Background(), "local", KindInternal)
+	local.Finish()
+	tracer.Close()
+
+	if len(rec.spans) != 2 {
+		t.Fatalf("%d spans exported, want 2", len(rec.spans))
+	}
+	if server.Context.TraceID != remote.TraceID || server.Parent != remote.SpanID {
+		t.Errorf("server span %+v is not a child of the remote span", server.Context)
+	}
+	if client.Context.TraceID != remote.TraceID || client.Parent != server.Context.SpanID {
+		t.Errorf("client span %+v is not a child of the server span", client.Context)
+	}
+	if got, want := h.Get("traceparent"), client.Context.Traceparent(); got != want {
+		t.Errorf("injected traceparent %q, want %q", got, want)
+	}
+
+	h = http.Header{}
+	Inject(context.Background(), h)
+	if len(h) != 0 {
+		t.Errorf("injected %v without a span", h)
+	}
+}